@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// AccessLogEntry is what is known about a finished request, available to
+// ACCESS_LOG_FORMAT templates as {{.Method}}, {{.Status}} and so on
+type AccessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"-"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	RequestID  string        `json:"request_id"`
+}
+
+// accessLogFormat writes access log entries in one of the presets or a
+// custom template
+type accessLogFormat struct {
+	logger *log.Logger
+	format func(AccessLogEntry) string
+}
+
+// newAccessLogFormat parses ACCESS_LOG_FORMAT: "default" (the board's own
+// format), "common" or "combined" (Apache), "json", or a text/template over
+// AccessLogEntry. Only the default format is prefixed with the log
+// timestamp; the others carry their own.
+func newAccessLogFormat(spec string) (*accessLogFormat, error) {
+	bare := log.New(os.Stderr, "", 0)
+
+	switch spec {
+	case "", "default":
+		return &accessLogFormat{logger: log.Default(), format: formatDefaultAccess}, nil
+	case "common":
+		return &accessLogFormat{logger: bare, format: formatCommonAccess}, nil
+	case "combined":
+		return &accessLogFormat{logger: bare, format: formatCombinedAccess}, nil
+	case "json":
+		return &accessLogFormat{logger: bare, format: formatJSONAccess}, nil
+	}
+
+	if !strings.Contains(spec, "{{") {
+		return nil, fmt.Errorf("unknown preset %q, expected default, common, combined, json or a template", spec)
+	}
+	tmpl, err := template.New("access").Option("missingkey=error").Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogFormat{logger: bare, format: func(e AccessLogEntry) string {
+		var line strings.Builder
+		if err := tmpl.Execute(&line, e); err != nil {
+			return fmt.Sprintf("access log template failed: %v", err)
+		}
+		return line.String()
+	}}, nil
+}
+
+// write logs one entry
+func (f *accessLogFormat) write(e AccessLogEntry) {
+	f.logger.Println(f.format(e))
+}
+
+// formatDefaultAccess is the board's original format:
+// method, URI, status, duration, client address and request ID
+func formatDefaultAccess(e AccessLogEntry) string {
+	return fmt.Sprintf("%s %s %d %v %s %s", e.Method, e.URI, e.Status, e.Duration, e.RemoteAddr, e.RequestID)
+}
+
+// formatCommonAccess is the Apache Common Log Format
+func formatCommonAccess(e AccessLogEntry) string {
+	bytes := "-"
+	if e.Bytes > 0 {
+		bytes = strconv.FormatInt(e.Bytes, 10)
+	}
+	host, _, err := net.SplitHostPort(e.RemoteAddr)
+	if err != nil {
+		host = e.RemoteAddr
+	}
+	return fmt.Sprintf(`%s - - [%s] "%s %s %s" %d %s`,
+		host, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, escapeLogField(e.URI), e.Proto, e.Status, bytes)
+}
+
+// formatCombinedAccess is the Apache Combined Log Format: the common format
+// plus referer and user agent
+func formatCombinedAccess(e AccessLogEntry) string {
+	return fmt.Sprintf(`%s "%s" "%s"`, formatCommonAccess(e), orDash(escapeLogField(e.Referer)), orDash(escapeLogField(e.UserAgent)))
+}
+
+// formatJSONAccess writes an entry as a JSON object, one per line
+func formatJSONAccess(e AccessLogEntry) string {
+	data, err := json.Marshal(struct {
+		AccessLogEntry
+		DurationMs float64 `json:"duration_ms"`
+	}{e, float64(e.Duration) / float64(time.Millisecond)})
+	if err != nil {
+		return fmt.Sprintf(`{"error":%q}`, err.Error())
+	}
+	return string(data)
+}
+
+// escapeLogField escapes quotes and backslashes so client-supplied values
+// can't break out of a quoted log field
+func escapeLogField(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// orDash returns "-" for empty fields, as Apache logs do
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// generationUsage counts the tokens spent on one request, across every
+// generation attempt it makes
+type generationUsage struct {
+	tokens atomic.Int64
+}
+
+// usageContextKey is the context key for the request's generationUsage
+type usageContextKey struct{}
+
+// contextWithUsage returns a context that collects token counts into usage
+func contextWithUsage(ctx context.Context, usage *generationUsage) context.Context {
+	return context.WithValue(ctx, usageContextKey{}, usage)
+}
+
+// addUsage records tokens against the usage carried by ctx, if any
+func addUsage(ctx context.Context, tokens int64) {
+	if usage, ok := ctx.Value(usageContextKey{}).(*generationUsage); ok {
+		usage.tokens.Add(tokens)
+	}
+}
+
+// UsageStats is the running token and cost total reported by /stats
+type UsageStats struct {
+	Tokens int64   `json:"tokens"`
+	Cost   float64 `json:"cost"`
+}
+
+// costMeter prices token usage and keeps running totals
+type costMeter struct {
+	costPerToken float64
+	mu           sync.Mutex
+	totals       UsageStats
+}
+
+// newCostMeter creates a cost meter charging costPerToken per token
+func newCostMeter(costPerToken float64) *costMeter {
+	return &costMeter{costPerToken: costPerToken}
+}
+
+// record adds a request's usage to the totals and returns its cost
+func (m *costMeter) record(usage *generationUsage) float64 {
+	tokens := usage.tokens.Load()
+	cost := float64(tokens) * m.costPerToken
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.totals.Tokens += tokens
+	m.totals.Cost += cost
+	return cost
+}
+
+// Totals returns the usage recorded so far
+func (m *costMeter) Totals() UsageStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.totals
+}
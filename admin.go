@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// ReloadResponse lists what an admin reload swapped in
+type ReloadResponse struct {
+	Reloaded []string `json:"reloaded"`
+}
+
+// authorizeAdmin checks the request's bearer token against ADMIN_TOKEN.
+// Nobody is an admin when ADMIN_TOKEN is unset.
+func (app *App) authorizeAdmin(r *http.Request) bool {
+	if app.config.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(app.config.AdminToken)) == 1
+}
+
+// adminReloadHandler re-reads the message overrides and prompt templates.
+// Everything is loaded and validated before anything is swapped, so a bad
+// file leaves the running configuration untouched.
+func (app *App) adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(r) {
+		respondWithError(w, r, "The spirits do not answer to you", http.StatusUnauthorized)
+		return
+	}
+
+	messages, err := loadMessages(app.config.MessagesFile)
+	if err != nil {
+		log.Printf("Admin reload rejected: %v", err)
+		respondWithError(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	prompts, err := loadPromptSet(app.config.PromptTemplateFile, app.config.ModelPromptTemplates)
+	if err != nil {
+		log.Printf("Admin reload rejected: %v", err)
+		respondWithError(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	app.messages.Store(&messages)
+	reloaded := []string{"messages"}
+	if reloader, ok := app.generator.(promptReloader); ok {
+		reloader.SetPrompts(prompts)
+		reloaded = append(reloaded, "prompts")
+	}
+
+	log.Printf("Admin reload: swapped in %s (messages file %q, prompt template file %q, %d model templates)",
+		strings.Join(reloaded, ", "), app.config.MessagesFile, app.config.PromptTemplateFile, len(app.config.ModelPromptTemplates))
+
+	respondWithJSON(w, r, ReloadResponse{Reloaded: reloaded}, http.StatusOK)
+}
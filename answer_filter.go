@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ANSWER_FILTER modes
+const (
+	answerFilterOff        = "off"
+	answerFilterMask       = "mask"
+	answerFilterRegenerate = "regenerate"
+)
+
+// answerFilter keeps words from ANSWER_FILTER_WORDS out of answers, for
+// family-friendly boards. In "mask" mode matches are replaced with
+// asterisks; in "regenerate" mode the answer is generated once more and
+// masked only if the new one matches too.
+type answerFilter struct {
+	mode    string
+	pattern *regexp.Regexp
+	// span is the most words any filtered entry has
+	span int
+}
+
+// newAnswerFilter creates a filter for mode and words, or nil when mode is off
+func newAnswerFilter(mode string, words []string) (*answerFilter, error) {
+	switch mode {
+	case "", answerFilterOff:
+		return nil, nil
+	case answerFilterMask, answerFilterRegenerate:
+	default:
+		return nil, fmt.Errorf("invalid ANSWER_FILTER %q, expected off, mask or regenerate", mode)
+	}
+	if len(words) == 0 {
+		return nil, errors.New("ANSWER_FILTER needs at least one ANSWER_FILTER_WORDS entry")
+	}
+
+	quoted := make([]string, len(words))
+	span := 1
+	for i, word := range words {
+		quoted[i] = regexp.QuoteMeta(word)
+		span = max(span, len(strings.FieldsFunc(word, isNotWordRune)))
+	}
+	pattern, err := regexp.Compile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+	if err != nil {
+		return nil, err
+	}
+	return &answerFilter{mode: mode, pattern: pattern, span: span}, nil
+}
+
+// matches reports whether answer contains a filtered word
+func (f *answerFilter) matches(answer string) bool {
+	return f != nil && f.pattern.MatchString(answer)
+}
+
+// regenerates reports whether matching answers should be generated again
+// before falling back to masking
+func (f *answerFilter) regenerates() bool {
+	return f != nil && f.mode == answerFilterRegenerate
+}
+
+// undecided returns where the end of streamed text that may still grow into
+// a filtered entry starts: the word being written and, for entries of
+// several words, the complete words before it that could begin one. Text
+// before it can be masked on its own and sent.
+func (f *answerFilter) undecided(text string) int {
+	if f == nil {
+		return len(text)
+	}
+
+	end := len(text)
+	words := f.span - 1
+	if last, _ := utf8.DecodeLastRuneInString(text); text != "" && !isNotWordRune(last) {
+		// The last word may not be finished
+		words++
+	}
+	for ; words > 0; words-- {
+		// Step back over the separators to the previous word, then to its start
+		inWord := strings.LastIndexFunc(text[:end], func(r rune) bool { return !isNotWordRune(r) })
+		if inWord < 0 {
+			return end
+		}
+		separator := strings.LastIndexFunc(text[:inWord], isNotWordRune)
+		if separator < 0 {
+			return 0
+		}
+		_, size := utf8.DecodeRuneInString(text[separator:])
+		end = separator + size
+	}
+
+	// A match running on into the held back text is held back whole
+	for _, loc := range f.pattern.FindAllStringIndex(text, -1) {
+		if loc[0] < end && end < loc[1] {
+			return loc[0]
+		}
+	}
+	return end
+}
+
+// mask replaces each filtered word in answer with as many asterisks
+func (f *answerFilter) mask(answer string) string {
+	if f == nil {
+		return answer
+	}
+	return f.pattern.ReplaceAllStringFunc(answer, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+}
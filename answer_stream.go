@@ -0,0 +1,151 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	// htmlTagAtStart matches an htmlTagPattern construct at the start of text
+	htmlTagAtStart = regexp.MustCompile(`^(?:` + htmlTagPattern.String() + `)`)
+	// htmlBlockStart matches the opening of an element stripped with its contents
+	htmlBlockStart = regexp.MustCompile(`(?i)^<(?:script|style)\b`)
+	// htmlBlockAtStart matches a whole script or style element at the start of text
+	htmlBlockAtStart = regexp.MustCompile(`(?is)^(?:<script\b.*?</script\s*>|<style\b.*?</style\s*>)`)
+)
+
+// answerStream applies the answer post-processing that can work on a
+// partial answer to chunks as they stream, so a client reading the stream
+// never sees what the final answer has removed. Text that can't be decided
+// yet, such as a tag whose ">" hasn't arrived, a word that may still become
+// a filtered one or the start of a possible question echo, is held back
+// until it can.
+type answerStream struct {
+	// html is the ESCAPE_ANSWER_HTML mode
+	html string
+	// filter masks filtered words, which can't be regenerated once streamed
+	filter *answerFilter
+	// echo is the question while the answer may still start by echoing it,
+	// see STRIP_QUESTION_ECHO
+	echo    string
+	emit    func(string) error
+	pending string
+}
+
+// newAnswerStream creates a stream answering question, passing processed
+// chunks to emit
+func (c *OllamaClient) newAnswerStream(question string, emit func(string) error) *answerStream {
+	s := &answerStream{html: c.answerHTML, filter: c.filter, emit: emit}
+	if c.stripEcho {
+		s.echo = question
+	}
+	return s
+}
+
+// write accepts the next model chunk, sending on whatever is decided
+func (s *answerStream) write(chunk string) error {
+	s.pending += chunk
+	if s.echo != "" {
+		// Nothing is sent until it is known whether the answer echoes the
+		// question, then the echo is dropped
+		n, decided := questionEcho(s.pending, s.echo)
+		if !decided {
+			return nil
+		}
+		s.pending, s.echo = s.pending[n:], ""
+	}
+	ready := s.pending[:s.decided()]
+	s.pending = s.pending[len(ready):]
+	return s.send(ready)
+}
+
+// flush sends any held back text once the model is done. An answer that
+// never got past a possible echo is sent as it is.
+func (s *answerStream) flush() error {
+	pending := s.pending
+	s.pending = ""
+	return s.send(pending)
+}
+
+// send processes decided text and passes it on, unless nothing is left
+func (s *answerStream) send(text string) error {
+	switch s.html {
+	case "escape":
+		// Escaping is per character, so chunks can be escaped on their own
+		text = html.EscapeString(text)
+	case "strip":
+		// Unlike sanitizeAnswerHTML, spacing is kept, since it may separate
+		// this chunk's words from the next one's
+		text = htmlTagPattern.ReplaceAllString(text, "")
+	}
+	text = s.filter.mask(text)
+	if text == "" {
+		return nil
+	}
+	return s.emit(text)
+}
+
+// decided returns how much of the pending text can be sent: neither the
+// words the filter can't judge yet nor unfinished markup
+func (s *answerStream) decided() int {
+	return min(s.filter.undecided(s.pending), s.decidedHTML())
+}
+
+// decidedHTML returns how much of the pending text is decided as markup.
+// With ESCAPE_ANSWER_HTML=strip, text from a "<" that may still become a
+// tag, comment or script element is held back until it is complete.
+func (s *answerStream) decidedHTML() int {
+	if s.html != "strip" {
+		return len(s.pending)
+	}
+
+	for i := 0; i < len(s.pending); {
+		next := strings.IndexByte(s.pending[i:], '<')
+		if next < 0 {
+			break
+		}
+		i += next
+		rest := s.pending[i:]
+
+		if htmlBlockStart.MatchString(rest) {
+			loc := htmlBlockAtStart.FindStringIndex(rest)
+			if loc == nil {
+				return i
+			}
+			i += loc[1]
+			continue
+		}
+		if loc := htmlTagAtStart.FindStringIndex(rest); loc != nil {
+			i += loc[1]
+			continue
+		}
+		if mayBecomeTag(rest) {
+			return i
+		}
+		i++
+	}
+	return len(s.pending)
+}
+
+// mayBecomeTag reports whether text, starting with "<", is the unfinished
+// start of something htmlTagPattern would strip, rather than a literal "<"
+func mayBecomeTag(text string) bool {
+	if len(text) == 1 {
+		return true
+	}
+	switch c := text[1]; {
+	case isASCIILetter(c):
+		return true
+	case c == '/':
+		return len(text) == 2 || isASCIILetter(text[2])
+	case c == '!':
+		return strings.HasPrefix(text, "<!--") || strings.HasPrefix("<!--", text)
+	}
+	return false
+}
+
+// isASCIILetter reports whether c is an ASCII letter
+func isASCIILetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
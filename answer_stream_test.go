@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// streamThrough passes chunks through an answerStream, returning what it emits
+func streamThrough(t *testing.T, stream *answerStream, chunks []string) []string {
+	t.Helper()
+
+	var emitted []string
+	stream.emit = func(chunk string) error {
+		emitted = append(emitted, chunk)
+		return nil
+	}
+	for _, chunk := range chunks {
+		if err := stream.write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return emitted
+}
+
+func TestAnswerStreamHTML(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		chunks []string
+		want   string
+	}{
+		{name: "off", mode: "off", chunks: []string{"<b>YES", "</b>"}, want: "<b>YES</b>"},
+		{name: "escape", mode: "escape", chunks: []string{"<scr", "ipt>alert(1)</script>", " YES"}, want: "&lt;script&gt;alert(1)&lt;/script&gt; YES"},
+		{name: "strip whole tags", mode: "strip", chunks: []string{"<b>YES</b>", " it will"}, want: "YES it will"},
+		{name: "strip split tag", mode: "strip", chunks: []string{"YES <", "b", ">it", " will</", "b>"}, want: "YES it will"},
+		{name: "strip split script", mode: "strip", chunks: []string{"<scr", "ipt>alert(", "1)</scr", "ipt> YES"}, want: " YES"},
+		{name: "strip split comment", mode: "strip", chunks: []string{"YES<!", "-- hidden -", "->"}, want: "YES"},
+		{name: "literal less-than", mode: "strip", chunks: []string{"1 < 2", " and 3 <4"}, want: "1 < 2 and 3 <4"},
+		{name: "unfinished tag at the end", mode: "strip", chunks: []string{"YES <b"}, want: "YES <b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emitted := streamThrough(t, &answerStream{html: tt.mode}, tt.chunks)
+			if got := strings.Join(emitted, ""); got != tt.want {
+				t.Errorf("streamed %q, want %q", got, tt.want)
+			}
+			if tt.mode == "off" {
+				return
+			}
+			for _, chunk := range emitted {
+				leaked := strings.Contains(chunk, "<b>") || strings.Contains(chunk, "<script")
+				// Stripping removes a script's contents too
+				if tt.mode == "strip" && strings.Contains(chunk, "alert(1)") {
+					leaked = true
+				}
+				if leaked {
+					t.Errorf("chunk %q leaked markup", chunk)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamAnswerSanitized(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		want string
+	}{
+		{name: "escape", mode: "escape", want: "&lt;script&gt;alert(1)&lt;/script&gt;YES"},
+		{name: "strip", mode: "strip", want: "YES"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newFakeOllama(t, "<scr", "ipt>alert(1)</sc", "ript>", "YES")
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.EscapeAnswerHTML = tt.mode
+			})
+
+			var streamed strings.Builder
+			answer, err := client.StreamAnswer(context.Background(), "Will it rain?", func(chunk string) error {
+				if strings.Contains(chunk, "<") {
+					t.Errorf("chunk %q reached the client unsanitized", chunk)
+				}
+				streamed.WriteString(chunk)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if streamed.String() != tt.want || !strings.HasPrefix(answer, tt.want) {
+				t.Errorf("streamed %q, answered %q, want %q", streamed.String(), answer, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnswerStreamFilter(t *testing.T) {
+	filter, err := newAnswerFilter(answerFilterMask, []string{"bad", "go away"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{name: "whole word", chunks: []string{"a bad ", "omen"}, want: "a *** omen"},
+		{name: "word split across chunks", chunks: []string{"a b", "a", "d omen"}, want: "a *** omen"},
+		{name: "longer word", chunks: []string{"a bad", "ge"}, want: "a badge"},
+		{name: "word at the end", chunks: []string{"so ", "ba", "d"}, want: "so ***"},
+		{name: "phrase split across chunks", chunks: []string{"spirits go", " aw", "ay now"}, want: "spirits ******* now"},
+		{name: "phrase cut short", chunks: []string{"they go", " home"}, want: "they go home"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emitted := streamThrough(t, &answerStream{html: "off", filter: filter}, tt.chunks)
+			if got := strings.Join(emitted, ""); got != tt.want {
+				t.Errorf("streamed %q, want %q", got, tt.want)
+			}
+			for _, chunk := range emitted {
+				if strings.Contains(chunk, "bad ") || strings.HasSuffix(chunk, "bad") || strings.Contains(chunk, "away") {
+					t.Errorf("chunk %q leaked a filtered word", chunk)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamAnswerFiltered(t *testing.T) {
+	_, srv := newFakeOllama(t, "YES, the cur", "sed spirits ", "agree")
+	client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+		config.AnswerFilter = answerFilterRegenerate
+		config.AnswerFilterWords = []string{"cursed"}
+	})
+
+	var streamed strings.Builder
+	answer, err := client.StreamAnswer(context.Background(), "Will it rain?", func(chunk string) error {
+		if strings.Contains(chunk, "cur") {
+			t.Errorf("chunk %q leaked a filtered word", chunk)
+		}
+		streamed.WriteString(chunk)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "YES, the ****** spirits agree"; streamed.String() != want || !strings.HasPrefix(answer, want) {
+		t.Errorf("streamed %q, answered %q, want %q", streamed.String(), answer, want)
+	}
+}
+
+func TestStructuredAnswerFiltered(t *testing.T) {
+	_, srv := newFakeOllama(t, `{"answer":"YES, the cursed spirits agree","confidence":0.5}`)
+	client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+		config.AnswerFilter = answerFilterMask
+		config.AnswerFilterWords = []string{"cursed"}
+	})
+
+	answer, err := client.GenerateStructuredAnswer(context.Background(), "Will it rain?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "YES, the ****** spirits agree"; !strings.HasPrefix(answer.Answer, want) {
+		t.Errorf("answered %q, want %q", answer.Answer, want)
+	}
+}
+
+func TestAnswerStreamEcho(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{name: "echo split across chunks", chunks: []string{"Will", " it ra", "in?", " YES", " it will"}, want: "YES it will"},
+		{name: "echo in one chunk", chunks: []string{"Will it rain? YES"}, want: "YES"},
+		{name: "no echo", chunks: []string{"YES", " it will"}, want: "YES it will"},
+		{name: "same first words", chunks: []string{"Will", " it", " be", " so? YES"}, want: "Will it be so? YES"},
+		{name: "echo not followed by punctuation", chunks: []string{"Will it rain", " today"}, want: "Will it rain today"},
+		{name: "nothing but the echo", chunks: []string{"Will it", " rain?"}, want: "Will it rain?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			emitted := streamThrough(t, &answerStream{html: "off", echo: "Will it rain?"}, tt.chunks)
+			if got := strings.Join(emitted, ""); got != tt.want {
+				t.Errorf("streamed %q, want %q", got, tt.want)
+			}
+			// An echo that is stripped is never sent, even in part
+			if tt.want == "YES" || strings.HasPrefix(tt.want, "YES ") {
+				for _, chunk := range emitted {
+					if strings.Contains(chunk, "Will") {
+						t.Errorf("chunk %q leaked the echo", chunk)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStreamAnswerEcho(t *testing.T) {
+	tests := []struct {
+		name  string
+		strip bool
+		want  string
+	}{
+		{name: "stripped", strip: true, want: "YES, the spirits agree"},
+		{name: "off", strip: false, want: "Will it rain? YES, the spirits agree"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newFakeOllama(t, "Will", " it", " rain", "?", " YES", ", the spirits agree")
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.StripQuestionEcho = tt.strip
+			})
+
+			var streamed strings.Builder
+			answer, err := client.StreamAnswer(context.Background(), "Will it rain?", func(chunk string) error {
+				streamed.WriteString(chunk)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(streamed.String()); got != tt.want || !strings.HasPrefix(answer, tt.want) {
+				t.Errorf("streamed %q, answered %q, want %q", streamed.String(), answer, tt.want)
+			}
+		})
+	}
+}
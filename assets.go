@@ -0,0 +1,23 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"os"
+)
+
+// embeddedAssets bundles the templates and static files into the binary so it
+// doesn't depend on the working directory
+//
+//go:embed templates static
+var embeddedAssets embed.FS
+
+// loadAssets returns the filesystem holding templates/ and static/. The
+// embedded copy is used unless dir points at a directory on disk, which is
+// handy during development to pick up edits without rebuilding.
+func loadAssets(dir string) fs.FS {
+	if dir != "" {
+		return os.DirFS(dir)
+	}
+	return embeddedAssets
+}
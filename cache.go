@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// cacheEntryOverhead approximates the memory an entry costs beyond its
+// strings: the list element, map slot and string headers
+const cacheEntryOverhead = 128
+
+// answerCache is an LRU cache of generated answers, bounded by entry count,
+// approximate memory, or both
+type answerCache struct {
+	maxEntries int // 0 for no count limit
+	maxBytes   int // 0 for no memory limit
+	mu         sync.Mutex
+	bytes      int
+	order      *list.List // most recently used at the front
+	entries    map[string]*list.Element
+	hits       int64
+	misses     int64
+}
+
+// CacheStats describes the answer cache's current size and hit rate
+type CacheStats struct {
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+	// Hits and Misses count lookups since startup
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// cacheEntry is a single cached answer
+type cacheEntry struct {
+	key    string
+	answer string
+}
+
+// size returns the approximate memory used by the entry
+func (e *cacheEntry) size() int {
+	return len(e.key) + len(e.answer) + cacheEntryOverhead
+}
+
+// newAnswerCache creates a new answer cache holding up to maxEntries answers
+// in up to maxBytes of memory; either limit may be 0 to disable it
+func newAnswerCache(maxEntries, maxBytes int) *answerCache {
+	return &answerCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+	}
+}
+
+// answerCacheKey builds the cache key for a normalized question asked of a
+// model in a personality. Both are part of the key so an answer from one
+// model or personality is never served for a request to another.
+func answerCacheKey(normalized, model, personality string) string {
+	return model + "\x00" + personality + "\x00" + normalized
+}
+
+// Get returns the cached answer for key
+func (c *answerCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, exists := c.entries[key]
+	if !exists {
+		c.misses++
+		return "", false
+	}
+
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).answer, true
+}
+
+// Put stores an answer, evicting the least recently used entries when full.
+// An answer too large for the whole memory budget is not cached.
+func (c *answerCache) Put(key, answer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{key: key, answer: answer}
+	if c.maxBytes > 0 && entry.size() > c.maxBytes {
+		return
+	}
+
+	if elem, exists := c.entries[key]; exists {
+		c.remove(elem)
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	c.bytes += entry.size()
+
+	for (c.maxEntries > 0 && c.order.Len() > c.maxEntries) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.order.Back())
+	}
+}
+
+// Stats returns the current entry count and approximate memory use
+func (c *answerCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Entries: c.order.Len(), Bytes: c.bytes, Hits: c.hits, Misses: c.misses}
+}
+
+// remove deletes an entry. Must be called with c.mu held.
+func (c *answerCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+}
+
+// cacheBypassContextKey is the context key marking requests that must not use the cache
+type cacheBypassContextKey struct{}
+
+// contextWithCacheBypass returns a context that forces a fresh generation
+func contextWithCacheBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheBypassContextKey{}, true)
+}
+
+// cacheBypassed reports whether ctx asks for a fresh generation
+func cacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(cacheBypassContextKey{}).(bool)
+	return bypass
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAnswerCacheByteBudget(t *testing.T) {
+	large := strings.Repeat("YES ", 100) // 400 bytes
+	entrySize := (&cacheEntry{key: "q1", answer: large}).size()
+
+	tests := []struct {
+		name        string
+		maxEntries  int
+		maxBytes    int
+		puts        []string
+		get         string // looked up after the first put, making it recent
+		wantKept    []string
+		wantEvicted []string
+	}{
+		{
+			name:        "large answers evict the oldest",
+			maxBytes:    2 * entrySize,
+			puts:        []string{"q1", "q2", "q3"},
+			wantKept:    []string{"q2", "q3"},
+			wantEvicted: []string{"q1"},
+		},
+		{
+			name:        "a lookup keeps an answer",
+			maxBytes:    2 * entrySize,
+			puts:        []string{"q1", "q2", "q3"},
+			get:         "q1",
+			wantKept:    []string{"q1", "q3"},
+			wantEvicted: []string{"q2"},
+		},
+		{
+			name:        "answer larger than the budget isn't cached",
+			maxBytes:    entrySize - 1,
+			puts:        []string{"q1"},
+			wantEvicted: []string{"q1"},
+		},
+		{
+			name:        "entry count still applies",
+			maxEntries:  1,
+			maxBytes:    10 * entrySize,
+			puts:        []string{"q1", "q2"},
+			wantKept:    []string{"q2"},
+			wantEvicted: []string{"q1"},
+		},
+		{
+			name:     "replacing an answer doesn't count it twice",
+			maxBytes: 2 * entrySize,
+			puts:     []string{"q1", "q2", "q2", "q2"},
+			wantKept: []string{"q1", "q2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newAnswerCache(tt.maxEntries, tt.maxBytes)
+			for i, key := range tt.puts {
+				cache.Put(key, large)
+				if i == 1 && tt.get != "" {
+					cache.Get(tt.get)
+				}
+			}
+
+			for _, key := range tt.wantKept {
+				if _, ok := cache.Get(key); !ok {
+					t.Errorf("%s evicted, want it kept", key)
+				}
+			}
+			for _, key := range tt.wantEvicted {
+				if _, ok := cache.Get(key); ok {
+					t.Errorf("%s kept, want it evicted", key)
+				}
+			}
+
+			stats := cache.Stats()
+			if stats.Entries != len(tt.wantKept) || stats.Bytes != len(tt.wantKept)*entrySize {
+				t.Errorf("stats %+v, want %d entries of %d bytes", stats, len(tt.wantKept), entrySize)
+			}
+			if tt.maxBytes > 0 && stats.Bytes > tt.maxBytes {
+				t.Errorf("cache holds %d bytes, over its %d byte budget", stats.Bytes, tt.maxBytes)
+			}
+		})
+	}
+}
+
+func TestStatsCache(t *testing.T) {
+	_, srv := newFakeOllama(t, "YES")
+	client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+		config.CacheMaxBytes = 4096
+	})
+	app := newTestApp(t, client)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.GenerateAnswer(context.Background(), "Will it rain?"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	app.statsHandler(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats StatsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cache == nil {
+		t.Fatal("no cache section in /stats")
+	}
+	if stats.Cache.Entries != 1 || stats.Cache.Bytes == 0 || stats.Cache.Hits != 1 || stats.Cache.Misses != 1 {
+		t.Errorf("cache stats %+v, want 1 entry, 1 hit and 1 miss", *stats.Cache)
+	}
+}
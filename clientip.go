@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ipRanges is a list of CIDR ranges
+type ipRanges []netip.Prefix
+
+// parseIPRanges parses CIDR ranges; bare addresses are treated as single hosts
+func parseIPRanges(items []string) (ipRanges, error) {
+	ranges := make(ipRanges, 0, len(items))
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP address %q: %w", item, err)
+			}
+			ranges = append(ranges, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q: %w", item, err)
+		}
+		ranges = append(ranges, prefix.Masked())
+	}
+	return ranges, nil
+}
+
+// contains reports whether addr falls within any of the ranges
+func (ranges ipRanges) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range ranges {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipResolver determines the real client address of a request, only trusting
+// X-Forwarded-For and X-Real-IP when the request came through a trusted proxy
+type ipResolver struct {
+	trustedProxies ipRanges
+}
+
+// clientIP returns the resolved client address. The remote address is used
+// unless it is a trusted proxy, in which case X-Forwarded-For is walked from
+// the right and the first hop that isn't a trusted proxy wins. Proxies that
+// only set X-Real-IP are honored when there is no X-Forwarded-For, provided
+// it holds a valid address.
+func (res *ipResolver) clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+
+	if !res.trustedProxies.contains(addr) {
+		return addr
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.Unmap()
+		}
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(forwarded, ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Don't trust anything left of a malformed entry
+			break
+		}
+		addr = hop.Unmap()
+		if !res.trustedProxies.contains(addr) {
+			break
+		}
+	}
+
+	return addr
+}
+
+// anonymizeIP masks the host part of an address for privacy: the last octet
+// of IPv4 addresses and the last 80 bits of IPv6 addresses are zeroed
+func anonymizeIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "invalid"
+	}
+	addr = addr.Unmap()
+
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return "invalid"
+	}
+	return prefix.Addr().String()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseIPRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		items   []string
+		addr    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "inside range", items: []string{"10.0.0.0/8"}, addr: "10.1.2.3", want: true},
+		{name: "outside range", items: []string{"10.0.0.0/8"}, addr: "11.1.2.3", want: false},
+		{name: "bare address", items: []string{"192.0.2.7"}, addr: "192.0.2.7", want: true},
+		{name: "host bits are masked", items: []string{"192.0.2.7/24"}, addr: "192.0.2.200", want: true},
+		{name: "IPv4-mapped IPv6", items: []string{"192.0.2.0/24"}, addr: "::ffff:192.0.2.1", want: true},
+		{name: "invalid address", items: []string{"not-an-ip"}, wantErr: true},
+		{name: "invalid range", items: []string{"10.0.0.0/99"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges, err := parseIPRanges(tt.items)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIPRanges(%v) error = %v, want error %v", tt.items, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := ranges.contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+				t.Errorf("contains(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	config := LoadConfig()
+	trusted, err := parseIPRanges(config.TrustedProxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := &ipResolver{trustedProxies: trusted}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.5:1234", want: "203.0.113.5"},
+		{name: "untrusted peer can't spoof", remoteAddr: "203.0.113.5:1234", forwarded: "198.51.100.1", want: "203.0.113.5"},
+		{name: "loopback proxy is trusted", remoteAddr: "127.0.0.1:1234", forwarded: "198.51.100.1", want: "198.51.100.1"},
+		{name: "IPv6 loopback proxy is trusted", remoteAddr: "[::1]:1234", forwarded: "198.51.100.1", want: "198.51.100.1"},
+		{name: "private peer isn't trusted by default", remoteAddr: "10.0.0.2:1234", forwarded: "198.51.100.1", want: "10.0.0.2"},
+		{name: "spoofed hops left of the client are ignored", remoteAddr: "127.0.0.1:1234", forwarded: "1.1.1.1, 198.51.100.1", want: "198.51.100.1"},
+		{name: "trusted hops are skipped", remoteAddr: "127.0.0.1:1234", forwarded: "198.51.100.1, 127.0.0.2", want: "198.51.100.1"},
+		{name: "malformed hop stops the walk", remoteAddr: "127.0.0.1:1234", forwarded: "198.51.100.1, bogus, 127.0.0.2", want: "127.0.0.2"},
+		{name: "X-Real-IP from a trusted proxy", remoteAddr: "127.0.0.1:1234", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{name: "X-Real-IP IPv6", remoteAddr: "127.0.0.1:1234", realIP: " 2001:db8::1 ", want: "2001:db8::1"},
+		{name: "X-Real-IP IPv4-mapped", remoteAddr: "127.0.0.1:1234", realIP: "::ffff:198.51.100.1", want: "198.51.100.1"},
+		{name: "invalid X-Real-IP is ignored", remoteAddr: "127.0.0.1:1234", realIP: "198.51.100.1:80", want: "127.0.0.1"},
+		{name: "X-Forwarded-For wins over X-Real-IP", remoteAddr: "127.0.0.1:1234", forwarded: "198.51.100.1", realIP: "192.0.2.9", want: "198.51.100.1"},
+		{name: "untrusted peer can't spoof X-Real-IP", remoteAddr: "203.0.113.5:1234", realIP: "198.51.100.1", want: "203.0.113.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := defaults.clientIP(req); got.String() != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitExemption(t *testing.T) {
+	exempt, err := parseIPRanges([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := rateLimitMiddleware(1, rateLimitTokenBucket, &ipResolver{}, exempt)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantLimit  bool
+	}{
+		{name: "exempt client", remoteAddr: "192.0.2.1:1234", wantLimit: false},
+		{name: "other client", remoteAddr: "203.0.113.5:1234", wantLimit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limited := false
+			for i := 0; i < 10; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = tt.remoteAddr
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				limited = limited || rec.Code == http.StatusTooManyRequests
+			}
+			if limited != tt.wantLimit {
+				t.Errorf("limited = %v, want %v", limited, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "203.0.113.57", want: "203.0.113.0"},
+		{ip: "::ffff:203.0.113.57", want: "203.0.113.0"},
+		{ip: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1::"},
+		{ip: "::1", want: "::"},
+		{ip: "not-an-ip", want: "invalid"},
+		{ip: "", want: "invalid"},
+	}
+
+	for _, tt := range tests {
+		if got := anonymizeIP(tt.ip); got != tt.want {
+			t.Errorf("anonymizeIP(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationSmoothing is the weight of the newest sample in the moving average
+const durationSmoothing = 0.2
+
+// generationLimiter bounds the number of concurrent generations and tracks a
+// moving average of how long they take, to tell busy clients when to retry.
+// When every slot is taken, up to queueSize requests wait up to queueTimeout
+// for one, absorbing brief spikes.
+type generationLimiter struct {
+	slots        chan struct{}
+	queueSize    int
+	queueTimeout time.Duration
+	// waiting is the current queue depth
+	waiting atomic.Int64
+	mu      sync.Mutex
+	avg     time.Duration
+	// waits and waitTotal describe the time queued requests spent waiting
+	waits     int64
+	waitTotal time.Duration
+}
+
+// QueueStats describes the generation queue
+type QueueStats struct {
+	// Depth is how many requests are waiting now
+	Depth int64 `json:"depth"`
+	// Waits and WaitSeconds count the requests that queued since startup
+	// and the time they spent waiting
+	Waits       int64   `json:"waits"`
+	WaitSeconds float64 `json:"wait_seconds"`
+}
+
+// newGenerationLimiter creates a limiter allowing maxConcurrent generations,
+// queueing up to queueSize more for at most queueTimeout
+func newGenerationLimiter(maxConcurrent, queueSize int, queueTimeout time.Duration) *generationLimiter {
+	return &generationLimiter{
+		slots:        make(chan struct{}, maxConcurrent),
+		queueSize:    queueSize,
+		queueTimeout: queueTimeout,
+	}
+}
+
+// acquire takes a slot, queueing for one if none is free. It returns false
+// if the queue is full, the wait times out or ctx is done first, so
+// abandoned requests leave the queue.
+func (l *generationLimiter) acquire(ctx context.Context) bool {
+	if l.tryAcquire() {
+		return true
+	}
+	if l.queueSize <= 0 || l.queueTimeout <= 0 {
+		return false
+	}
+
+	if l.waiting.Add(1) > int64(l.queueSize) {
+		l.waiting.Add(-1)
+		return false
+	}
+	defer l.waiting.Add(-1)
+
+	start := time.Now()
+	defer func() { l.observeWait(time.Since(start)) }()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// observeWait records how long a queued request waited
+func (l *generationLimiter) observeWait(waited time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.waits++
+	l.waitTotal += waited
+}
+
+// queueStats returns the queue's depth and the time spent waiting in it
+func (l *generationLimiter) queueStats() QueueStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return QueueStats{Depth: l.waiting.Load(), Waits: l.waits, WaitSeconds: l.waitTotal.Seconds()}
+}
+
+// tryAcquire takes a slot without waiting, returning false if all are in use
+func (l *generationLimiter) tryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// release frees a slot and records how long the generation took
+func (l *generationLimiter) release(elapsed time.Duration) {
+	<-l.slots
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.avg == 0 {
+		l.avg = elapsed
+	} else {
+		l.avg = time.Duration(durationSmoothing*float64(elapsed) + (1-durationSmoothing)*float64(l.avg))
+	}
+}
+
+// retryAfter estimates how long until a slot frees up, in whole seconds
+func (l *generationLimiter) retryAfter() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return max(1, int(math.Ceil(l.avg.Seconds())))
+}
+
+// acquireGeneration reserves a generation slot, queueing for one if
+// GENERATION_QUEUE_SIZE allows. If none can be had it responds with 503 and a
+// Retry-After estimate and returns false; otherwise the returned function
+// must be called once generation finishes.
+func (app *App) acquireGeneration(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if app.generations == nil {
+		return func() {}, true
+	}
+
+	if !app.generations.acquire(r.Context()) {
+		w.Header().Set("Retry-After", strconv.Itoa(app.generations.retryAfter()))
+		respondWithError(w, r, "The spirits are busy, ask again shortly", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	start := time.Now()
+	return func() {
+		app.generations.release(time.Since(start))
+	}, true
+}
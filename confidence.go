@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// confidenceInstruction asks the model to end its answer with a marker
+// that confidencePattern can find, see ANSWER_CONFIDENCE
+const confidenceInstruction = "End your answer with how certain the spirits are, from 0 to 100, written as [confidence: N]."
+
+// confidencePattern matches a confidence marker at the end of an answer,
+// tolerating the variations models tend to produce
+var confidencePattern = regexp.MustCompile(`(?i)[\s(\[]*confidence\s*[:=]?\s*(\d{1,3})\s*%?\s*[)\]]?[\s.]*$`)
+
+// extractConfidence removes the confidence marker from the end of text and
+// returns the text and the confidence it gave. Answers without a marker, or
+// with one out of range, get a confidence picked from rng, since a Ouija
+// board is never short of certainty.
+func extractConfidence(text string, rng *lockedRand) (string, int) {
+	if match := confidencePattern.FindStringSubmatchIndex(text); match != nil {
+		if value, err := strconv.Atoi(text[match[2]:match[3]]); err == nil && value <= 100 {
+			return strings.TrimSpace(text[:match[0]]), value
+		}
+		text = strings.TrimSpace(text[:match[0]])
+	}
+	return text, rng.Intn(101)
+}
+
+// withConfidence appends a confidence marker to text, so cached answers
+// keep their confidence
+func withConfidence(text string, value int) string {
+	return text + " [confidence: " + strconv.Itoa(value) + "]"
+}
+
+// answerConfidence carries the confidence of a request's answer out of the
+// generator, the way generationUsage carries its tokens
+type answerConfidence struct {
+	mu    sync.Mutex
+	value *int
+}
+
+// confidenceContextKey is the context key for the request's answerConfidence
+type confidenceContextKey struct{}
+
+// contextWithConfidence returns a context collecting the answer's confidence
+// into confidence
+func contextWithConfidence(ctx context.Context, confidence *answerConfidence) context.Context {
+	return context.WithValue(ctx, confidenceContextKey{}, confidence)
+}
+
+// reportConfidence records the confidence of the answer generated for ctx
+func reportConfidence(ctx context.Context, value int) {
+	if confidence, ok := ctx.Value(confidenceContextKey{}).(*answerConfidence); ok {
+		confidence.mu.Lock()
+		confidence.value = &value
+		confidence.mu.Unlock()
+	}
+}
+
+// confidenceFromContext returns the confidence reported for ctx's answer,
+// nil when none was
+func confidenceFromContext(ctx context.Context) *int {
+	confidence, ok := ctx.Value(confidenceContextKey{}).(*answerConfidence)
+	if !ok {
+		return nil
+	}
+
+	confidence.mu.Lock()
+	defer confidence.mu.Unlock()
+	return confidence.value
+}
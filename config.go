@@ -3,34 +3,348 @@ package main
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Config holds all application configuration
 type Config struct {
-	ServerAddr     string
-	OllamaURL      string
-	OllamaModel    string
-	OllamaTimeout  time.Duration
-	MaxHistorySize int
-	MaxTokens      int
-	RateLimit      int
-	EnableOTEL     bool
-	OTELEndpoint   string
+	ServerAddr    string
+	OllamaURL     string
+	OllamaModel   string
+	OllamaTimeout time.Duration
+	// OllamaFirstByteTimeout bounds the wait for Ollama to start streaming, 0 for none
+	OllamaFirstByteTimeout time.Duration
+	MaxHistorySize         int
+	MaxTokens              int
+	RateLimit              int
+	EnableOTEL             bool
+	OTELEndpoint           string
+	IdempotencyTTL         time.Duration
+	StripPrefixes          []string
+	// OllamaModelTokens overrides MaxTokens for particular models, as
+	// model=tokens entries
+	OllamaModelTokens map[string]string
+	// OllamaModels are the models a request may pick besides OllamaModel
+	OllamaModels []string
+	// QuestionPattern is an optional regular expression every question must
+	// match in full, e.g. `^[\p{L}\p{N}\s.,!?'"-]+$`. Empty allows anything.
+	QuestionPattern string
+	// SnapshotInterval enables periodic history snapshots to SnapshotPath when non-zero
+	SnapshotInterval time.Duration
+	SnapshotPath     string
+	// DisableHistory never stores Q&A pairs, regardless of the request's store flag
+	DisableHistory bool
+	// StoreQuestionMode is how questions are kept in history: full, hashed or none
+	StoreQuestionMode string
+	// AssetsDir serves templates/ and static/ from disk instead of the embedded copy
+	AssetsDir string
+	// MaxSessions caps live sessions; the least recently used is evicted when full
+	MaxSessions        int
+	SessionIdleTimeout time.Duration
+	// PromptTemplateFile overrides the built-in prompt; ModelPromptTemplates
+	// maps model names to their own template files
+	PromptTemplateFile   string
+	ModelPromptTemplates map[string]string
+	// AnswerSuffix is a template appended to model answers, e.g. "— the
+	// spirits {{.SessionID}}", see SuffixData
+	AnswerSuffix string
+	// TrustedProxies are the CIDR ranges whose X-Forwarded-For header is
+	// believed, loopback only by default
+	TrustedProxies []string
+	// RateLimitExemptIPs are CIDR ranges never subject to rate limiting
+	RateLimitExemptIPs []string
+	// RateLimitAlgorithm is tokenbucket (bursts up to twice RATE_LIMIT) or
+	// slidingwindow (about RATE_LIMIT in any second, no bursts)
+	RateLimitAlgorithm string
+	// MinAnswerLength triggers up to MinAnswerRetries regenerations of shorter answers
+	MinAnswerLength  int
+	MinAnswerRetries int
+	// PrettyJSON indents JSON responses by default; ?pretty= overrides per request
+	PrettyJSON bool
+	// ModelWatchInterval is how often Ollama is polled for model availability
+	ModelWatchInterval time.Duration
+	// AnonymizeIPs masks client addresses in the access log
+	AnonymizeIPs bool
+	// AccessLogFormat is default, common, combined, json or a text/template
+	AccessLogFormat string
+	// CORSAllowedOrigins enables CORS for these origins ("*" for any); empty disables it
+	CORSAllowedOrigins []string
+	// CORSAllowCredentials lets browsers send cookies cross-origin, e.g.
+	// for cookie-based sessions. It can't be combined with "*".
+	CORSAllowCredentials bool
+	// CORSExposeHeaders are response headers cross-origin scripts may read
+	CORSExposeHeaders []string
+	// MaxPromptTokens is the estimated token budget for a composed prompt, 0 disables the check
+	MaxPromptTokens int
+	// StreamDrainGrace is how long streams may finish after the shutdown notice
+	StreamDrainGrace time.Duration
+	// StreamResumeWindow is how long a finished /ask/stream generation can
+	// still be resumed with Last-Event-ID, 0 disables resuming
+	StreamResumeWindow time.Duration
+	// AnswerCacheSize is the number of answers cached per model and question, 0 disables caching
+	AnswerCacheSize int
+	// MaxConcurrentGenerations bounds simultaneous model calls, 0 for no limit
+	MaxConcurrentGenerations int
+	// GenerationQueueSize is how many requests may wait for a generation
+	// slot, for up to GenerationQueueTimeout, before getting a 503
+	GenerationQueueSize    int
+	GenerationQueueTimeout time.Duration
+	// EnableStructuredAnswers registers /ask/structured, which uses Ollama's JSON format mode
+	EnableStructuredAnswers bool
+	// MaxBodyBytes caps the size of request bodies
+	MaxBodyBytes int64
+	// MessagesFile is a JSON file overriding user-facing messages
+	MessagesFile string
+	// BoardTheme is the default visual theme (classic, wood, neon or spooky)
+	BoardTheme string
+	// AdminToken protects the /admin endpoints, which are disabled when empty
+	AdminToken string
+	// Backend selects the answer generator: ollama, proxy to another board,
+	// or fake for a fixed answer
+	Backend string
+	// FakeAnswer and FakeDelay configure the fake backend
+	FakeAnswer string
+	FakeDelay  time.Duration
+	// HistoryTTL drops history older than this, 0 keeps it until MaxHistorySize evicts it
+	HistoryTTL time.Duration
+	// UpstreamURL is the board the proxy backend forwards questions to
+	UpstreamURL     string
+	UpstreamTimeout time.Duration
+	UpstreamRetries int
+	// CacheMaxBytes bounds the answer cache's approximate memory use, 0 for no byte limit
+	CacheMaxBytes int
+	// CostPerToken prices generated tokens for cost accounting
+	CostPerToken float64
+	// EmptyAnswerRetries is how many times an empty answer is retried before the fallback
+	EmptyAnswerRetries int
+	// FallbackAnswers are given, one at random, when the spirits fail to
+	// answer, and served to clients at /fallbacks. A non-zero FallbackSeed
+	// makes the picks repeatable.
+	FallbackAnswers []string
+	FallbackSeed    int64
+	// RateLimitRetries is how many times a 429 from Ollama is retried after
+	// its Retry-After, 0 to give up at once
+	RateLimitRetries int
+	// EscapeAnswerHTML handles markup in answers: off, escape or strip
+	EscapeAnswerHTML string
+	// EnableGetAsk registers GET /ask?q=, for links and bookmarks
+	EnableGetAsk bool
+	// MaxConnPerIP caps simultaneous streaming connections per client IP, 0 for no limit
+	MaxConnPerIP int
+	// StrictJSON rejects request bodies with unknown fields instead of ignoring them
+	StrictJSON bool
+	// DisableGlobalHistory stops serving everyone's history, leaving per-session history
+	DisableGlobalHistory bool
+	// PromptGuard wraps questions in QuestionDelimiters with an instruction
+	// not to follow anything inside them, to resist prompt injection
+	PromptGuard        bool
+	QuestionDelimiters []string
+	// LogSampleRate logs 1 in N successful requests; errors and requests
+	// slower than LogSlowThreshold are always logged
+	LogSampleRate    int
+	LogSlowThreshold time.Duration
+	// DeterministicGoodbye answers questions containing FarewellKeywords with
+	// "Goodbye." without calling the model
+	DeterministicGoodbye bool
+	FarewellKeywords     []string
+	// Namespaces are the themed boards that keep their own history, chosen
+	// per request with the X-Board-Namespace header
+	Namespaces    []string
+	MaxNamespaces int
+	// RequestTimeout bounds everything one question does, retries and
+	// delays included; 0 for no bound
+	RequestTimeout time.Duration
+	// BoardDormant shows the page at rest and fails /ready, for static demos
+	// or while the model backend is intentionally off
+	BoardDormant bool
+	// WarmupModel loads the model at startup, before questions are accepted
+	WarmupModel bool
+	// AnswerMoods and TemperatureJitter vary answers per question; a
+	// non-zero VariationSeed makes the variation, and the confidences picked
+	// for answers without a marker, repeatable
+	AnswerMoods       []string
+	TemperatureJitter float64
+	VariationSeed     int64
+	// QuestionNormalization lists the steps deciding which questions count
+	// as the same, in order; see normalize.go
+	QuestionNormalization []string
+	// OllamaFollowUps feeds Ollama's context from a session's last answer
+	// into its next question, up to OllamaFollowUpMaxContext tokens
+	OllamaFollowUps          bool
+	OllamaFollowUpMaxContext int
+	// AnswerFilter keeps AnswerFilterWords out of generated answers: off,
+	// mask or regenerate (once, then mask)
+	AnswerFilter      string
+	AnswerFilterWords []string
+	// RequireQuestionMark rejects questions that don't end in "?"
+	RequireQuestionMark bool
+	// HistoryFeedInterval batches /history/stream pairs into one event per
+	// interval, 0 to send each pair at once
+	HistoryFeedInterval time.Duration
+	// StripQuestionEcho removes the question from the start of answers when
+	// the model repeats it
+	StripQuestionEcho bool
+	// TagKeywords maps tags to |-separated keywords that apply them to
+	// questions, e.g. love=love|heart|marry
+	TagKeywords map[string]string
+	// AnswerConfidence asks the model for a confidence marker and returns
+	// it separately with each answer
+	AnswerConfidence bool
+	// MemoryShedHeapMB is the heap size above which questions get 503, 0
+	// to never shed; the heap is sampled every MemorySampleInterval
+	MemoryShedHeapMB     int
+	MemorySampleInterval time.Duration
+	// Debug logs extra detail, such as Ollama's timings for every answer
+	Debug bool
+	// DryRun logs composed prompts and answers with a placeholder instead
+	// of calling Ollama
+	DryRun bool
+	// SlowGenerationThreshold is how long a generation may take before it is
+	// logged and counted as slow, 0 to disable
+	SlowGenerationThreshold time.Duration
+	// BoardPersonality is the default prompt preset, see personalities.go
+	BoardPersonality string
+	// InvalidUTF8 handles questions that aren't valid UTF-8: replace the bad
+	// bytes with U+FFFD, or reject the request
+	InvalidUTF8 string
+	// CollapseAnswerSpaces collapses runs of spaces in answers and drops
+	// spaces around line breaks, left over from joining streamed tokens
+	CollapseAnswerSpaces bool
+	// CallbackAllowedHosts are the hosts a request's callback_url may point
+	// at; callbacks are off when empty. Failed deliveries are retried
+	// CallbackRetries times, each attempt bounded by CallbackTimeout.
+	CallbackAllowedHosts []string
+	CallbackRetries      int
+	CallbackTimeout      time.Duration
+	// MaxHistorySubscribers caps open /history/stream connections, 0 for no limit
+	MaxHistorySubscribers int
+	// SelfTest asks one canned question at startup and exits instead of
+	// serving, like the --selftest flag
+	SelfTest bool
+	// DefaultHistoryLimit caps /history for callers without the admin token, 0 for no cap
+	DefaultHistoryLimit int
+	// GetAllMax caps every /history response, admin or not, pointing at
+	// the next page when it cuts one short; 0 for no cap
+	GetAllMax int
 }
 
 // LoadConfig loads configuration from environment variables with sensible defaults
 func LoadConfig() *Config {
 	return &Config{
-		ServerAddr:     getEnv("SERVER_ADDR", "0.0.0.0:8080"),
-		OllamaURL:      getEnv("OLLAMA_URL", "http://localhost:11434/api/generate"),
-		OllamaModel:    getEnv("OLLAMA_MODEL", "qwen3"),
-		OllamaTimeout:  getDurationEnv("OLLAMA_TIMEOUT", 30*time.Second),
-		MaxHistorySize: getIntEnv("MAX_HISTORY_SIZE", 1000),
-		MaxTokens:      getIntEnv("MAX_TOKENS", 10),
-		RateLimit:      getIntEnv("RATE_LIMIT", 10), // requests per second
-		EnableOTEL:     getBoolEnv("ENABLE_OTEL", false),
-		OTELEndpoint:   getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317"),
+		ServerAddr:             getEnv("SERVER_ADDR", "0.0.0.0:8080"),
+		OllamaURL:              getEnv("OLLAMA_URL", "http://localhost:11434/api/generate"),
+		OllamaModel:            getEnv("OLLAMA_MODEL", "qwen3"),
+		OllamaTimeout:          getDurationEnv("OLLAMA_TIMEOUT", 30*time.Second),
+		OllamaFirstByteTimeout: getDurationEnv("OLLAMA_FIRST_BYTE_TIMEOUT", 0),
+		MaxHistorySize:         getIntEnv("MAX_HISTORY_SIZE", 1000),
+		MaxTokens:              getIntEnv("MAX_TOKENS", 10),
+		OllamaModelTokens:      getMapEnv("OLLAMA_MODEL_TOKENS", map[string]string{}),
+		OllamaModels:           getListEnv("OLLAMA_MODELS", ",", nil),
+		RateLimit:              getIntEnv("RATE_LIMIT", 10), // requests per second
+		EnableOTEL:             getBoolEnv("ENABLE_OTEL", false),
+		OTELEndpoint:           getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://localhost:4317"),
+		IdempotencyTTL:         getDurationEnv("IDEMPOTENCY_TTL", 5*time.Minute),
+		StripPrefixes: getListEnv("STRIP_PREFIXES", "|", []string{
+			"Sure, here's your answer:",
+			"As a Ouija board, I say:",
+			"The Ouija board says:",
+			"The spirits say:",
+		}),
+		QuestionPattern:      getEnv("QUESTION_ALLOWED_PATTERN", ""),
+		SnapshotInterval:     getDurationEnv("SNAPSHOT_INTERVAL", 0),
+		SnapshotPath:         getEnv("SNAPSHOT_PATH", "answers.json"),
+		DisableHistory:       getBoolEnv("DISABLE_HISTORY", false),
+		StoreQuestionMode:    getEnv("STORE_QUESTION_MODE", "full"),
+		AssetsDir:            getEnv("ASSETS_DIR", ""),
+		MaxSessions:          getIntEnv("MAX_SESSIONS", 10000),
+		SessionIdleTimeout:   getDurationEnv("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		PromptTemplateFile:   getEnv("PROMPT_TEMPLATE_FILE", ""),
+		ModelPromptTemplates: getMapEnv("MODEL_PROMPT_TEMPLATES", map[string]string{}),
+		AnswerSuffix:         getEnv("ANSWER_SUFFIX", ""),
+		TrustedProxies: getListEnv("TRUSTED_PROXIES", ",", []string{
+			"127.0.0.0/8", "::1/128",
+		}),
+		RateLimitExemptIPs:       getListEnv("RATE_LIMIT_EXEMPT_IPS", ",", []string{}),
+		RateLimitAlgorithm:       getEnv("RATE_LIMIT_ALGORITHM", "tokenbucket"),
+		MinAnswerLength:          getIntEnv("MIN_ANSWER_LENGTH", 0),
+		MinAnswerRetries:         getIntEnv("MIN_ANSWER_RETRIES", 2),
+		PrettyJSON:               getBoolEnv("PRETTY_JSON", false),
+		ModelWatchInterval:       getDurationEnv("MODEL_WATCH_INTERVAL", 30*time.Second),
+		AnonymizeIPs:             getBoolEnv("ANONYMIZE_IPS", false),
+		AccessLogFormat:          getEnv("ACCESS_LOG_FORMAT", "default"),
+		CORSAllowedOrigins:       getListEnv("CORS_ALLOWED_ORIGINS", ",", []string{}),
+		CORSAllowCredentials:     getBoolEnv("CORS_ALLOW_CREDENTIALS", false),
+		CORSExposeHeaders:        getListEnv("CORS_EXPOSE_HEADERS", ",", []string{"X-Request-ID", "Retry-After", "X-History-Truncated", "Link"}),
+		MaxPromptTokens:          getIntEnv("MAX_PROMPT_TOKENS", 0),
+		StreamDrainGrace:         getDurationEnv("STREAM_DRAIN_GRACE", 5*time.Second),
+		StreamResumeWindow:       getDurationEnv("STREAM_RESUME_WINDOW", 0),
+		AnswerCacheSize:          getIntEnv("ANSWER_CACHE_SIZE", 0),
+		MaxConcurrentGenerations: getIntEnv("MAX_CONCURRENT_GENERATIONS", 0),
+		GenerationQueueSize:      getIntEnv("GENERATION_QUEUE_SIZE", 0),
+		GenerationQueueTimeout:   getDurationEnv("QUEUE_TIMEOUT", 5*time.Second),
+		EnableStructuredAnswers:  getBoolEnv("ENABLE_STRUCTURED_ANSWERS", false),
+		MaxBodyBytes:             int64(getIntEnv("MAX_BODY_BYTES", 64*1024)),
+		MessagesFile:             getEnv("MESSAGES_FILE", ""),
+		BoardTheme:               getEnv("BOARD_THEME", "classic"),
+		AdminToken:               getEnv("ADMIN_TOKEN", ""),
+		Backend:                  getEnv("BACKEND", "ollama"),
+		FakeAnswer:               getEnv("FAKE_ANSWER", "Yes"),
+		FakeDelay:                getDurationEnv("FAKE_DELAY", 0),
+		HistoryTTL:               getDurationEnv("HISTORY_TTL", 0),
+		UpstreamURL:              getEnv("UPSTREAM_URL", ""),
+		UpstreamTimeout:          getDurationEnv("UPSTREAM_TIMEOUT", 30*time.Second),
+		UpstreamRetries:          getIntEnv("UPSTREAM_RETRIES", 2),
+		CacheMaxBytes:            getIntEnv("CACHE_MAX_BYTES", 0),
+		CostPerToken:             getFloatEnv("COST_PER_TOKEN", 0),
+		EmptyAnswerRetries:       getIntEnv("EMPTY_ANSWER_RETRIES", 0),
+		FallbackAnswers:          getListEnv("FALLBACK_ANSWERS", "|", []string{fallbackAnswer}),
+		FallbackSeed:             int64(getIntEnv("FALLBACK_SEED", 0)),
+		RateLimitRetries:         getIntEnv("OLLAMA_RATE_LIMIT_RETRIES", 2),
+		EscapeAnswerHTML:         getEnv("ESCAPE_ANSWER_HTML", "off"),
+		EnableGetAsk:             getBoolEnv("ENABLE_GET_ASK", false),
+		MaxConnPerIP:             getIntEnv("MAX_CONN_PER_IP", 0),
+		StrictJSON:               getBoolEnv("STRICT_JSON", true),
+		DisableGlobalHistory:     getBoolEnv("DISABLE_GLOBAL_HISTORY", false),
+		PromptGuard:              getBoolEnv("PROMPT_GUARD", true),
+		QuestionDelimiters:       getListEnv("QUESTION_DELIMITERS", "|", []string{"<q>", "</q>"}),
+		LogSampleRate:            getIntEnv("LOG_SAMPLE_RATE", 1),
+		LogSlowThreshold:         getDurationEnv("LOG_SLOW_THRESHOLD", 2*time.Second),
+		DeterministicGoodbye:     getBoolEnv("DETERMINISTIC_GOODBYE", false),
+		FarewellKeywords:         getListEnv("FAREWELL_KEYWORDS", ",", []string{"goodbye", "bye", "farewell"}),
+		Namespaces:               getListEnv("NAMESPACES", ",", []string{}),
+		MaxNamespaces:            getIntEnv("MAX_NAMESPACES", 16),
+		RequestTimeout:           getDurationEnv("REQUEST_TIMEOUT", 0),
+		BoardDormant:             getBoolEnv("BOARD_DORMANT", false),
+		WarmupModel:              getBoolEnv("WARMUP_MODEL", true),
+		AnswerMoods:              getListEnv("ANSWER_MOODS", ",", []string{}),
+		TemperatureJitter:        getFloatEnv("TEMPERATURE_JITTER", 0),
+		VariationSeed:            int64(getIntEnv("VARIATION_SEED", 0)),
+		DefaultHistoryLimit:      getIntEnv("DEFAULT_HISTORY_LIMIT", 0),
+		GetAllMax:                getIntEnv("GETALL_MAX", 1000),
+		OllamaFollowUps:          getBoolEnv("OLLAMA_FOLLOW_UPS", false),
+		OllamaFollowUpMaxContext: getIntEnv("OLLAMA_FOLLOW_UP_MAX_CONTEXT", 4096),
+		QuestionNormalization:    getListEnv("QUESTION_NORMALIZATION", ",", []string{"lowercase", "trim", "collapse_whitespace"}),
+		AnswerFilter:             getEnv("ANSWER_FILTER", "off"),
+		AnswerFilterWords:        getListEnv("ANSWER_FILTER_WORDS", ",", []string{}),
+		SelfTest:                 getBoolEnv("SELFTEST", false),
+		BoardPersonality:         getEnv("BOARD_PERSONALITY", defaultPersonality),
+		InvalidUTF8:              getEnv("INVALID_UTF8", "replace"),
+		CollapseAnswerSpaces:     getBoolEnv("COLLAPSE_ANSWER_SPACES", true),
+		RequireQuestionMark:      getBoolEnv("REQUIRE_QUESTION_MARK", false),
+		HistoryFeedInterval:      getDurationEnv("HISTORY_FEED_INTERVAL", 0),
+		StripQuestionEcho:        getBoolEnv("STRIP_QUESTION_ECHO", false),
+		TagKeywords:              getMapEnv("TAG_KEYWORDS", map[string]string{}),
+		AnswerConfidence:         getBoolEnv("ANSWER_CONFIDENCE", false),
+		MemoryShedHeapMB:         getIntEnv("MEMORY_SHED_HEAP_MB", 0),
+		MemorySampleInterval:     getDurationEnv("MEMORY_SAMPLE_INTERVAL", time.Second),
+		Debug:                    getBoolEnv("DEBUG", false),
+		DryRun:                   getBoolEnv("DRY_RUN", false),
+		SlowGenerationThreshold:  getDurationEnv("SLOW_GENERATION_THRESHOLD", 0),
+		MaxHistorySubscribers:    getIntEnv("MAX_HISTORY_SUBSCRIBERS", 100),
+		CallbackAllowedHosts:     getListEnv("CALLBACK_ALLOWED_HOSTS", ",", []string{}),
+		CallbackRetries:          getIntEnv("CALLBACK_RETRIES", 3),
+		CallbackTimeout:          getDurationEnv("CALLBACK_TIMEOUT", 10*time.Second),
 	}
 }
 
@@ -60,6 +374,15 @@ func getDurationEnv(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
+func getFloatEnv(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
 func getBoolEnv(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolVal, err := strconv.ParseBool(value); err == nil {
@@ -68,3 +391,36 @@ func getBoolEnv(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+// getListEnv splits a separated environment variable into trimmed, non-empty items
+func getListEnv(key, sep string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getMapEnv parses a comma-separated list of key=value pairs
+func getMapEnv(key string, defaultValue map[string]string) map[string]string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	result := make(map[string]string)
+	for _, item := range strings.Split(value, ",") {
+		k, v, found := strings.Cut(item, "=")
+		if k, v = strings.TrimSpace(k), strings.TrimSpace(v); found && k != "" && v != "" {
+			result[k] = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// corsAllowedHeaders are the request headers browsers may send cross-origin
+var corsAllowedHeaders = []string{
+	"Content-Type",
+	"Idempotency-Key",
+	"X-Request-ID",
+	// Sent by EventSource when it reconnects, see STREAM_RESUME_WINDOW
+	"Last-Event-ID",
+	sessionHeaderName,
+	namespaceHeaderName,
+}
+
+// corsMaxAge is how long, in seconds, browsers may cache a preflight answer
+const corsMaxAge = 600
+
+// corsPolicy decides which cross-origin callers may use the API
+type corsPolicy struct {
+	origins     []string
+	anyOrigin   bool
+	credentials bool
+	expose      string
+}
+
+// newCORSPolicy creates a policy for the given origins, which may be "*".
+// Credentials can't be combined with "*": browsers reject it, and it would
+// let any site act with a visitor's session cookie.
+func newCORSPolicy(origins []string, credentials bool, exposeHeaders []string) (*corsPolicy, error) {
+	anyOrigin := slices.Contains(origins, "*")
+	if anyOrigin && credentials {
+		return nil, errors.New("CORS_ALLOW_CREDENTIALS needs CORS_ALLOWED_ORIGINS to list specific origins, not *")
+	}
+
+	return &corsPolicy{
+		origins:     origins,
+		anyOrigin:   anyOrigin,
+		credentials: credentials,
+		expose:      strings.Join(exposeHeaders, ", "),
+	}, nil
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or "" if it isn't allowed. With credentials the origin itself
+// is echoed, never "*".
+func (p *corsPolicy) allowOrigin(origin string) string {
+	if p.anyOrigin {
+		return "*"
+	}
+	if slices.Contains(p.origins, origin) {
+		return origin
+	}
+	return ""
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers
+// preflight requests. It wraps the whole router, since preflight OPTIONS
+// requests don't match any route.
+func corsMiddleware(policy *corsPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The answer depends on the origin, so caches must keep them apart
+			w.Header().Add("Vary", "Origin")
+			allowed := policy.allowOrigin(origin)
+			if allowed != "" {
+				w.Header().Set("Access-Control-Allow-Origin", allowed)
+				if policy.credentials {
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+				if policy.expose != "" {
+					w.Header().Set("Access-Control-Expose-Headers", policy.expose)
+				}
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				if allowed != "" {
+					w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+					w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// FallbacksResponse lists the answers the board gives when the spirits fail
+type FallbacksResponse struct {
+	Answers []string `json:"answers"`
+}
+
+// lockedRand is a seeded random source safe for concurrent use, so random
+// picks can be made repeatable in tests
+type lockedRand struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// newLockedRand creates a random source. A seed of 0 seeds from the clock.
+func newLockedRand(seed int64) *lockedRand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &lockedRand{rng: rand.New(rand.NewSource(seed))}
+}
+
+// Intn returns a random int in [0, n)
+func (r *lockedRand) Intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rng.Intn(n)
+}
+
+// fallback returns the canned answer for a failed generation like
+// fallbackFor, picking generic failures' answer from FALLBACK_ANSWERS.
+// A missing model keeps its own message, since it asks for an operator.
+func (app *App) fallback(err error) (string, bool) {
+	answer, ok := fallbackFor(err)
+	if ok && answer == fallbackAnswer && len(app.config.FallbackAnswers) > 0 {
+		answer = app.config.FallbackAnswers[app.rng.Intn(len(app.config.FallbackAnswers))]
+	}
+	return answer, ok
+}
+
+// fallbacksHandler returns the FALLBACK_ANSWERS pool, so offline-capable
+// clients can answer from the same set as the board when the network is down
+func (app *App) fallbacksHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, r, FallbacksResponse{Answers: app.config.FallbackAnswers}, http.StatusOK)
+}
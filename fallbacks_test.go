@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// askFallback asks app a question its generator fails, returning the answer
+func askFallback(t *testing.T, app *App) AskResponse {
+	t.Helper()
+
+	rec := askJSON(app, `{"question":"Will it rain?"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var resp AskResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Source != answerSourceFallback {
+		t.Fatalf("source %q, want a fallback", resp.Source)
+	}
+	return resp
+}
+
+func TestFallbackSeeded(t *testing.T) {
+	answers := []string{"Yes", "No", "Perhaps", "Ask again later"}
+
+	tests := []struct {
+		name string
+		seed string
+	}{
+		{name: "seed 1", seed: "1"},
+		{name: "seed 42", seed: "42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The answers a source with this seed picks, in order
+			seed, _ := strconv.ParseInt(tt.seed, 10, 64)
+			rng := newLockedRand(seed)
+			var want []string
+			for i := 0; i < 5; i++ {
+				want = append(want, answers[rng.Intn(len(answers))])
+			}
+
+			t.Setenv("FALLBACK_SEED", tt.seed)
+			app := newTestApp(t, &FakeGenerator{Err: ErrOllamaUnreachable})
+			app.config.FallbackAnswers = answers
+
+			for i, wantAnswer := range want {
+				if got := askFallback(t, app).Answer; got != wantAnswer {
+					t.Errorf("fallback %d is %q, want %q", i, got, wantAnswer)
+				}
+			}
+		})
+	}
+}
+
+func TestFallbackModelMissing(t *testing.T) {
+	app := newTestApp(t, &FakeGenerator{Err: ErrModelNotFound})
+	app.config.FallbackAnswers = []string{"Yes", "No"}
+
+	// A missing model asks for an operator rather than guessing
+	if got := askFallback(t, app).Answer; got != modelMissingAnswer {
+		t.Errorf("answer %q, want %q", got, modelMissingAnswer)
+	}
+}
+
+func TestFallbacksHandler(t *testing.T) {
+	app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+	app.config.FallbackAnswers = []string{"Yes", "No"}
+
+	rec := httptest.NewRecorder()
+	app.fallbacksHandler(rec, httptest.NewRequest(http.MethodGet, "/fallbacks", nil))
+	var resp FallbacksResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answers) != 2 || resp.Answers[0] != "Yes" || resp.Answers[1] != "No" {
+		t.Errorf("answers %q, want the FALLBACK_ANSWERS pool", resp.Answers)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AnswerGenerator produces answers to questions. OllamaClient is the real
+// implementation; FakeGenerator stands in for it without a model.
+type AnswerGenerator interface {
+	GenerateAnswer(ctx context.Context, question string) (string, error)
+	StreamAnswer(ctx context.Context, question string, onChunk func(string) error) (string, error)
+	GenerateStructuredAnswer(ctx context.Context, question string) (StructuredAnswer, error)
+}
+
+// promptReloader is implemented by generators whose prompt templates can be
+// swapped at runtime
+type promptReloader interface {
+	SetPrompts(prompts *promptSet)
+}
+
+// cacheReporter is implemented by generators that cache answers
+type cacheReporter interface {
+	CacheStats() (CacheStats, bool)
+}
+
+// slowReporter is implemented by generators that count generations slower
+// than SLOW_GENERATION_THRESHOLD
+type slowReporter interface {
+	SlowGenerations() (int64, bool)
+}
+
+// evalReporter is implemented by generators whose backend reports token
+// counts and timings
+type evalReporter interface {
+	EvalStats() (EvalStats, bool)
+}
+
+// overloadReporter is implemented by generators that back off from an
+// overloaded backend
+type overloadReporter interface {
+	RetryAfter() time.Duration
+}
+
+// FakeGenerator is a deterministic AnswerGenerator for tests and for running
+// the board without Ollama. It returns Answer or Err after Delay, and records
+// every question it is asked.
+type FakeGenerator struct {
+	Answer string
+	Err    error
+	Delay  time.Duration
+
+	mu        sync.Mutex
+	questions []string
+}
+
+// Questions returns the questions received so far, oldest first
+func (f *FakeGenerator) Questions() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	questions := make([]string, len(f.questions))
+	copy(questions, f.questions)
+	return questions
+}
+
+// receive records a question and waits out the simulated delay
+func (f *FakeGenerator) receive(ctx context.Context, question string) error {
+	f.mu.Lock()
+	f.questions = append(f.questions, question)
+	f.mu.Unlock()
+
+	if f.Delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(f.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GenerateAnswer returns the configured answer or error
+func (f *FakeGenerator) GenerateAnswer(ctx context.Context, question string) (string, error) {
+	if err := f.receive(ctx, question); err != nil {
+		return "", err
+	}
+	if f.Err != nil {
+		return "", f.Err
+	}
+	return f.Answer, nil
+}
+
+// StreamAnswer passes the configured answer to onChunk a word at a time
+func (f *FakeGenerator) StreamAnswer(ctx context.Context, question string, onChunk func(string) error) (string, error) {
+	answer, err := f.GenerateAnswer(ctx, question)
+	if err != nil {
+		return "", err
+	}
+
+	for _, chunk := range strings.SplitAfter(answer, " ") {
+		if err := onChunk(chunk); err != nil {
+			return "", err
+		}
+	}
+	return answer, nil
+}
+
+// GenerateStructuredAnswer returns the configured answer with full confidence
+func (f *FakeGenerator) GenerateStructuredAnswer(ctx context.Context, question string) (StructuredAnswer, error) {
+	answer, err := f.GenerateAnswer(ctx, question)
+	if err != nil {
+		return StructuredAnswer{}, err
+	}
+	return StructuredAnswer{Answer: answer, Confidence: 1}, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeGenerator(t *testing.T) {
+	errBoard := errors.New("the board is cracked")
+
+	tests := []struct {
+		name       string
+		gen        *FakeGenerator
+		timeout    time.Duration
+		wantAnswer string
+		wantErr    error
+	}{
+		{name: "answer", gen: &FakeGenerator{Answer: "YES"}, wantAnswer: "YES"},
+		{name: "error", gen: &FakeGenerator{Answer: "YES", Err: errBoard}, wantErr: errBoard},
+		{name: "delay", gen: &FakeGenerator{Answer: "NO", Delay: 10 * time.Millisecond}, timeout: time.Second, wantAnswer: "NO"},
+		{name: "delay past the deadline", gen: &FakeGenerator{Answer: "NO", Delay: time.Second}, timeout: 10 * time.Millisecond, wantErr: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			answer, err := tt.gen.GenerateAnswer(ctx, "Will it rain?")
+			if !errors.Is(err, tt.wantErr) || answer != tt.wantAnswer {
+				t.Errorf("GenerateAnswer = %q, %v, want %q, %v", answer, err, tt.wantAnswer, tt.wantErr)
+			}
+			if questions := tt.gen.Questions(); len(questions) != 1 || questions[0] != "Will it rain?" {
+				t.Errorf("recorded questions %q", questions)
+			}
+		})
+	}
+}
+
+func TestFakeGeneratorStream(t *testing.T) {
+	gen := &FakeGenerator{Answer: "THE SPIRITS SAY YES"}
+
+	var chunks []string
+	answer, err := gen.StreamAnswer(context.Background(), "Will it rain?", func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	if err != nil || answer != "THE SPIRITS SAY YES" {
+		t.Fatalf("StreamAnswer = %q, %v", answer, err)
+	}
+	if len(chunks) != 4 || strings.Join(chunks, "") != answer {
+		t.Errorf("chunks %q, want the answer a word at a time", chunks)
+	}
+
+	// An error from onChunk aborts the stream
+	errClosed := errors.New("client went away")
+	if _, err := gen.StreamAnswer(context.Background(), "Will it rain?", func(string) error { return errClosed }); !errors.Is(err, errClosed) {
+		t.Errorf("StreamAnswer error = %v, want the onChunk error", err)
+	}
+}
+
+func TestAskStoresAnswer(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStored int
+	}{
+		{name: "stored", body: `{"question":"Will it rain?"}`, wantStored: 1},
+		{name: "not stored", body: `{"question":"Will it rain?","store":false}`, wantStored: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &FakeGenerator{Answer: "YES"}
+			app := newTestApp(t, gen)
+
+			rec := askJSON(app, tt.body, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+			}
+			if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/json") {
+				t.Errorf("Content-Type %q, want JSON", got)
+			}
+
+			var resp AskResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Answer != "YES" || resp.RequestID == "" || resp.Source != answerSourceModel {
+				t.Errorf("response %+v, want the model's answer with a request ID", resp)
+			}
+			if questions := gen.Questions(); len(questions) != 1 || questions[0] != "Will it rain?" {
+				t.Errorf("generator asked %q", questions)
+			}
+
+			pairs, err := app.storage.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pairs) != tt.wantStored {
+				t.Fatalf("%d pairs stored, want %d", len(pairs), tt.wantStored)
+			}
+			if tt.wantStored > 0 && (pairs[0].Question != "Will it rain?" || pairs[0].Answer != "YES") {
+				t.Errorf("stored %+v", pairs[0])
+			}
+		})
+	}
+}
@@ -1,28 +1,188 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
 )
 
 // App holds application dependencies
 type App struct {
 	config  *Config
 	storage Storage
-	ollama  *OllamaClient
+	// namespaces holds the themed boards' separate histories
+	namespaces *namespaceStore
+	generator  AnswerGenerator
+	responses  *responseStore
+	sessions   *sessionStore
+	// resolver finds the client address behind trusted proxies
+	resolver *ipResolver
+	// models tracks model availability, nil when not backed by Ollama
+	models  *modelWatcher
+	streams *streamTracker
+	// resumes keeps /ask/stream generations for Last-Event-ID, nil without
+	// STREAM_RESUME_WINDOW
+	resumes *resumeStore
+	// seances fans streamed answers out to the clients watching a session
+	seances *seanceHub
+	costs   *costMeter
+	// rng picks fallback answers, seeded by FALLBACK_SEED
+	rng *lockedRand
+	// generations limits concurrent model calls, nil for no limit
+	generations *generationLimiter
+	// tagger tags questions by keyword, nil without TAG_KEYWORDS
+	tagger *tagClassifier
+	// normalizer decides which questions count as the same, so an
+	// Idempotency-Key retry may respell its question
+	normalizer *questionNormalizer
+	// questionPattern restricts the characters allowed in questions, nil allows all
+	questionPattern *regexp.Regexp
+	indexTemplate   *template.Template
+	// messages is swapped atomically by /admin/reload
+	messages atomic.Pointer[Messages]
+	// started is set once history is restored and the model warmed up
+	started atomic.Bool
+	// metrics counts generations for /metrics and /metrics.json
+	metrics generationMetrics
+	// callbacks delivers answers to callback_url in the background
+	callbacks *callbackSender
+	// historySubscribers counts open /history/stream connections
+	historySubscribers atomic.Int64
 }
 
 // AskRequest represents the incoming question request
 type AskRequest struct {
 	Question string `json:"question"`
+	// Store controls whether the Q&A pair is kept in history (default true)
+	Store *bool `json:"store,omitempty"`
+	// Personality picks a prompt preset for this question instead of
+	// BOARD_PERSONALITY
+	Personality string `json:"personality,omitempty"`
+	// CallbackURL, if set, has the answer POSTed there instead of returned;
+	// see CALLBACK_ALLOWED_HOSTS
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Tags categorize the question in history, see normalizeTags
+	Tags []string `json:"tags,omitempty"`
+	// Model picks OLLAMA_MODEL or one of OLLAMA_MODELS for this question
+	Model string `json:"model,omitempty"`
+}
+
+// shouldStore reports whether the pair should be saved to history
+func (req AskRequest) shouldStore() bool {
+	return req.Store == nil || *req.Store
 }
 
 // AskResponse represents the answer response
 type AskResponse struct {
-	Answer string `json:"answer"`
+	Answer    string `json:"answer"`
+	RequestID string `json:"request_id"`
+	// Confidence is the spirits' certainty from 0 to 100, only given with
+	// ANSWER_CONFIDENCE on
+	Confidence *int `json:"confidence,omitempty"`
+	// Source is answerSourceModel, answerSourceFallback for a canned answer
+	// given because generation failed, or answerSourceDryRun under DRY_RUN
+	Source string `json:"source,omitempty"`
+}
+
+// Answer sources. A fallback is recognized by the typed error that caused
+// it, never by its text, so a model answer that happens to read like the
+// fallback message is still tagged as the model's.
+const (
+	answerSourceModel    = "model"
+	answerSourceFallback = "fallback"
+	answerSourceDryRun   = "dryrun"
+)
+
+// reportedSource carries an answer's source out of a generator that knows
+// it better than the board does, such as a proxy relaying the upstream
+// board's fallback
+type reportedSource struct {
+	mu    sync.Mutex
+	value string
+}
+
+// sourceContextKey is the context key for the request's reportedSource
+type sourceContextKey struct{}
+
+// contextWithSource returns a context collecting the answer's source into
+// source
+func contextWithSource(ctx context.Context, source *reportedSource) context.Context {
+	return context.WithValue(ctx, sourceContextKey{}, source)
+}
+
+// reportSource records the source of the answer generated for ctx
+func reportSource(ctx context.Context, value string) {
+	if source, ok := ctx.Value(sourceContextKey{}).(*reportedSource); ok {
+		source.mu.Lock()
+		source.value = value
+		source.mu.Unlock()
+	}
+}
+
+// generatedSource is the source of an answer the generator produced
+// without error: the one it reported for ctx, if any
+func (app *App) generatedSource(ctx context.Context) string {
+	if source, ok := ctx.Value(sourceContextKey{}).(*reportedSource); ok {
+		source.mu.Lock()
+		defer source.mu.Unlock()
+		if source.value != "" {
+			return source.value
+		}
+	}
+	if app.config.DryRun {
+		return answerSourceDryRun
+	}
+	return answerSourceModel
+}
+
+// ReplayResponse compares a stored answer with a freshly generated one
+type ReplayResponse struct {
+	ID             int64  `json:"id"`
+	Question       string `json:"question"`
+	PreviousAnswer string `json:"previous_answer"`
+	Answer         string `json:"answer"`
+}
+
+// StatusResponse represents a probe response
+type StatusResponse struct {
+	Status string `json:"status"`
+}
+
+// StatsResponse represents runtime statistics
+type StatsResponse struct {
+	Sessions    int `json:"sessions"`
+	HistorySize int `json:"history_size"`
+	// HistorySubscribers is the number of open /history/stream connections
+	HistorySubscribers int64 `json:"history_subscribers"`
+	// Cache is omitted when answer caching is disabled
+	Cache *CacheStats `json:"cache,omitempty"`
+	// Usage is the tokens generated and their cost since startup
+	Usage UsageStats `json:"usage"`
+	// Storage is the history backend's recent latency, when it is metered
+	Storage *StorageStats `json:"storage,omitempty"`
+	// Namespace is the history the figures above are for, omitted for the
+	// default one
+	Namespace string `json:"namespace,omitempty"`
 }
 
 // ErrorResponse represents an error response
@@ -30,16 +190,33 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// IndexData is the data rendered into the index template
+type IndexData struct {
+	Question string
+	Answer   string
+	Theme    Theme
+	// Dormant shows the board at rest, with the form disabled, when the model
+	// backend is off or unavailable
+	Dormant bool
+}
+
 // indexHandler serves the main HTML page
 func (app *App) indexHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl, err := template.ParseFiles("templates/index.html")
-	if err != nil {
-		log.Printf("Error parsing template: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	app.renderIndex(w, r, IndexData{})
+}
+
+// renderIndex renders the main HTML page, including an answer for no-JavaScript form posts
+func (app *App) renderIndex(w http.ResponseWriter, r *http.Request, data IndexData) {
+	// Unknown ?theme= values quietly fall back to the configured theme
+	theme, ok := app.resolveTheme(r)
+	if !ok {
+		theme = themes[app.config.BoardTheme]
 	}
+	data.Theme = theme
+	data.Dormant = app.dormant()
 
-	if err := tmpl.Execute(w, nil); err != nil {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := app.indexTemplate.Execute(w, data); err != nil {
 		log.Printf("Error executing template: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
@@ -47,80 +224,670 @@ func (app *App) indexHandler(w http.ResponseWriter, r *http.Request) {
 
 // askHandler handles question submissions
 func (app *App) askHandler(w http.ResponseWriter, r *http.Request) {
-	// Validate content type
-	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		respondWithError(w, "Content-Type must be application/json", http.StatusBadRequest)
+	req, ok := app.decodeAskRequest(w, r)
+	if !ok {
 		return
 	}
 
-	// Parse request
-	var req AskRequest
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
+	// Track the caller's session
+	session := app.resolveSession(w, r)
+	usage := &generationUsage{}
+	confidence := &answerConfidence{}
+	ctx := contextWithUsage(contextWithSession(r.Context(), session), usage)
+	ctx = contextWithConfidence(contextWithPersonality(ctx, req.Personality), confidence)
+	ctx = contextWithModel(contextWithTags(ctx, req.Tags), req.Model)
+	ctx = contextWithSource(ctx, &reportedSource{})
 
-	if err := decoder.Decode(&req); err != nil {
-		respondWithError(w, "Invalid request format", http.StatusBadRequest)
+	if req.CallbackURL != "" {
+		app.askWithCallback(ctx, w, r, req, usage)
 		return
 	}
 
-	// Validate question length
-	if len(req.Question) > 1000 {
-		respondWithError(w, "Question too long (max 1000 characters)", http.StatusBadRequest)
+	// Resolve the dedupe key: a retry presents either the server-generated
+	// request_id or its own idempotency key via the Idempotency-Key header
+	requestID := r.Header.Get("Idempotency-Key")
+	if requestID == "" {
+		requestID = newRequestID()
+	} else if !validIdempotencyKey(requestID) {
+		respondWithError(w, r, "Invalid Idempotency-Key header", http.StatusBadRequest)
 		return
 	}
 
-	// Validate question is not empty after trimming
-	if strings.TrimSpace(req.Question) == "" {
-		respondWithError(w, "Question cannot be empty", http.StatusBadRequest)
+	// Entries are kept under the client's scope but the client only ever
+	// sees the bare request ID
+	fingerprint := requestFingerprint(req, app.normalizer)
+	key := app.idempotencyScope(r) + " " + requestID
+	entry, reserved := app.responses.begin(key, fingerprint)
+	if !reserved {
+		if !entry.matches(fingerprint) {
+			respondWithError(w, r, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+			return
+		}
+		// Already generated (or generating) for this key, return that answer
+		resp, ok := entry.wait(r.Context())
+		if !ok {
+			respondWithError(w, r, "Request with this Idempotency-Key is not available", http.StatusConflict)
+			return
+		}
+		app.respondWithAnswer(w, r, req, resp)
+		return
+	}
+
+	release, ok := app.acquireGeneration(w, r)
+	if !ok {
+		app.responses.abort(key)
 		return
 	}
 
-	// Generate answer using Ollama
-	answer, err := app.ollama.GenerateAnswer(r.Context(), req.Question)
+	// Generate answer using Ollama, giving a canned answer if the spirits fail
+	start := time.Now()
+	answer, err := app.generator.GenerateAnswer(ctx, req.Question)
+	app.metrics.observe(time.Since(start), err)
+	release()
+	cost := app.costs.record(usage)
+	source := app.generatedSource(ctx)
+	if fallback, ok := app.fallback(err); ok {
+		log.Printf("Error generating answer, using fallback: %v", err)
+		answer, err, source = fallback, nil, answerSourceFallback
+	}
 	if err != nil {
+		app.responses.abort(key)
 		log.Printf("Error generating answer: %v", err)
-		respondWithError(w, "Failed to generate answer", http.StatusInternalServerError)
+		app.respondGenerationError(w, r, err, "Failed to generate answer", http.StatusInternalServerError)
+		return
+	}
+
+	// Store Q&A pair unless the request opted out of history
+	if req.shouldStore() {
+		app.storeAnswer(ctx, req.Question, answer, cost)
+	}
+
+	// Respond with answer
+	resp := AskResponse{Answer: answer, RequestID: requestID, Confidence: confidenceFromContext(ctx), Source: source}
+	app.responses.complete(key, resp)
+	app.respondWithAnswer(w, r, req, resp)
+}
+
+// fallbackFor returns the canned answer to give in place of a failed
+// generation, or false when the error should be reported to the client
+func fallbackFor(err error) (string, bool) {
+	switch {
+	case err == nil:
+		return "", false
+	case errors.Is(err, ErrModelNotFound):
+		return modelMissingAnswer, true
+	case errors.Is(err, ErrOllamaUnreachable),
+		errors.Is(err, ErrOllamaTimeout),
+		errors.Is(err, ErrOllamaStatus),
+		errors.Is(err, ErrEmptyResponse):
+		return fallbackAnswer, true
+	}
+	return "", false
+}
+
+// respondGenerationError reports a generation that failed without a
+// fallback: an overloaded model gets 503 with Retry-After, a prompt over
+// MAX_PROMPT_TOKENS 413, and anything else message with status
+func (app *App) respondGenerationError(w http.ResponseWriter, r *http.Request, err error, message string, status int) {
+	switch {
+	case app.respondOverloaded(w, r, err):
+	case errors.Is(err, ErrPromptTooLarge):
+		respondWithError(w, r, app.messages.Load().PromptTooLarge, http.StatusRequestEntityTooLarge)
+	default:
+		respondWithError(w, r, message, status)
+	}
+}
+
+// respondWithAnswer sends an answer as the board's HTML page to browsers
+// that submitted a plain form or followed a GET /ask link, and as JSON otherwise
+func (app *App) respondWithAnswer(w http.ResponseWriter, r *http.Request, req AskRequest, resp AskResponse) {
+	if r.Method == http.MethodGet {
+		// Every GET is a fresh reading, proxies and browsers must not replay it
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	if (isFormRequest(r) || r.Method == http.MethodGet) && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		app.renderIndex(w, r, IndexData{Question: req.Question, Answer: resp.Answer})
+		return
+	}
+	respondWithJSON(w, r, resp, http.StatusOK)
+}
+
+// isFormRequest reports whether the request body is an HTML form submission
+func isFormRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
+}
+
+// askStructuredHandler answers a question with a JSON answer and confidence score
+func (app *App) askStructuredHandler(w http.ResponseWriter, r *http.Request) {
+	req, ok := app.decodeAskRequest(w, r)
+	if !ok {
+		return
+	}
+
+	session := app.resolveSession(w, r)
+	usage := &generationUsage{}
+	ctx := contextWithUsage(contextWithSession(r.Context(), session), usage)
+	ctx = contextWithModel(contextWithTags(contextWithPersonality(ctx, req.Personality), req.Tags), req.Model)
+
+	release, ok := app.acquireGeneration(w, r)
+	if !ok {
+		return
+	}
+
+	start := time.Now()
+	answer, err := app.generator.GenerateStructuredAnswer(ctx, req.Question)
+	app.metrics.observe(time.Since(start), err)
+	release()
+	cost := app.costs.record(usage)
+	if err != nil {
+		log.Printf("Error generating structured answer: %v", err)
+		app.respondGenerationError(w, r, err, "The spirits cannot answer at this time. Try again later.", http.StatusBadGateway)
+		return
+	}
+
+	if req.shouldStore() {
+		app.storeAnswer(ctx, req.Question, answer.Answer, cost)
+	}
+
+	respondWithJSON(w, r, answer, http.StatusOK)
+}
+
+// errTrailingData is returned when a JSON body continues after its object
+var errTrailingData = errors.New("trailing data after JSON body")
+
+// expectEOF checks that only whitespace follows the value just decoded, since
+// Decode alone stops after the first value and ignores anything after it
+func expectEOF(decoder *json.Decoder) error {
+	var extra json.RawMessage
+	err := decoder.Decode(&extra)
+	if err == io.EOF {
+		return nil
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return errTrailingData
+}
+
+// INVALID_UTF8 modes
+const (
+	invalidUTF8Replace = "replace"
+	invalidUTF8Reject  = "reject"
+)
+
+// decodeAskRequest parses and validates an /ask request body, sent either as
+// JSON or as an HTML form. On failure it writes the error response and
+// returns false.
+func (app *App) decodeAskRequest(w http.ResponseWriter, r *http.Request) (AskRequest, bool) {
+	var req AskRequest
+	var err error
+	// invalidBody is set when a JSON body has invalid UTF-8, which the
+	// decoder would otherwise replace without a trace
+	invalidBody := false
+
+	switch {
+	case r.Method == http.MethodGet:
+		req, err = decodeAskQuery(r)
+	case isFormRequest(r):
+		req, err = decodeAskForm(r)
+	case strings.Contains(r.Header.Get("Content-Type"), "application/json"):
+		var body []byte
+		if body, err = io.ReadAll(r.Body); err != nil {
+			break
+		}
+		invalidBody = !utf8.Valid(body)
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		if app.config.StrictJSON {
+			decoder.DisallowUnknownFields()
+		}
+		err = decoder.Decode(&req)
+		if err == nil {
+			err = expectEOF(decoder)
+		}
+	default:
+		respondWithError(w, r, "Content-Type must be application/json or application/x-www-form-urlencoded", http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			respondBodyTooLarge(w, r)
+			return AskRequest{}, false
+		}
+		respondWithError(w, r, app.messages.Load().decodeError(err), http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	// Handle invalid UTF-8 per INVALID_UTF8 before it reaches the prompt or
+	// history. The decoder has already replaced bad bytes in JSON bodies, so
+	// those are checked as they arrived.
+	if invalidBody || !utf8.ValidString(req.Question) {
+		if app.config.InvalidUTF8 == invalidUTF8Reject {
+			respondWithError(w, r, app.messages.Load().InvalidUTF8, http.StatusBadRequest)
+			return AskRequest{}, false
+		}
+		req.Question = strings.ToValidUTF8(req.Question, string(utf8.RuneError))
+	}
+
+	// Validate question length
+	if len(req.Question) > maxQuestionLength {
+		respondWithError(w, r, app.messages.Load().questionTooLong(maxQuestionLength), http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	// Validate question is not empty after trimming
+	if strings.TrimSpace(req.Question) == "" {
+		respondWithError(w, r, app.messages.Load().QuestionEmpty, http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	// Strictly themed boards only answer actual questions
+	if app.config.RequireQuestionMark && !strings.HasSuffix(strings.TrimRightFunc(req.Question, unicode.IsSpace), "?") {
+		respondWithError(w, r, app.messages.Load().NotAQuestion, http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	if req.Personality != "" && !validPersonality(req.Personality) {
+		respondWithError(w, r, fmt.Sprintf("Unknown personality, expected one of %v", personalityNames()), http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	if req.Model != "" && !app.validModel(req.Model) {
+		respondWithError(w, r, fmt.Sprintf("Unknown model, expected one of %v", app.modelNames()), http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	if req.Tags, err = normalizeTags(req.Tags); err != nil {
+		respondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	// Validate question against the configured character allowlist
+	if app.questionPattern != nil && !app.questionPattern.MatchString(req.Question) {
+		respondWithError(w, r, app.messages.Load().DisallowedCharacters, http.StatusBadRequest)
+		return AskRequest{}, false
+	}
+
+	return req, true
+}
+
+// decodeAskForm reads an AskRequest from form fields
+func decodeAskForm(r *http.Request) (AskRequest, error) {
+	if err := r.ParseForm(); err != nil {
+		return AskRequest{}, err
+	}
+
+	req := AskRequest{Question: r.PostForm.Get("question"), Personality: r.PostForm.Get("personality"), Tags: splitTags(r.PostForm.Get("tags")), Model: r.PostForm.Get("model")}
+	if value := r.PostForm.Get("store"); value != "" {
+		store, err := strconv.ParseBool(value)
+		if err != nil {
+			return AskRequest{}, err
+		}
+		req.Store = &store
+	}
+	return req, nil
+}
+
+// decodeAskQuery reads a GET /ask request from the q and store query params
+func decodeAskQuery(r *http.Request) (AskRequest, error) {
+	query := r.URL.Query()
+	req := AskRequest{Question: query.Get("q"), Personality: query.Get("personality"), Tags: splitTags(query.Get("tags")), Model: query.Get("model")}
+	if value := query.Get("store"); value != "" {
+		store, err := strconv.ParseBool(value)
+		if err != nil {
+			return AskRequest{}, err
+		}
+		req.Store = &store
+	}
+	return req, nil
+}
+
+// storeAnswer saves a Q&A pair and what it cost to history, tagged with the
+// session carried by ctx, unless history is disabled
+func (app *App) storeAnswer(ctx context.Context, question, answer string, cost float64) {
+	if app.config.DisableHistory {
 		return
 	}
 
-	// Store Q&A pair
+	// Keyword tags would give away what hashed or dropped questions were about
+	tags := tagsFromContext(ctx)
+	if app.config.StoreQuestionMode == "full" {
+		tags = mergeTags(tags, app.tagger.classify(question))
+	}
+
 	pair := QAPair{
-		Question: req.Question,
-		Answer:   answer,
+		Question:   storedQuestion(question, app.config.StoreQuestionMode),
+		Answer:     answer,
+		Cost:       cost,
+		Tags:       tags,
+		Confidence: confidenceFromContext(ctx),
+		SessionID:  sessionIDFromContext(ctx),
 	}
 
-	if err := app.storage.Add(pair); err != nil {
+	if err := app.storageFor(ctx).Add(ctx, pair); err != nil {
 		log.Printf("Error storing Q&A pair: %v", err)
 		// Don't fail the request if storage fails, just log it
 	}
+}
 
-	// Respond with answer
-	respondWithJSON(w, AskResponse{Answer: answer}, http.StatusOK)
+// storedQuestion returns what history keeps of a question under
+// STORE_QUESTION_MODE: "full" keeps the text, "hashed" its hex SHA-256
+// and "none" nothing
+func storedQuestion(question, mode string) string {
+	switch mode {
+	case "hashed":
+		sum := sha256.Sum256([]byte(question))
+		return hex.EncodeToString(sum[:])
+	case "none":
+		return ""
+	default:
+		return question
+	}
 }
 
-// historyHandler returns all Q&A history
+// validStoreQuestionMode reports whether mode is a supported STORE_QUESTION_MODE value
+func validStoreQuestionMode(mode string) bool {
+	return mode == "full" || mode == "hashed" || mode == "none"
+}
+
+// historyHandler returns the most recent Q&A history. ?limit= asks for
+// fewer pairs; callers without the admin token get at most
+// DEFAULT_HISTORY_LIMIT however large a limit they ask for. ?before= pages
+// back through older pairs, and GETALL_MAX bounds every response.
 func (app *App) historyHandler(w http.ResponseWriter, r *http.Request) {
-	pairs, err := app.storage.GetAll()
+	limit, before, ok := historyPaging(w, r)
+	if !ok {
+		return
+	}
+	if maxPairs := app.config.DefaultHistoryLimit; maxPairs > 0 && !app.authorizeAdmin(r) && (limit == 0 || limit > maxPairs) {
+		limit = maxPairs
+	}
+	loc, ok := historyLocation(w, r)
+	if !ok {
+		return
+	}
+
+	// ?tag= narrows history to one tag
+	tag := ""
+	if value := r.URL.Query().Get("tag"); value != "" {
+		tags, err := normalizeTags([]string{value})
+		if err != nil {
+			respondWithError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tag = tags[0]
+	}
+
+	var pairs []QAPair
+	var err error
+	if tag != "" {
+		pairs, err = app.storageFor(r.Context()).GetByTag(tag)
+	} else {
+		pairs, err = app.storageFor(r.Context()).GetAll()
+	}
 	if err != nil {
 		log.Printf("Error retrieving history: %v", err)
-		respondWithError(w, "Failed to retrieve history", http.StatusInternalServerError)
+		respondWithError(w, r, "Failed to retrieve history", http.StatusInternalServerError)
 		return
 	}
 
-	respondWithJSON(w, pairs, http.StatusOK)
+	respondWithJSON(w, r, pairsInLocation(app.pageHistory(w, r, pairs, limit, before), loc), http.StatusOK)
 }
 
-// respondWithJSON sends a JSON response
-func respondWithJSON(w http.ResponseWriter, payload interface{}, statusCode int) {
+// historyPaging reads a history request's ?limit= and ?before=, either 0
+// when absent. Malformed values get a 400 and false.
+func historyPaging(w http.ResponseWriter, r *http.Request) (limit int, before int64, ok bool) {
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			respondWithError(w, r, "limit must be a positive number", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = parsed
+	}
+	if value := r.URL.Query().Get("before"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			respondWithError(w, r, "before must be a pair ID", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		before = parsed
+	}
+	return limit, before, true
+}
+
+// pageHistory returns the page of pairs, oldest first, a history request
+// asked for with limit and before, capped at GETALL_MAX
+func (app *App) pageHistory(w http.ResponseWriter, r *http.Request, pairs []QAPair, limit int, before int64) []QAPair {
+	// Pairs are oldest first, so IDs ascend and the most recent are at the end
+	if before > 0 {
+		pairs = pairs[:sort.Search(len(pairs), func(i int) bool { return pairs[i].ID >= before })]
+	}
+	if limit > 0 && len(pairs) > limit {
+		pairs = pairs[len(pairs)-limit:]
+	}
+	// However large a history is misconfigured to be, it is never sent all
+	// at once; truncated responses link to the page before them
+	if maxPairs := app.config.GetAllMax; maxPairs > 0 && len(pairs) > maxPairs {
+		pairs = pairs[len(pairs)-maxPairs:]
+		w.Header().Set("X-History-Truncated", "true")
+		w.Header().Set("Link", historyPageLink(r, pairs[0].ID, maxPairs))
+	}
+	return pairs
+}
+
+// historyPageLink returns a Link header pointing at the limit pairs before
+// the pair with ID before, keeping the request's other parameters
+func historyPageLink(r *http.Request, before int64, limit int) string {
+	query := r.URL.Query()
+	query.Set("before", strconv.FormatInt(before, 10))
+	query.Set("limit", strconv.Itoa(limit))
+	return fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, query.Encode())
+}
+
+// historyLocation returns the time zone requested with ?tz= (an IANA name
+// such as Europe/Paris) for history timestamps, or nil for none. Unknown
+// zones get a 400 and false.
+func historyLocation(w http.ResponseWriter, r *http.Request) (*time.Location, bool) {
+	name := r.URL.Query().Get("tz")
+	if name == "" {
+		return nil, true
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		respondWithError(w, r, "tz must be an IANA time zone such as Europe/Paris", http.StatusBadRequest)
+		return nil, false
+	}
+	return loc, true
+}
+
+// pairsInLocation returns pairs with their creation times shown in loc, or
+// pairs itself when loc is nil. Stored pairs may be shared, so the
+// converted ones are copies.
+func pairsInLocation(pairs []QAPair, loc *time.Location) []QAPair {
+	if loc == nil {
+		return pairs
+	}
+	converted := make([]QAPair, len(pairs))
+	for i, pair := range pairs {
+		pair.CreatedAt = pair.CreatedAt.In(loc)
+		converted[i] = pair
+	}
+	return converted
+}
+
+// sessionHistoryHandler returns the Q&A pairs asked in the caller's session,
+// paged and capped like /history
+func (app *App) sessionHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	limit, before, ok := historyPaging(w, r)
+	if !ok {
+		return
+	}
+	loc, ok := historyLocation(w, r)
+	if !ok {
+		return
+	}
+	session := app.resolveSession(w, r)
+
+	pairs, err := app.storageFor(r.Context()).GetBySession(session.ID)
+	if err != nil {
+		log.Printf("Error retrieving session history: %v", err)
+		respondWithError(w, r, "Failed to retrieve history", http.StatusInternalServerError)
+		return
+	}
+
+	respondWithJSON(w, r, pairsInLocation(app.pageHistory(w, r, pairs, limit, before), loc), http.StatusOK)
+}
+
+// replayHandler re-asks a stored question and returns both answers. With
+// ADMIN_TOKEN set only admins may replay, since every replay costs a
+// generation.
+func (app *App) replayHandler(w http.ResponseWriter, r *http.Request) {
+	if app.config.AdminToken != "" && !app.authorizeAdmin(r) {
+		respondWithError(w, r, "The spirits do not answer to you", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, r, "Invalid history ID", http.StatusBadRequest)
+		return
+	}
+
+	previous, err := app.storageFor(r.Context()).Get(id)
+	if errors.Is(err, ErrNotFound) {
+		respondWithError(w, r, "The spirits have no memory of that question", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error retrieving Q&A pair %d: %v", id, err)
+		respondWithError(w, r, "Failed to retrieve history", http.StatusInternalServerError)
+		return
+	}
+
+	release, ok := app.acquireGeneration(w, r)
+	if !ok {
+		return
+	}
+
+	// Replays always ask the spirits again rather than using a cached answer,
+	// and the new answer belongs to whoever asked for the replay
+	session := app.resolveSession(w, r)
+	usage := &generationUsage{}
+	ctx := contextWithUsage(contextWithCacheBypass(contextWithSession(r.Context(), session)), usage)
+	ctx = contextWithTags(ctx, previous.Tags)
+	start := time.Now()
+	answer, err := app.generator.GenerateAnswer(ctx, previous.Question)
+	app.metrics.observe(time.Since(start), err)
+	release()
+	cost := app.costs.record(usage)
+	if fallback, ok := app.fallback(err); ok {
+		log.Printf("Error generating answer, using fallback: %v", err)
+		answer, err = fallback, nil
+	}
+	if err != nil {
+		log.Printf("Error generating answer: %v", err)
+		app.respondGenerationError(w, r, err, "Failed to generate answer", http.StatusInternalServerError)
+		return
+	}
+
+	app.storeAnswer(ctx, previous.Question, answer, cost)
+
+	respondWithJSON(w, r, ReplayResponse{
+		ID:             previous.ID,
+		Question:       previous.Question,
+		PreviousAnswer: previous.Answer,
+		Answer:         answer,
+	}, http.StatusOK)
+}
+
+// statsHandler returns runtime statistics. History figures are for the
+// namespace selected with X-Board-Namespace, the default history otherwise.
+func (app *App) statsHandler(w http.ResponseWriter, r *http.Request) {
+	storage := app.storageFor(r.Context())
+	pairs, err := storage.GetAll()
+	if err != nil {
+		log.Printf("Error retrieving history: %v", err)
+		respondWithError(w, r, "Failed to retrieve stats", http.StatusInternalServerError)
+		return
+	}
+
+	stats := StatsResponse{
+		Namespace:          namespaceFromContext(r.Context()),
+		Sessions:           app.sessions.Len(),
+		HistorySize:        len(pairs),
+		HistorySubscribers: app.historySubscribers.Load(),
+		Usage:              app.costs.Totals(),
+	}
+	if metered, ok := storage.(*MeteredStorage); ok {
+		storageStats := metered.Stats()
+		stats.Storage = &storageStats
+	}
+	if reporter, ok := app.generator.(cacheReporter); ok {
+		if cache, ok := reporter.CacheStats(); ok {
+			stats.Cache = &cache
+		}
+	}
+
+	respondWithJSON(w, r, stats, http.StatusOK)
+}
+
+// dormant reports whether the board should be shown at rest: it was put to
+// sleep with BOARD_DORMANT, or the model is known to be unavailable
+func (app *App) dormant() bool {
+	return app.config.BoardDormant || (app.models != nil && !app.models.Ready())
+}
+
+// readyHandler reports whether the configured model is available, using the
+// status cached by the model watcher
+func (app *App) readyHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.started.Load() {
+		respondWithError(w, r, "The board is still waking", http.StatusServiceUnavailable)
+		return
+	}
+	if app.config.BoardDormant {
+		respondWithError(w, r, "The board is dormant", http.StatusServiceUnavailable)
+		return
+	}
+	if app.models != nil && !app.models.Ready() {
+		respondWithError(w, r, "The spirits are not yet ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	respondWithJSON(w, r, StatusResponse{Status: "ready"}, http.StatusOK)
+}
+
+// notFoundHandler returns a JSON 404 for unmatched routes
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, r, "The spirits cannot find what you seek", http.StatusNotFound)
+}
+
+// methodNotAllowedHandler returns a JSON 405 for routes called with the wrong method
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, r, "The spirits do not answer when asked that way", http.StatusMethodNotAllowed)
+}
+
+// respondWithJSON sends a JSON response, indented when the request asked for
+// pretty output (see prettyJSONMiddleware)
+func respondWithJSON(w http.ResponseWriter, r *http.Request, payload interface{}, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
 
-	if err := json.NewEncoder(w).Encode(payload); err != nil {
+	encoder := json.NewEncoder(w)
+	if prettyJSONFromContext(r.Context()) {
+		encoder.SetIndent("", "  ")
+	}
+
+	if err := encoder.Encode(payload); err != nil {
 		log.Printf("Error encoding JSON response: %v", err)
 	}
 }
 
 // respondWithError sends an error response
-func respondWithError(w http.ResponseWriter, message string, statusCode int) {
-	respondWithJSON(w, ErrorResponse{Error: message}, statusCode)
+func respondWithError(w http.ResponseWriter, r *http.Request, message string, statusCode int) {
+	respondWithJSON(w, r, ErrorResponse{Error: message}, statusCode)
 }
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestApp builds an App around gen with the default configuration, as
+// main does but without the background workers
+func newTestApp(t *testing.T, gen AnswerGenerator) *App {
+	t.Helper()
+
+	config := LoadConfig()
+	app := &App{
+		config:    config,
+		storage:   NewMemoryStorage(config.MaxHistorySize, config.HistoryTTL),
+		generator: gen,
+		responses: newResponseStore(config.IdempotencyTTL),
+		sessions:  newSessionStore(config.MaxSessions, config.SessionIdleTimeout),
+		resolver:  &ipResolver{},
+		streams:   newStreamTracker(),
+		seances:   newSeanceHub(),
+		costs:     newCostMeter(config.CostPerToken),
+		rng:       newLockedRand(config.FallbackSeed),
+	}
+	messages, err := loadMessages("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.messages.Store(&messages)
+	if app.normalizer, err = newQuestionNormalizer(config.QuestionNormalization); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// askJSON posts body to /ask with the given extra headers
+func askJSON(app *App, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ask", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	app.askHandler(rec, req)
+	return rec
+}
+
+func TestAskIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		second     string
+		headers    map[string]string
+		wantStatus int
+		wantAsked  int
+	}{
+		{
+			name:       "retry returns the stored answer",
+			second:     `{"question":"Will it rain?"}`,
+			wantStatus: http.StatusOK,
+			wantAsked:  1,
+		},
+		{
+			name:       "retry respelling the question returns the stored answer",
+			second:     `{"question":"will it  RAIN?"}`,
+			wantStatus: http.StatusOK,
+			wantAsked:  1,
+		},
+		{
+			name:       "different question is rejected",
+			second:     `{"question":"Will it snow?"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantAsked:  1,
+		},
+		{
+			name:       "different options are rejected",
+			second:     `{"question":"Will it rain?","store":false}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantAsked:  1,
+		},
+		{
+			name:       "another client gets its own answer",
+			second:     `{"question":"Will it rain?"}`,
+			headers:    map[string]string{"X-Forwarded-For": "203.0.113.9"},
+			wantStatus: http.StatusOK,
+			wantAsked:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &FakeGenerator{Answer: "YES"}
+			app := newTestApp(t, gen)
+
+			first := askJSON(app, `{"question":"Will it rain?"}`, map[string]string{"Idempotency-Key": "key-1"})
+			if first.Code != http.StatusOK {
+				t.Fatalf("first ask: status %d, body %s", first.Code, first.Body)
+			}
+
+			headers := map[string]string{"Idempotency-Key": "key-1"}
+			for name, value := range tt.headers {
+				headers[name] = value
+			}
+			// The second client differs by address, so make the remote
+			// address a trusted proxy for the forwarded one to count
+			if _, ok := tt.headers["X-Forwarded-For"]; ok {
+				app.resolver.trustedProxies, _ = parseIPRanges([]string{"192.0.2.0/24"})
+			}
+			second := askJSON(app, tt.second, headers)
+			if second.Code != tt.wantStatus {
+				t.Fatalf("second ask: status %d, want %d, body %s", second.Code, tt.wantStatus, second.Body)
+			}
+			if asked := len(gen.Questions()); asked != tt.wantAsked {
+				t.Errorf("generator asked %d times, want %d", asked, tt.wantAsked)
+			}
+		})
+	}
+}
+
+func TestAskIdempotencyRequestID(t *testing.T) {
+	gen := &FakeGenerator{Answer: "YES"}
+	app := newTestApp(t, gen)
+
+	first := askJSON(app, `{"question":"Will it rain?"}`, nil)
+	var resp AskResponse
+	if err := json.NewDecoder(first.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrying with the server-generated request_id is deduplicated
+	retry := askJSON(app, `{"question":"Will it rain?"}`, map[string]string{"Idempotency-Key": resp.RequestID})
+	if retry.Code != http.StatusOK {
+		t.Fatalf("retry: status %d, body %s", retry.Code, retry.Body)
+	}
+	if asked := len(gen.Questions()); asked != 1 {
+		t.Errorf("generator asked %d times after a retry, want 1", asked)
+	}
+}
+
+func TestReplayAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		wantStatus    int
+	}{
+		{name: "open without ADMIN_TOKEN", wantStatus: http.StatusOK},
+		{name: "no token", adminToken: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", adminToken: "secret", authorization: "Bearer guess", wantStatus: http.StatusUnauthorized},
+		{name: "admin token", adminToken: "secret", authorization: "Bearer secret", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &FakeGenerator{Answer: "NO"}
+			app := newTestApp(t, gen)
+			app.config.AdminToken = tt.adminToken
+			if err := app.storage.Add(context.Background(), QAPair{Question: "Will it rain?", Answer: "YES"}); err != nil {
+				t.Fatal(err)
+			}
+
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/history/1/replay", nil), map[string]string{"id": "1"})
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			app.replayHandler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			wantAsked := 0
+			if tt.wantStatus == http.StatusOK {
+				wantAsked = 1
+			}
+			if asked := len(gen.Questions()); asked != wantAsked {
+				t.Errorf("generator asked %d times, want %d", asked, wantAsked)
+			}
+		})
+	}
+}
+
+func TestAskModelSelection(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "no model", body: `{"question":"Will it rain?"}`, wantStatus: http.StatusOK},
+		{name: "OLLAMA_MODEL", body: `{"question":"Will it rain?","model":"qwen3"}`, wantStatus: http.StatusOK},
+		{name: "listed model", body: `{"question":"Will it rain?","model":"llama3"}`, wantStatus: http.StatusOK},
+		{name: "unlisted model", body: `{"question":"Will it rain?","model":"gpt-4"}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+			app.config.OllamaModel = "qwen3"
+			app.config.OllamaModels = []string{"llama3"}
+
+			if rec := askJSON(app, tt.body, nil); rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAskGenerationErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantError  string
+	}{
+		{name: "prompt too large", err: ErrPromptTooLarge, wantStatus: http.StatusRequestEntityTooLarge, wantError: defaultMessages().PromptTooLarge},
+		{name: "overloaded", err: ErrOllamaOverloaded, wantStatus: http.StatusServiceUnavailable},
+		{name: "unreachable falls back", err: ErrOllamaUnreachable, wantStatus: http.StatusOK},
+		{name: "first-byte timeout falls back", err: ErrFirstByteTimeout, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &FakeGenerator{Err: tt.err})
+			rec := askJSON(app, `{"question":"Will it rain?"}`, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantError != "" && !strings.Contains(rec.Body.String(), tt.wantError) {
+				t.Errorf("body %s, want the error %q", rec.Body, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestAskStrictJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		strict     bool
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{name: "strict, known fields", strict: true, body: `{"question":"Will it rain?"}`, wantStatus: http.StatusOK},
+		{name: "strict, unknown field", strict: true, body: `{"question":"Will it rain?","client":"web"}`, wantStatus: http.StatusBadRequest, wantError: `"client"`},
+		{name: "lenient, unknown field", body: `{"question":"Will it rain?","client":"web"}`, wantStatus: http.StatusOK},
+		{name: "lenient, wrong type", body: `{"question":42}`, wantStatus: http.StatusBadRequest, wantError: `"question"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &FakeGenerator{Answer: "YES"}
+			app := newTestApp(t, gen)
+			app.config.StrictJSON = tt.strict
+
+			rec := askJSON(app, tt.body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantError != "" {
+				var resp ErrorResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || !strings.Contains(resp.Error, tt.wantError) {
+					t.Errorf("error %q, want it to name %s", resp.Error, tt.wantError)
+				}
+			}
+			if tt.wantStatus != http.StatusOK && len(gen.Questions()) != 0 {
+				t.Error("a rejected request reached the generator")
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutBoundsRetries(t *testing.T) {
+	const budget = 300 * time.Millisecond
+
+	tests := []struct {
+		name       string
+		answer     string
+		wantSource string
+	}{
+		// Every answer is too short, so it is regenerated until time runs out
+		{name: "regenerations", answer: "A", wantSource: answerSourceModel},
+		// Every answer is empty, so it is retried until time runs out
+		{name: "empty retries", answer: "", wantSource: answerSourceFallback},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var asked atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				asked.Add(1)
+				select {
+				case <-time.After(50 * time.Millisecond):
+				case <-r.Context().Done():
+					return
+				}
+				json.NewEncoder(w).Encode(OllamaResponse{Response: tt.answer, Done: true})
+			}))
+			defer srv.Close()
+
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.MinAnswerLength = 100
+				config.MinAnswerRetries = 1000
+				config.EmptyAnswerRetries = 1000
+			})
+			app := newTestApp(t, client)
+			handler := requestTimeoutMiddleware(budget)(http.HandlerFunc(app.askHandler))
+
+			req := httptest.NewRequest(http.MethodPost, "/ask", strings.NewReader(`{"question":"Will it rain?"}`))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			handler.ServeHTTP(rec, req)
+			elapsed := time.Since(start)
+
+			if elapsed > budget+150*time.Millisecond {
+				t.Errorf("took %v with a %v budget", elapsed, budget)
+			}
+			if asked.Load() < 2 {
+				t.Errorf("Ollama asked %d times, want the budget spent on retries", asked.Load())
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+			}
+			var resp AskResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Source != tt.wantSource {
+				t.Errorf("source %q, want %q", resp.Source, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestStoreQuestionMode(t *testing.T) {
+	sum := sha256.Sum256([]byte("Will it rain?"))
+	hashed := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		mode         string
+		wantQuestion string
+	}{
+		{mode: "full", wantQuestion: "Will it rain?"},
+		{mode: "hashed", wantQuestion: hashed},
+		{mode: "none", wantQuestion: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+			app.config.StoreQuestionMode = tt.mode
+
+			rec := askJSON(app, `{"question":"Will it rain?"}`, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+			}
+
+			pairs, err := app.storage.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pairs) != 1 {
+				t.Fatalf("%d pairs stored, want 1", len(pairs))
+			}
+			if pairs[0].Question != tt.wantQuestion {
+				t.Errorf("stored question %q, want %q", pairs[0].Question, tt.wantQuestion)
+			}
+			// The answer is kept whatever happens to the question
+			if pairs[0].Answer != "YES" {
+				t.Errorf("stored answer %q, want YES", pairs[0].Answer)
+			}
+		})
+	}
+}
+
+func TestAskTrailingData(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "single object", body: `{"question":"Will it rain?"}`, wantStatus: http.StatusOK},
+		{name: "trailing whitespace", body: "{\"question\":\"Will it rain?\"}\n\t ", wantStatus: http.StatusOK},
+		{name: "trailing junk", body: `{"question":"Will it rain?"}garbage`, wantStatus: http.StatusBadRequest},
+		{name: "second object", body: `{"question":"Will it rain?"}{"question":"Will it snow?"}`, wantStatus: http.StatusBadRequest},
+		{name: "trailing bracket", body: `{"question":"Will it rain?"}}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &FakeGenerator{Answer: "YES"}
+			app := newTestApp(t, gen)
+
+			rec := askJSON(app, tt.body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusBadRequest {
+				var resp ErrorResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Error != app.messages.Load().TrailingData {
+					t.Errorf("error %q, want %q", resp.Error, app.messages.Load().TrailingData)
+				}
+				if len(gen.Questions()) != 0 {
+					t.Error("a request with trailing data reached the generator")
+				}
+			}
+		})
+	}
+}
+
+func TestAskInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		contentType string
+		method      string
+		target      string
+		body        string
+		wantStatus  int
+	}{
+		{name: "json replaced", mode: "replace", contentType: "application/json", body: "{\"question\":\"Will it \xff\xfe rain?\"}", wantStatus: http.StatusOK},
+		{name: "json rejected", mode: "reject", contentType: "application/json", body: "{\"question\":\"Will it \xff\xfe rain?\"}", wantStatus: http.StatusBadRequest},
+		{name: "json valid", mode: "reject", contentType: "application/json", body: `{"question":"Will it rain? ☂"}`, wantStatus: http.StatusOK},
+		{name: "form replaced", mode: "replace", contentType: "application/x-www-form-urlencoded", body: "question=Will+it+%E9+rain%3F", wantStatus: http.StatusOK},
+		{name: "form rejected", mode: "reject", contentType: "application/x-www-form-urlencoded", body: "question=Will+it+%E9+rain%3F", wantStatus: http.StatusBadRequest},
+		{name: "query replaced", mode: "replace", method: http.MethodGet, target: "/ask?q=Will+it+%ff%fe+rain%3F", wantStatus: http.StatusOK},
+		{name: "query rejected", mode: "reject", method: http.MethodGet, target: "/ask?q=Will+it+%ff%fe+rain%3F", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &FakeGenerator{Answer: "YES"}
+			app := newTestApp(t, gen)
+			app.config.InvalidUTF8 = tt.mode
+
+			method, target := http.MethodPost, "/ask"
+			if tt.method != "" {
+				method, target = tt.method, tt.target
+			}
+			req := httptest.NewRequest(method, target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			app.askHandler(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			asked := gen.Questions()
+			if tt.wantStatus != http.StatusOK {
+				if len(asked) != 0 {
+					t.Errorf("rejected question reached the generator as %q", asked)
+				}
+				return
+			}
+			pairs, err := app.storage.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(asked) != 1 || !utf8.ValidString(asked[0]) || len(pairs) != 1 || !utf8.ValidString(pairs[0].Question) {
+				t.Errorf("asked %q and stored %+v, want valid UTF-8", asked, pairs)
+			}
+		})
+	}
+}
+
+func TestRequireQuestionMark(t *testing.T) {
+	tests := []struct {
+		name       string
+		require    bool
+		question   string
+		wantStatus int
+	}{
+		{name: "question", require: true, question: "Will it rain?", wantStatus: http.StatusOK},
+		{name: "trailing whitespace", require: true, question: "Will it rain? \\n\\t", wantStatus: http.StatusOK},
+		{name: "statement", require: true, question: "It will rain", wantStatus: http.StatusBadRequest},
+		{name: "mark not at the end", require: true, question: "Rain? Tomorrow", wantStatus: http.StatusBadRequest},
+		{name: "statement when off", require: false, question: "It will rain", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen := &FakeGenerator{Answer: "YES"}
+			app := newTestApp(t, gen)
+			app.config.RequireQuestionMark = tt.require
+
+			rec := askJSON(app, `{"question":"`+tt.question+`"}`, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d, body %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusBadRequest {
+				var resp ErrorResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Error != "The spirits only answer questions." {
+					t.Errorf("error %q, want the themed message", resp.Error)
+				}
+				if len(gen.Questions()) != 0 {
+					t.Error("a statement reached the generator")
+				}
+			}
+		})
+	}
+}
+
+func TestAskSourceOfFallbackText(t *testing.T) {
+	// A model answer reading exactly like the fallback is still the model's
+	app := newTestApp(t, &FakeGenerator{Answer: fallbackAnswer})
+
+	rec := askJSON(app, `{"question":"Will it rain?"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	var resp AskResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Answer != fallbackAnswer || resp.Source != answerSourceModel {
+		t.Errorf("response %+v, want the fallback text tagged %q", resp, answerSourceModel)
+	}
+}
+
+func TestHistoryTruncated(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		handler  func(*App) http.HandlerFunc
+		wantLink string
+	}{
+		{
+			name:     "all history",
+			path:     "/history",
+			handler:  func(app *App) http.HandlerFunc { return app.historyHandler },
+			wantLink: `</history?before=4&limit=2>; rel="next"`,
+		},
+		{
+			name:     "by tag",
+			path:     "/history?tag=love",
+			handler:  func(app *App) http.HandlerFunc { return app.historyHandler },
+			wantLink: `</history?before=4&limit=2&tag=love>; rel="next"`,
+		},
+		{
+			name:     "by session",
+			path:     "/history/session",
+			handler:  func(app *App) http.HandlerFunc { return app.sessionHistoryHandler },
+			wantLink: `</history/session?before=4&limit=2>; rel="next"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+			app.config.GetAllMax = 2
+			session := app.sessions.Create()
+			for i := 1; i <= 5; i++ {
+				pair := QAPair{Question: fmt.Sprintf("Question %d?", i), Answer: "YES", Tags: []string{"love"}, SessionID: session.ID}
+				if err := app.storage.Add(context.Background(), pair); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// get fetches a page of history, returning its pair IDs
+			get := func(path string) ([]int64, *httptest.ResponseRecorder) {
+				t.Helper()
+				req := httptest.NewRequest(http.MethodGet, path, nil)
+				req.Header.Set(sessionHeaderName, session.ID)
+				rec := httptest.NewRecorder()
+				tt.handler(app)(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("GET %s: status %d, body %s", path, rec.Code, rec.Body)
+				}
+				var pairs []QAPair
+				if err := json.NewDecoder(rec.Body).Decode(&pairs); err != nil {
+					t.Fatal(err)
+				}
+				ids := make([]int64, 0, len(pairs))
+				for _, pair := range pairs {
+					ids = append(ids, pair.ID)
+				}
+				return ids, rec
+			}
+
+			ids, rec := get(tt.path)
+			if fmt.Sprint(ids) != "[4 5]" {
+				t.Errorf("first page %v, want the 2 most recent pairs", ids)
+			}
+			if got := rec.Header().Get("X-History-Truncated"); got != "true" {
+				t.Errorf("X-History-Truncated %q, want true", got)
+			}
+			link := rec.Header().Get("Link")
+			if link != tt.wantLink {
+				t.Fatalf("Link %q, want %q", link, tt.wantLink)
+			}
+
+			// Following the link fetches the page before
+			next := strings.TrimPrefix(strings.TrimSuffix(link, `>; rel="next"`), "<")
+			if ids, _ := get(next); fmt.Sprint(ids) != "[2 3]" {
+				t.Errorf("next page %v, want pairs 2 and 3", ids)
+			}
+		})
+	}
+}
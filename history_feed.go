@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// historyFeedBuffer is how many stored pairs may queue up for one
+// subscriber before it is considered too slow and dropped
+const historyFeedBuffer = 16
+
+// maxHistoryFeedInterval caps the batching interval a client may ask for,
+// bounding how many pairs a subscriber holds between batches
+const maxHistoryFeedInterval = time.Minute
+
+// historyFeed broadcasts newly stored pairs to live subscribers
+type historyFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan QAPair]struct{}
+}
+
+// newHistoryFeed creates a feed with no subscribers
+func newHistoryFeed() *historyFeed {
+	return &historyFeed{subscribers: make(map[chan QAPair]struct{})}
+}
+
+// subscribe returns a channel receiving every pair published from now on,
+// and a function to unsubscribe. The channel is closed when unsubscribing,
+// or early if the subscriber falls more than historyFeedBuffer pairs behind.
+func (f *historyFeed) subscribe() (<-chan QAPair, func()) {
+	ch := make(chan QAPair, historyFeedBuffer)
+
+	f.mu.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.mu.Unlock()
+
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.remove(ch)
+	}
+}
+
+// remove drops a subscriber, closing its channel once. Must be called with f.mu held.
+func (f *historyFeed) remove(ch chan QAPair) {
+	if _, ok := f.subscribers[ch]; ok {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish sends a pair to every subscriber without blocking, dropping
+// subscribers whose buffer is full so one slow client can't stall Add
+func (f *historyFeed) publish(pair QAPair) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.subscribers {
+		select {
+		case ch <- pair:
+		default:
+			f.remove(ch)
+		}
+	}
+}
+
+// historyPublisher is implemented by storage that publishes newly stored
+// pairs to a live feed
+type historyPublisher interface {
+	// Feed returns the live feed, or nil if there is none
+	Feed() *historyFeed
+}
+
+// historyStreamHandler streams every newly stored pair as a Server-Sent
+// "pair" event, to at most MAX_HISTORY_SUBSCRIBERS clients at once. With a
+// HISTORY_FEED_INTERVAL, or ?interval=, pairs are instead collected and sent
+// at most once per interval as a "pairs" event holding an array, so bursts
+// don't overwhelm slow displays. Clients that fall too far behind get a
+// "lagged" event and should reconnect and catch up from /history. During
+// shutdown a "shutdown" event asks the client to reconnect later.
+func (app *App) historyStreamHandler(w http.ResponseWriter, r *http.Request) {
+	var feed *historyFeed
+	if publisher, ok := app.storageFor(r.Context()).(historyPublisher); ok {
+		feed = publisher.Feed()
+	}
+	if feed == nil {
+		respondWithError(w, r, "This board has no live history", http.StatusNotFound)
+		return
+	}
+
+	interval := app.config.HistoryFeedInterval
+	if value := r.URL.Query().Get("interval"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 || parsed > maxHistoryFeedInterval {
+			respondWithError(w, r, "interval must be a duration from 0s to 1m, such as 2s", http.StatusBadRequest)
+			return
+		}
+		interval = parsed
+	}
+
+	// Every subscriber holds a buffer and a connection, so their number is
+	// capped across all namespaces
+	subscribers := app.historySubscribers.Add(1)
+	defer app.historySubscribers.Add(-1)
+	if limit := app.config.MaxHistorySubscribers; limit > 0 && subscribers > int64(limit) {
+		respondWithError(w, r, "Too many are already watching the spirits, return later", http.StatusServiceUnavailable)
+		return
+	}
+
+	done, ok := app.streams.track()
+	if !ok {
+		respondWithError(w, r, "The board is closing, ask again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+
+	pairs, unsubscribe := feed.subscribe()
+	defer unsubscribe()
+
+	stream := newSSEStream(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := stream.rc.Flush(); err != nil {
+		return
+	}
+
+	// Without an interval ticks stays nil and every pair is sent at once
+	var ticks <-chan time.Time
+	var batch []QAPair
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case pair, ok := <-pairs:
+			if !ok {
+				stream.send("lagged", ErrorResponse{Error: "Too far behind the spirits, reconnect to catch up"})
+				return
+			}
+			if ticks != nil {
+				batch = append(batch, pair)
+				continue
+			}
+			if err := stream.send("pair", pair); err != nil {
+				return
+			}
+		case <-ticks:
+			if len(batch) == 0 {
+				continue
+			}
+			if err := stream.send("pairs", batch); err != nil {
+				return
+			}
+			batch = nil
+		case <-app.streams.draining:
+			// Pairs already collected still reach the client
+			if len(batch) > 0 {
+				stream.send("pairs", batch)
+			}
+			stream.send("shutdown", ErrorResponse{Error: "The board is closing, reconnect shortly"})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
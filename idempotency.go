@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// responseEntry holds a generated answer, or a pending generation, for a key
+type responseEntry struct {
+	// fingerprint identifies the request the key was first used with, so
+	// the key can't be replayed for a different question
+	fingerprint string
+	response    AskResponse
+	done        chan struct{}
+	expires     time.Time
+}
+
+// responseStore is a short-lived keyed store of /ask responses. Keys are either
+// server-generated request IDs or client-supplied idempotency keys; both share
+// the same store so a retry with either returns the original answer.
+type responseStore struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	entries   map[string]*responseEntry
+	lastSweep time.Time
+	// now is the time source, replaceable so expiry can be tested without sleeping
+	now func() time.Time
+}
+
+// newResponseStore creates a new response store
+func newResponseStore(ttl time.Duration) *responseStore {
+	return &responseStore{
+		ttl:     ttl,
+		entries: make(map[string]*responseEntry),
+		now:     time.Now,
+	}
+}
+
+// begin reserves key for a new generation of the request with the given
+// fingerprint. If the key is already known, the existing entry is returned
+// with reserved set to false and the caller should wait on it instead of
+// generating again, after checking it was made for the same request.
+func (s *responseStore) begin(key, fingerprint string) (entry *responseEntry, reserved bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Sweep at most once per TTL, so a busy store isn't scanned on every
+	// request; an expired entry found before then is treated as gone
+	now := s.now()
+	if now.Sub(s.lastSweep) >= s.ttl {
+		s.sweep(now)
+		s.lastSweep = now
+	}
+
+	if entry, exists := s.entries[key]; exists && !entry.expired(now) {
+		return entry, false
+	}
+
+	entry = &responseEntry{
+		fingerprint: fingerprint,
+		done:        make(chan struct{}),
+		expires:     now.Add(s.ttl),
+	}
+	s.entries[key] = entry
+	return entry, true
+}
+
+// complete records the response for a reserved key and wakes any waiters
+func (s *responseStore) complete(key string, response AskResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, exists := s.entries[key]; exists {
+		entry.response = response
+		entry.expires = s.now().Add(s.ttl)
+		close(entry.done)
+	}
+}
+
+// abort releases a reserved key without a response so a retry can try again
+func (s *responseStore) abort(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, exists := s.entries[key]; exists {
+		delete(s.entries, key)
+		close(entry.done)
+	}
+}
+
+// wait blocks until the entry has completed or the context is cancelled.
+// It returns false if the generation was aborted or the context ended first.
+func (e *responseEntry) wait(ctx context.Context) (AskResponse, bool) {
+	select {
+	case <-e.done:
+		return e.response, e.response.RequestID != ""
+	case <-ctx.Done():
+		return AskResponse{}, false
+	}
+}
+
+// sweep removes expired, completed entries. Must be called with s.mu held.
+func (s *responseStore) sweep(now time.Time) {
+	for key, entry := range s.entries {
+		if entry.expired(now) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// expired reports whether the entry has completed and outlived its TTL.
+// Entries still generating never expire.
+func (e *responseEntry) expired(now time.Time) bool {
+	select {
+	case <-e.done:
+		return now.After(e.expires)
+	default:
+		return false
+	}
+}
+
+// matches reports whether the entry was made for the request with the given
+// fingerprint
+func (e *responseEntry) matches(fingerprint string) bool {
+	return subtle.ConstantTimeCompare([]byte(e.fingerprint), []byte(fingerprint)) == 1
+}
+
+// requestFingerprint hashes what a request asks for, so a reused
+// idempotency key can be told apart from a genuine retry. The question is
+// normalized first, so a retry that only respells it still matches.
+func requestFingerprint(req AskRequest, normalizer *questionNormalizer) string {
+	req.Question = normalizer.normalizeQuestion(req.Question)
+	body, _ := json.Marshal(req)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyScope keys idempotency entries by the client that made them,
+// so nobody can collect another client's answer by guessing or reusing its
+// key. Sessions rotate with cookies, so the client address is used.
+func (app *App) idempotencyScope(r *http.Request) string {
+	if app.resolver == nil {
+		return r.RemoteAddr
+	}
+	return app.resolver.clientIP(r).String()
+}
+
+// newRequestID returns a random hex-encoded request identifier
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand failing is not recoverable in any meaningful way
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validIdempotencyKey reports whether a client-supplied key is acceptable
+func validIdempotencyKey(key string) bool {
+	if len(key) == 0 || len(key) > 128 {
+		return false
+	}
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
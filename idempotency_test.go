@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestResponseStore creates a responseStore driven by a fake clock
+func newTestResponseStore(ttl time.Duration) (*responseStore, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newResponseStore(ttl)
+	s.now = clock.Now
+	return s, clock
+}
+
+func TestResponseStoreSweepInterval(t *testing.T) {
+	s, clock := newTestResponseStore(time.Minute)
+	s.begin("first", "fingerprint")
+
+	clock.advance(time.Second)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		s.begin(key, "fingerprint")
+		s.complete(key, AskResponse{RequestID: key})
+	}
+
+	// Swept just before the answers expire, then they expire
+	clock.advance(59 * time.Second)
+	s.begin("fresh", "fingerprint")
+	clock.advance(2 * time.Second)
+	s.begin("fresher", "fingerprint")
+	if got := len(s.entries); got != 13 {
+		t.Fatalf("%d entries before the next sweep, want 13", got)
+	}
+
+	// An expired entry found before it is swept is treated as gone
+	if _, reserved := s.begin("key-0", "fingerprint"); !reserved {
+		t.Error("expired key was not reserved again")
+	}
+
+	clock.advance(time.Minute)
+	s.begin("last", "fingerprint")
+	// Only entries still generating survive the sweep
+	if got := len(s.entries); got != 5 {
+		t.Errorf("%d entries after the sweep, want 5", got)
+	}
+}
@@ -2,52 +2,294 @@ package main
 
 import (
 	"context"
+	"flag"
+	"html/template"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"syscall"
+	"regexp"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	selfTest := flag.Bool("selftest", false, "ask one canned question, then exit 0 if it was answered or 1 if not")
+	flag.Parse()
+
 	// Load configuration
 	config := LoadConfig()
 
 	// Initialize storage
-	storage := NewMemoryStorage(config.MaxHistorySize)
+	storage := NewMemoryStorage(config.MaxHistorySize, config.HistoryTTL)
 	defer storage.Close()
 
-	// Initialize Ollama client
-	ollamaClient := NewOllamaClient(config.OllamaURL, config.OllamaModel, config.OllamaTimeout, config.MaxTokens)
+	// Give each themed board its own history, capped, metered and
+	// snapshotted like the default one
+	namespaceHistories := make(map[string]*MemoryStorage)
+	namespaces, err := newNamespaceStore(config.Namespaces, config.MaxNamespaces, func(name string) Storage {
+		history := NewMemoryStorage(config.MaxHistorySize, config.HistoryTTL)
+		namespaceHistories[name] = history
+		return NewMeteredStorage(history, "memory")
+	})
+	if err != nil {
+		log.Fatalf("Invalid NAMESPACES: %v", err)
+	}
+	defer namespaces.Close()
+
+	// Initialize the answer generator
+	var generator AnswerGenerator
+	var models *modelWatcher
+	switch config.Backend {
+	case "ollama":
+		ollamaClient, err := NewOllamaClient(config)
+		if err != nil {
+			log.Fatalf("Failed to initialize Ollama client: %v", err)
+		}
+		generator = ollamaClient
+		if config.DryRun {
+			log.Println("DRY_RUN is on, prompts are logged and Ollama is never called")
+			break
+		}
+
+		// Watch model availability for the readiness probe
+		models, err = newModelWatcher(config.OllamaURL, config.OllamaModel, config.ModelWatchInterval, config.OllamaTimeout)
+		if err != nil {
+			log.Fatalf("Failed to initialize model watcher: %v", err)
+		}
+		models.Start()
+		defer models.Stop()
+	case "proxy":
+		proxy, err := NewProxyGenerator(config.UpstreamURL, config.UpstreamTimeout, config.UpstreamRetries)
+		if err != nil {
+			log.Fatalf("Failed to initialize proxy backend: %v", err)
+		}
+		log.Printf("Forwarding questions to the board at %s", config.UpstreamURL)
+		generator = proxy
+	case "fake":
+		log.Printf("Using the fake backend, every answer is %q", config.FakeAnswer)
+		generator = &FakeGenerator{Answer: config.FakeAnswer, Delay: config.FakeDelay}
+	default:
+		log.Fatalf("Unknown BACKEND %q, expected ollama, proxy or fake", config.Backend)
+	}
 
 	// Initialize application
 	app := &App{
-		config:  config,
-		storage: storage,
-		ollama:  ollamaClient,
+		config:     config,
+		storage:    NewMeteredStorage(storage, "memory"),
+		generator:  generator,
+		responses:  newResponseStore(config.IdempotencyTTL),
+		sessions:   newSessionStore(config.MaxSessions, config.SessionIdleTimeout),
+		models:     models,
+		streams:    newStreamTracker(),
+		seances:    newSeanceHub(),
+		costs:      newCostMeter(config.CostPerToken),
+		namespaces: namespaces,
+		rng:        newLockedRand(config.FallbackSeed),
+		callbacks:  newCallbackSender(config.CallbackAllowedHosts, config.CallbackRetries, config.CallbackTimeout),
+	}
+
+	if !validStoreQuestionMode(config.StoreQuestionMode) {
+		log.Fatalf("Invalid STORE_QUESTION_MODE %q, expected full, hashed or none", config.StoreQuestionMode)
+	}
+
+	if config.InvalidUTF8 != invalidUTF8Replace && config.InvalidUTF8 != invalidUTF8Reject {
+		log.Fatalf("Invalid INVALID_UTF8 %q, expected replace or reject", config.InvalidUTF8)
+	}
+
+	if _, ok := themes[config.BoardTheme]; !ok {
+		log.Fatalf("Unknown BOARD_THEME %q, expected one of %v", config.BoardTheme, themeNames())
+	}
+
+	// Load user-facing messages
+	messages, err := loadMessages(config.MessagesFile)
+	if err != nil {
+		log.Fatalf("Failed to load messages: %v", err)
+	}
+	app.messages.Store(&messages)
+
+	if config.StreamResumeWindow > 0 {
+		app.resumes = newResumeStore(config.StreamResumeWindow)
+	}
+
+	if config.MaxConcurrentGenerations > 0 {
+		app.generations = newGenerationLimiter(config.MaxConcurrentGenerations, config.GenerationQueueSize, config.GenerationQueueTimeout)
+	}
+
+	// Parse the index template once at startup so a missing file fails fast
+	assets := loadAssets(config.AssetsDir)
+	indexTemplate, err := template.ParseFS(assets, "templates/index.html")
+	if err != nil {
+		log.Fatalf("Failed to parse index template: %v", err)
+	}
+	app.indexTemplate = indexTemplate
+
+	staticFiles, err := fs.Sub(assets, "static")
+	if err != nil {
+		log.Fatalf("Failed to open static assets: %v", err)
+	}
+
+	tagger, err := newTagClassifier(config.TagKeywords)
+	if err != nil {
+		log.Fatalf("Invalid TAG_KEYWORDS: %v", err)
+	}
+	app.tagger = tagger
+
+	normalizer, err := newQuestionNormalizer(config.QuestionNormalization)
+	if err != nil {
+		log.Fatalf("Invalid QUESTION_NORMALIZATION: %v", err)
+	}
+	app.normalizer = normalizer
+
+	// Compile the optional question allowlist
+	if config.QuestionPattern != "" {
+		pattern, err := regexp.Compile(config.QuestionPattern)
+		if err != nil {
+			log.Fatalf("Invalid QUESTION_ALLOWED_PATTERN: %v", err)
+		}
+		app.questionPattern = pattern
+	}
+
+	// Parse proxy and rate limit exemption ranges
+	trustedProxies, err := parseIPRanges(config.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+	rateLimitExempt, err := parseIPRanges(config.RateLimitExemptIPs)
+	if err != nil {
+		log.Fatalf("Invalid RATE_LIMIT_EXEMPT_IPS: %v", err)
+	}
+	resolver := &ipResolver{trustedProxies: trustedProxies}
+	app.resolver = resolver
+	if !validRateLimitAlgorithm(config.RateLimitAlgorithm) {
+		log.Fatalf("Invalid RATE_LIMIT_ALGORITHM %q, expected tokenbucket or slidingwindow", config.RateLimitAlgorithm)
+	}
+
+	accessLog, err := newAccessLogFormat(config.AccessLogFormat)
+	if err != nil {
+		log.Fatalf("Invalid ACCESS_LOG_FORMAT: %v", err)
+	}
+
+	// Smoke-test the generation path instead of serving
+	if *selfTest || config.SelfTest {
+		answer, err := runSelfTest(generator)
+		if err != nil {
+			log.Printf("Self-test failed: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Self-test passed, the spirits answered %q", answer)
+		os.Exit(0)
 	}
 
 	// Setup router
 	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
 
-	// Apply middleware
-	router.Use(loggingMiddleware)
-	router.Use(rateLimitMiddleware(config.RateLimit))
+	// Apply middleware, outermost first:
+	// recover → request-id → logging → headers → rate-limit → body-limit →
+	// namespace → handler.
+	// Rate limiting runs before anything touches the body, so a throttled
+	// client never has its request body read.
+	router.Use(recoverMiddleware)
+	router.Use(requestIDMiddleware)
+	router.Use(loggingMiddleware(config.AnonymizeIPs, newLogSampler(config.LogSampleRate, config.LogSlowThreshold), accessLog))
 	router.Use(securityHeadersMiddleware)
+	router.Use(prettyJSONMiddleware(config.PrettyJSON))
+	router.Use(rateLimitMiddleware(config.RateLimit, config.RateLimitAlgorithm, resolver, rateLimitExempt))
+	router.Use(bodyLimitMiddleware(config.MaxBodyBytes))
+	router.Use(namespaceMiddleware(namespaces))
 
-	// Register routes
+	// Register routes. Every route that asks the spirits waits for startup
+	// to finish, is shed under memory pressure and shares the
+	// REQUEST_TIMEOUT budget.
+	withDeadline := requestTimeoutMiddleware(config.RequestTimeout)
+	startupGate := startupGateMiddleware(&app.started)
+	memoryShed := func(next http.Handler) http.Handler { return next }
+	if config.MemoryShedHeapMB > 0 {
+		guard := newMemoryGuard(uint64(config.MemoryShedHeapMB)<<20, config.MemorySampleInterval)
+		guard.Start()
+		defer guard.Stop()
+		memoryShed = memoryShedMiddleware(guard)
+	}
+	asking := func(handler http.HandlerFunc) http.Handler {
+		return startupGate(memoryShed(withDeadline(handler)))
+	}
+	askHandler := asking(app.askHandler)
 	router.HandleFunc("/", app.indexHandler).Methods("GET")
-	router.HandleFunc("/ask", app.askHandler).Methods("POST")
-	router.HandleFunc("/history", app.historyHandler).Methods("GET")
-	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	router.Handle("/ask", askHandler).Methods("POST")
+	if config.EnableGetAsk {
+		router.Handle("/ask", askHandler).Methods("GET")
+	}
+	streamHandler := asking(app.askStreamHandler)
+	ndjsonHandler := asking(app.askNDJSONHandler)
+	historyStreamHandler := http.Handler(http.HandlerFunc(app.historyStreamHandler))
+	seanceHandler := http.Handler(http.HandlerFunc(app.seanceHandler))
+	if config.MaxConnPerIP > 0 {
+		// All streaming endpoints share one per-IP budget
+		connLimit := connLimitMiddleware(config.MaxConnPerIP, resolver)
+		streamHandler = connLimit(streamHandler)
+		ndjsonHandler = connLimit(ndjsonHandler)
+		historyStreamHandler = connLimit(historyStreamHandler)
+		seanceHandler = connLimit(seanceHandler)
+	}
+	router.Handle("/ask/stream", streamHandler).Methods("POST")
+	router.Handle("/ask/ndjson", ndjsonHandler).Methods("POST")
+	if config.EnableGetAsk || config.StreamResumeWindow > 0 {
+		// EventSource can only GET, and resends Last-Event-ID itself, so
+		// resumable streams are served over GET even without ENABLE_GET_ASK
+		router.Handle("/ask/stream", streamHandler).Methods("GET")
+	}
+	if config.EnableGetAsk {
+		router.Handle("/ask/ndjson", ndjsonHandler).Methods("GET")
+	}
+	if config.EnableStructuredAnswers {
+		router.Handle("/ask/structured", asking(app.askStructuredHandler)).Methods("POST")
+	}
+	router.Handle("/session/stream", seanceHandler).Methods("GET")
+	router.HandleFunc("/history/session", app.sessionHistoryHandler).Methods("GET")
+	if config.DisableGlobalHistory {
+		// Replays reveal any stored question by ID, so they go with /history
+		log.Println("Global history disabled: /history, /history/stream and /history/{id}/replay are not served")
+	} else {
+		router.HandleFunc("/history", app.historyHandler).Methods("GET")
+		router.Handle("/history/stream", historyStreamHandler).Methods("GET")
+		if config.StoreQuestionMode == "full" {
+			router.Handle("/history/{id:[0-9]+}/replay", asking(app.replayHandler)).Methods("POST")
+		} else {
+			// There is no question left to ask again
+			log.Printf("STORE_QUESTION_MODE is %s: /history/{id}/replay is not served", config.StoreQuestionMode)
+		}
+	}
+	router.HandleFunc("/stats", app.statsHandler).Methods("GET")
+	router.HandleFunc("/metrics", app.metricsHandler).Methods("GET")
+	router.HandleFunc("/metrics.json", app.metricsJSONHandler).Methods("GET")
+	router.HandleFunc("/ready", app.readyHandler).Methods("GET")
+	router.HandleFunc("/health", app.healthHandler).Methods("GET")
+	router.HandleFunc("/theme", app.themeHandler).Methods("GET")
+	router.HandleFunc("/fallbacks", app.fallbacksHandler).Methods("GET")
+	if config.AdminToken != "" {
+		router.HandleFunc("/admin/reload", app.adminReloadHandler).Methods("POST")
+	}
+	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.FS(staticFiles))))
+
+	// CORS wraps the router so preflight requests, which match no route,
+	// are answered too
+	handler := http.Handler(router)
+	if len(config.CORSAllowedOrigins) > 0 {
+		policy, err := newCORSPolicy(config.CORSAllowedOrigins, config.CORSAllowCredentials, config.CORSExposeHeaders)
+		if err != nil {
+			log.Fatalf("Invalid CORS configuration: %v", err)
+		}
+		handler = corsMiddleware(policy)(handler)
+	}
 
 	// Create server
 	srv := &http.Server{
 		Addr:         config.ServerAddr,
-		Handler:      router,
+		Handler:      handler,
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -61,11 +303,52 @@ func main() {
 		}
 	}()
 
-	// Wait for interrupt signal to gracefully shutdown the server
+	// Catch signals from here on, so one arriving during startup still
+	// shuts down gracefully once startup is over
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down server...")
+	signal.Notify(quit, shutdownSignals...)
+
+	// Restore history from the last snapshot and keep saving it periodically
+	if config.SnapshotInterval > 0 {
+		if err := storage.LoadSnapshot(config.SnapshotPath); err != nil {
+			log.Printf("Error loading history snapshot: %v", err)
+		}
+		snap := newSnapshotter(storage, config.SnapshotPath, config.SnapshotInterval)
+		snap.Start()
+		defer snap.Stop()
+
+		for name, history := range namespaceHistories {
+			path := namespaceSnapshotPath(config.SnapshotPath, name)
+			if err := history.LoadSnapshot(path); err != nil {
+				log.Printf("Error loading %s history snapshot: %v", name, err)
+			}
+			snap := newSnapshotter(history, path, config.SnapshotInterval)
+			snap.Start()
+			defer snap.Stop()
+		}
+	}
+
+	// Load the model before the first question rather than during it
+	if w, ok := generator.(warmer); ok && config.WarmupModel {
+		start := time.Now()
+		if err := w.Warmup(context.Background()); err != nil {
+			log.Printf("Error warming up the model: %v", err)
+		} else {
+			log.Printf("Model warmed up in %v", time.Since(start))
+		}
+	}
+
+	// Open the gate for questions
+	app.started.Store(true)
+	log.Println("The board is awake")
+
+	// Wait for interrupt signal to gracefully shutdown the server
+	sig := <-quit
+	log.Printf("Received %v, shutting down server...", sig)
+
+	// Ask streaming clients to reconnect and give them a moment to finish
+	app.streams.Drain(config.StreamDrainGrace)
+	app.callbacks.Wait(config.StreamDrainGrace)
 
 	// Graceful shutdown with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryGuard periodically samples the heap and reports when it is over a
+// limit, so questions can be shed before the board runs out of memory.
+// runtime.ReadMemStats briefly stops the world, so it is read in the
+// background rather than on every request.
+type memoryGuard struct {
+	limit    uint64
+	interval time.Duration
+	heap     atomic.Uint64
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newMemoryGuard creates a guard for a heap limit of limitBytes, sampled
+// every interval
+func newMemoryGuard(limitBytes uint64, interval time.Duration) *memoryGuard {
+	return &memoryGuard{
+		limit:    limitBytes,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start samples the heap immediately and then on every interval
+func (g *memoryGuard) Start() {
+	g.sample()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				g.sample()
+			case <-g.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops sampling and waits for the sampler to exit
+func (g *memoryGuard) Stop() {
+	close(g.stop)
+	g.wg.Wait()
+}
+
+// sample reads the heap size, logging when it crosses the limit
+func (g *memoryGuard) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	previous := g.heap.Swap(stats.HeapAlloc)
+	if over := stats.HeapAlloc > g.limit; over != (previous > g.limit) {
+		if over {
+			log.Printf("Heap of %d MB is over MEMORY_SHED_HEAP_MB, shedding questions", stats.HeapAlloc>>20)
+		} else {
+			log.Printf("Heap of %d MB is back under MEMORY_SHED_HEAP_MB, accepting questions", stats.HeapAlloc>>20)
+		}
+	}
+}
+
+// overLimit reports whether the heap was over the limit at the last sample
+func (g *memoryGuard) overLimit() bool {
+	return g.heap.Load() > g.limit
+}
+
+// memoryShedMiddleware answers 503 while guard reports the heap over its
+// limit. It only wraps question endpoints, so health checks and the rest of
+// the board stay responsive.
+func memoryShedMiddleware(guard *memoryGuard) func(http.Handler) http.Handler {
+	retryAfter := strconv.Itoa(int(math.Ceil(guard.interval.Seconds())))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if guard.overLimit() {
+				w.Header().Set("Retry-After", retryAfter)
+				respondWithError(w, r, "The spirits are overburdened, ask again shortly", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
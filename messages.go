@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxQuestionLength is the longest question accepted, in bytes
+const maxQuestionLength = 1000
+
+// Messages holds user-facing messages so they can be themed in one place.
+// Any message may be overridden from a JSON file via MESSAGES_FILE.
+type Messages struct {
+	// QuestionTooLong may contain {limit}, replaced by the maximum length
+	QuestionTooLong string `json:"question_too_long"`
+	QuestionEmpty   string `json:"question_empty"`
+	// NotAQuestion is given under REQUIRE_QUESTION_MARK for statements
+	NotAQuestion string `json:"not_a_question"`
+	// PromptTooLarge is given when the prompt exceeds MAX_PROMPT_TOKENS
+	PromptTooLarge string `json:"prompt_too_large"`
+	// InvalidUTF8 is given when INVALID_UTF8=reject turns a question away
+	InvalidUTF8 string `json:"invalid_utf8"`
+	// DisallowedCharacters is given for questions not matching
+	// QUESTION_ALLOWED_PATTERN
+	DisallowedCharacters string `json:"disallowed_characters"`
+	// Request decoding errors; UnknownField and WrongFieldType may contain
+	// {field}, replaced by the offending field's name
+	MalformedJSON  string `json:"malformed_json"`
+	UnknownField   string `json:"unknown_field"`
+	WrongFieldType string `json:"wrong_field_type"`
+	EmptyBody      string `json:"empty_body"`
+	TrailingData   string `json:"trailing_data"`
+	InvalidRequest string `json:"invalid_request"`
+}
+
+// defaultMessages returns the built-in messages
+func defaultMessages() Messages {
+	return Messages{
+		QuestionTooLong:      "The spirits cannot hold such a long thought (max {limit} characters).",
+		QuestionEmpty:        "The spirits cannot hear a silent question.",
+		NotAQuestion:         "The spirits only answer questions.",
+		PromptTooLarge:       "The spirits cannot take in so much at once, ask something shorter.",
+		InvalidUTF8:          "The spirits cannot read that writing (invalid UTF-8)",
+		DisallowedCharacters: "The spirits do not recognize those symbols",
+		MalformedJSON:        "The spirits cannot read these garbled runes (malformed JSON).",
+		UnknownField:         "The spirits do not know the field {field}.",
+		WrongFieldType:       "The spirits expected something else in the field {field}.",
+		EmptyBody:            "The spirits received an empty message.",
+		TrailingData:         "The spirits found more than one message (trailing data after the JSON object).",
+		InvalidRequest:       "Invalid request format",
+	}
+}
+
+// loadMessages returns the built-in messages overlaid with any set in the
+// JSON file at path. An empty path uses the defaults.
+func loadMessages(path string) (Messages, error) {
+	messages := defaultMessages()
+	if path == "" {
+		return messages, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Messages{}, fmt.Errorf("failed to read messages file: %w", err)
+	}
+
+	overrides := defaultMessages()
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return Messages{}, fmt.Errorf("failed to parse messages file: %w", err)
+	}
+
+	// Ignore blank overrides so a partial file can't erase a message
+	if strings.TrimSpace(overrides.QuestionTooLong) != "" {
+		messages.QuestionTooLong = overrides.QuestionTooLong
+	}
+	if strings.TrimSpace(overrides.QuestionEmpty) != "" {
+		messages.QuestionEmpty = overrides.QuestionEmpty
+	}
+	if strings.TrimSpace(overrides.NotAQuestion) != "" {
+		messages.NotAQuestion = overrides.NotAQuestion
+	}
+	if strings.TrimSpace(overrides.PromptTooLarge) != "" {
+		messages.PromptTooLarge = overrides.PromptTooLarge
+	}
+	if strings.TrimSpace(overrides.InvalidUTF8) != "" {
+		messages.InvalidUTF8 = overrides.InvalidUTF8
+	}
+	if strings.TrimSpace(overrides.DisallowedCharacters) != "" {
+		messages.DisallowedCharacters = overrides.DisallowedCharacters
+	}
+	if strings.TrimSpace(overrides.MalformedJSON) != "" {
+		messages.MalformedJSON = overrides.MalformedJSON
+	}
+	if strings.TrimSpace(overrides.UnknownField) != "" {
+		messages.UnknownField = overrides.UnknownField
+	}
+	if strings.TrimSpace(overrides.WrongFieldType) != "" {
+		messages.WrongFieldType = overrides.WrongFieldType
+	}
+	if strings.TrimSpace(overrides.EmptyBody) != "" {
+		messages.EmptyBody = overrides.EmptyBody
+	}
+	if strings.TrimSpace(overrides.TrailingData) != "" {
+		messages.TrailingData = overrides.TrailingData
+	}
+	if strings.TrimSpace(overrides.InvalidRequest) != "" {
+		messages.InvalidRequest = overrides.InvalidRequest
+	}
+
+	return messages, nil
+}
+
+// questionTooLong returns the too-long message with the limit filled in
+func (m Messages) questionTooLong(limit int) string {
+	return strings.ReplaceAll(m.QuestionTooLong, "{limit}", strconv.Itoa(limit))
+}
+
+// decodeError returns the message describing why a request body could not
+// be decoded, telling syntax errors, unknown fields and type mismatches apart
+func (m Messages) decodeError(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return m.EmptyBody
+	case errors.Is(err, errTrailingData):
+		return m.TrailingData
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return m.MalformedJSON
+	case errors.As(err, &typeErr):
+		return strings.ReplaceAll(m.WrongFieldType, "{field}", strconv.Quote(typeErr.Field))
+	}
+
+	// DisallowUnknownFields reports unknown fields with a plain error
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return strings.ReplaceAll(m.UnknownField, "{field}", field)
+	}
+
+	return m.InvalidRequest
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMessagesOverrides(t *testing.T) {
+	defaults := defaultMessages()
+
+	tests := []struct {
+		name string
+		file string
+		got  func(Messages) string
+		want string
+	}{
+		{
+			name: "prompt too large",
+			file: `{"prompt_too_large": "Too much, mortal."}`,
+			got:  func(m Messages) string { return m.PromptTooLarge },
+			want: "Too much, mortal.",
+		},
+		{
+			name: "invalid UTF-8",
+			file: `{"invalid_utf8": "Those runes are broken."}`,
+			got:  func(m Messages) string { return m.InvalidUTF8 },
+			want: "Those runes are broken.",
+		},
+		{
+			name: "disallowed characters",
+			file: `{"disallowed_characters": "The board has no such letters."}`,
+			got:  func(m Messages) string { return m.DisallowedCharacters },
+			want: "The board has no such letters.",
+		},
+		{
+			name: "blank override keeps the default",
+			file: `{"prompt_too_large": "  "}`,
+			got:  func(m Messages) string { return m.PromptTooLarge },
+			want: defaults.PromptTooLarge,
+		},
+		{
+			name: "unset message keeps the default",
+			file: `{"question_empty": "Speak up."}`,
+			got:  func(m Messages) string { return m.PromptTooLarge },
+			want: defaults.PromptTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "messages.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			messages, err := loadMessages(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.got(messages); got != tt.want {
+				t.Errorf("message %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWindowSize is how many recent calls latency percentiles are computed over
+const latencyWindowSize = 1024
+
+// LatencyStats summarizes recent call latencies for one storage operation
+type LatencyStats struct {
+	Count int64   `json:"count"`
+	P50Ms float64 `json:"p50_ms"`
+	P99Ms float64 `json:"p99_ms"`
+}
+
+// StorageStats describes the storage backend's recent latency
+type StorageStats struct {
+	Backend    string                  `json:"backend"`
+	Operations map[string]LatencyStats `json:"operations"`
+}
+
+// storageBuckets are the upper bounds, in seconds, of the storage latency
+// histogram, from an in-memory call to a struggling remote backend
+var storageBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// HistogramBucket is the number of observations at or below LE seconds
+type HistogramBucket struct {
+	LE    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+// HistogramStats is a latency histogram with cumulative buckets. Count
+// includes observations over the last bucket.
+type HistogramStats struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Sum     float64           `json:"sum"`
+	Count   int64             `json:"count"`
+}
+
+// durationHistogram counts every call's latency into storageBuckets, unlike
+// latencyWindow's recent samples, so Prometheus can aggregate it over time
+type durationHistogram struct {
+	counts []int64 // per bucket, not cumulative
+	sum    time.Duration
+	count  int64
+}
+
+// observe records one call's latency
+func (h *durationHistogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(storageBuckets))
+	}
+	if i := sort.SearchFloat64s(storageBuckets, d.Seconds()); i < len(storageBuckets) {
+		h.counts[i]++
+	}
+	h.sum += d
+	h.count++
+}
+
+// stats returns the histogram with cumulative buckets
+func (h *durationHistogram) stats() HistogramStats {
+	stats := HistogramStats{Buckets: make([]HistogramBucket, len(storageBuckets)), Sum: h.sum.Seconds(), Count: h.count}
+	var cumulative int64
+	for i, le := range storageBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		stats.Buckets[i] = HistogramBucket{LE: le, Count: cumulative}
+	}
+	return stats
+}
+
+// latencyWindow keeps the most recent latencies of an operation in a ring buffer
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	count   int64
+}
+
+// observe records one call's latency
+func (lw *latencyWindow) observe(d time.Duration) {
+	if len(lw.samples) < latencyWindowSize {
+		lw.samples = append(lw.samples, d)
+	} else {
+		lw.samples[lw.next] = d
+		lw.next = (lw.next + 1) % latencyWindowSize
+	}
+	lw.count++
+}
+
+// stats returns the call count and recent percentiles
+func (lw *latencyWindow) stats() LatencyStats {
+	sorted := make([]time.Duration, len(lw.samples))
+	copy(sorted, lw.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return LatencyStats{
+		Count: lw.count,
+		P50Ms: percentileMs(sorted, 0.50),
+		P99Ms: percentileMs(sorted, 0.99),
+	}
+}
+
+// percentileMs returns the p-th percentile of sorted latencies in milliseconds
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// storageOp is the timing kept for one storage operation
+type storageOp struct {
+	recent    latencyWindow
+	histogram durationHistogram
+}
+
+// MeteredStorage wraps any Storage and times its calls, so slow backends
+// show up in /stats and /metrics without instrumenting each implementation
+type MeteredStorage struct {
+	Storage
+	backend string
+	mu      sync.Mutex
+	ops     map[string]*storageOp
+}
+
+// NewMeteredStorage wraps storage, labelling its stats with backend
+func NewMeteredStorage(storage Storage, backend string) *MeteredStorage {
+	return &MeteredStorage{
+		Storage: storage,
+		backend: backend,
+		ops:     make(map[string]*storageOp),
+	}
+}
+
+// observe records the latency of an operation that started at start
+func (m *MeteredStorage) observe(op string, start time.Time) {
+	elapsed := time.Since(start)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	timing, exists := m.ops[op]
+	if !exists {
+		timing = &storageOp{}
+		m.ops[op] = timing
+	}
+	timing.recent.observe(elapsed)
+	timing.histogram.observe(elapsed)
+}
+
+// Add stores a pair, timing the call
+func (m *MeteredStorage) Add(ctx context.Context, pair QAPair) error {
+	defer m.observe("add", time.Now())
+	return m.Storage.Add(ctx, pair)
+}
+
+// Get returns a pair by ID, timing the call
+func (m *MeteredStorage) Get(id int64) (QAPair, error) {
+	defer m.observe("get", time.Now())
+	return m.Storage.Get(id)
+}
+
+// GetAll returns all pairs, timing the call
+func (m *MeteredStorage) GetAll() ([]QAPair, error) {
+	defer m.observe("get_all", time.Now())
+	return m.Storage.GetAll()
+}
+
+// GetBySession returns a session's pairs, timing the call
+func (m *MeteredStorage) GetBySession(sessionID string) ([]QAPair, error) {
+	defer m.observe("get_by_session", time.Now())
+	return m.Storage.GetBySession(sessionID)
+}
+
+// GetByTag returns a tag's pairs, timing the call
+func (m *MeteredStorage) GetByTag(tag string) ([]QAPair, error) {
+	defer m.observe("get_by_tag", time.Now())
+	return m.Storage.GetByTag(tag)
+}
+
+// Feed returns the wrapped storage's live feed, if it has one
+func (m *MeteredStorage) Feed() *historyFeed {
+	if publisher, ok := m.Storage.(historyPublisher); ok {
+		return publisher.Feed()
+	}
+	return nil
+}
+
+// HistorySize returns the wrapped storage's size and capacity, if it reports them
+func (m *MeteredStorage) HistorySize() (pairs, maxPairs int, ok bool) {
+	if reporter, ok := m.Storage.(sizeReporter); ok {
+		return reporter.HistorySize()
+	}
+	return 0, 0, false
+}
+
+// Stats returns recent latency per operation
+func (m *MeteredStorage) Stats() StorageStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := StorageStats{Backend: m.backend, Operations: make(map[string]LatencyStats, len(m.ops))}
+	for op, timing := range m.ops {
+		stats.Operations[op] = timing.recent.stats()
+	}
+	return stats
+}
+
+// Histograms returns the latency histogram of each operation since startup
+func (m *MeteredStorage) Histograms() map[string]HistogramStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	histograms := make(map[string]HistogramStats, len(m.ops))
+	for op, timing := range m.ops {
+		histograms[op] = timing.histogram.stats()
+	}
+	return histograms
+}
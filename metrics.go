@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sizeReporter is implemented by storages that know how many pairs they
+// hold and how many they may hold
+type sizeReporter interface {
+	HistorySize() (pairs, maxPairs int, ok bool)
+}
+
+// generationMetrics counts questions put to the generator, how many failed
+// and how long they took
+type generationMetrics struct {
+	questions atomic.Int64
+	errors    atomic.Int64
+	fallbacks atomic.Int64
+	mu        sync.Mutex
+	latency   latencyWindow
+	total     time.Duration
+}
+
+// observe records one generation. Errors that get a fallback answer count
+// both as errors and as fallbacks, judged by the error rather than the
+// answer text; clients too slow to stream to don't count.
+func (g *generationMetrics) observe(elapsed time.Duration, err error) {
+	g.questions.Add(1)
+	if err != nil && !errors.Is(err, errSlowClient) {
+		g.errors.Add(1)
+	}
+	if _, ok := fallbackFor(err); ok {
+		g.fallbacks.Add(1)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.latency.observe(elapsed)
+	g.total += elapsed
+}
+
+// GenerationMetrics describes the generations since startup
+type GenerationMetrics struct {
+	Questions int64 `json:"questions"`
+	Errors    int64 `json:"errors"`
+	Fallbacks int64 `json:"fallbacks"`
+	// Slow counts generations over SLOW_GENERATION_THRESHOLD, when it is set
+	Slow         *int64       `json:"slow,omitempty"`
+	Latency      LatencyStats `json:"latency"`
+	TotalSeconds float64      `json:"total_seconds"`
+}
+
+// stats returns the counts and recent latency percentiles
+func (g *generationMetrics) stats() GenerationMetrics {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return GenerationMetrics{
+		Questions:    g.questions.Load(),
+		Errors:       g.errors.Load(),
+		Fallbacks:    g.fallbacks.Load(),
+		Latency:      g.latency.stats(),
+		TotalSeconds: g.total.Seconds(),
+	}
+}
+
+// evalMetrics totals the token counts and evaluation times Ollama reports
+// with each answer, the model's own view of its speed
+type evalMetrics struct {
+	mu     sync.Mutex
+	totals EvalStats
+}
+
+// EvalStats describes the model's work since startup
+type EvalStats struct {
+	PromptTokens  int64   `json:"prompt_tokens"`
+	PromptSeconds float64 `json:"prompt_seconds"`
+	Tokens        int64   `json:"tokens"`
+	Seconds       float64 `json:"seconds"`
+	// TokensPerSecond is the generation speed of the latest answer
+	TokensPerSecond float64 `json:"tokens_per_second"`
+}
+
+// observe adds one answer's counts and returns its tokens per second
+func (e *evalMetrics) observe(resp OllamaResponse) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.totals.PromptTokens += resp.PromptEvalCount
+	e.totals.PromptSeconds += time.Duration(resp.PromptEvalDuration).Seconds()
+	e.totals.Tokens += resp.EvalCount
+	e.totals.Seconds += time.Duration(resp.EvalDuration).Seconds()
+	if resp.EvalDuration > 0 {
+		e.totals.TokensPerSecond = float64(resp.EvalCount) / time.Duration(resp.EvalDuration).Seconds()
+	}
+	return e.totals.TokensPerSecond
+}
+
+// stats returns the totals so far
+func (e *evalMetrics) stats() EvalStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.totals
+}
+
+// HistoryMetrics describes how full the default history is
+type HistoryMetrics struct {
+	Backend  string `json:"backend"`
+	Pairs    int    `json:"pairs"`
+	MaxPairs int    `json:"max_pairs"`
+}
+
+// StorageMetrics is the default history's latency per operation
+type StorageMetrics struct {
+	Backend    string                    `json:"backend"`
+	Operations map[string]HistogramStats `json:"operations"`
+}
+
+// MetricsSnapshot is everything /metrics and /metrics.json report, read
+// once so both formats always agree. Sections are omitted when the feature
+// behind them is off.
+type MetricsSnapshot struct {
+	Generation GenerationMetrics `json:"generation"`
+	Usage      UsageStats        `json:"usage"`
+	Model      *EvalStats        `json:"model,omitempty"`
+	Cache      *CacheStats       `json:"cache,omitempty"`
+	History    *HistoryMetrics   `json:"history,omitempty"`
+	Queue      *QueueStats       `json:"queue,omitempty"`
+	Storage    *StorageMetrics   `json:"storage,omitempty"`
+}
+
+// collectMetrics reads the board's current metrics
+func (app *App) collectMetrics() MetricsSnapshot {
+	snapshot := MetricsSnapshot{Generation: app.metrics.stats(), Usage: app.costs.Totals()}
+
+	if reporter, ok := app.generator.(slowReporter); ok {
+		if slow, ok := reporter.SlowGenerations(); ok {
+			snapshot.Generation.Slow = &slow
+		}
+	}
+	if reporter, ok := app.generator.(evalReporter); ok {
+		if evals, ok := reporter.EvalStats(); ok {
+			snapshot.Model = &evals
+		}
+	}
+	if reporter, ok := app.generator.(cacheReporter); ok {
+		if cache, ok := reporter.CacheStats(); ok {
+			snapshot.Cache = &cache
+		}
+	}
+	if reporter, ok := app.storage.(sizeReporter); ok {
+		if pairs, maxPairs, ok := reporter.HistorySize(); ok {
+			history := HistoryMetrics{Backend: "unknown", Pairs: pairs, MaxPairs: maxPairs}
+			if metered, ok := app.storage.(*MeteredStorage); ok {
+				history.Backend = metered.backend
+			}
+			snapshot.History = &history
+		}
+	}
+	if app.generations != nil {
+		queue := app.generations.queueStats()
+		snapshot.Queue = &queue
+	}
+	if metered, ok := app.storage.(*MeteredStorage); ok {
+		snapshot.Storage = &StorageMetrics{Backend: metered.backend, Operations: metered.Histograms()}
+	}
+	return snapshot
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+// The board has only a handful of metrics, all read from state it already
+// keeps, so they are written by hand rather than through a client library.
+type metricsWriter struct {
+	out     strings.Builder
+	written map[string]bool
+}
+
+// newMetricsWriter creates an empty metrics page
+func newMetricsWriter() *metricsWriter {
+	return &metricsWriter{written: make(map[string]bool)}
+}
+
+// describe writes a metric's HELP and TYPE lines the first time it is written
+func (m *metricsWriter) describe(kind, name, help string) {
+	if !m.written[name] {
+		m.written[name] = true
+		fmt.Fprintf(&m.out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+}
+
+// sample writes one sample line. labels are name/value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.out.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+		}
+		sort.Strings(pairs)
+		m.out.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	m.out.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// gauge writes one sample of a gauge
+func (m *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	m.describe("gauge", name, help)
+	m.sample(name, value, labels...)
+}
+
+// counter writes one sample of a counter
+func (m *metricsWriter) counter(name, help string, value float64, labels ...string) {
+	m.describe("counter", name, help)
+	m.sample(name, value, labels...)
+}
+
+// summary writes a summary's quantiles, keyed by quantile, and its sum and count
+func (m *metricsWriter) summary(name, help string, quantiles map[string]float64, sum float64, count int64) {
+	m.describe("summary", name, help)
+	keys := make([]string, 0, len(quantiles))
+	for quantile := range quantiles {
+		keys = append(keys, quantile)
+	}
+	sort.Strings(keys)
+	for _, quantile := range keys {
+		m.sample(name, quantiles[quantile], "quantile", quantile)
+	}
+	m.sample(name+"_sum", sum)
+	m.sample(name+"_count", float64(count))
+}
+
+// histogram writes a histogram's cumulative buckets, ending with +Inf, and
+// its sum and count
+func (m *metricsWriter) histogram(name, help string, h HistogramStats, labels ...string) {
+	m.describe("histogram", name, help)
+	for _, bucket := range h.Buckets {
+		m.sample(name+"_bucket", float64(bucket.Count), append(labels, "le", strconv.FormatFloat(bucket.LE, 'g', -1, 64))...)
+	}
+	m.sample(name+"_bucket", float64(h.Count), append(labels, "le", "+Inf")...)
+	m.sample(name+"_sum", h.Sum, labels...)
+	m.sample(name+"_count", float64(h.Count), labels...)
+}
+
+// metricsHandler serves the board's metrics for Prometheus to scrape. Values
+// are read at scrape time, so they are always current.
+func (app *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := app.collectMetrics()
+	m := newMetricsWriter()
+
+	generation := snapshot.Generation
+	m.counter("ouija_questions_total", "Questions put to the answer generator.", float64(generation.Questions))
+	m.counter("ouija_generation_errors_total", "Generations that failed, including those given a fallback answer.", float64(generation.Errors))
+	m.counter("ouija_fallback_answers_total", "Failed generations answered with a fallback message.", float64(generation.Fallbacks))
+	m.summary("ouija_generation_duration_seconds", "Time spent generating answers; quantiles cover recent generations.",
+		map[string]float64{"0.5": generation.Latency.P50Ms / 1000, "0.99": generation.Latency.P99Ms / 1000},
+		generation.TotalSeconds, generation.Latency.Count)
+	if generation.Slow != nil {
+		m.counter("ouija_slow_generations_total", "Generations slower than SLOW_GENERATION_THRESHOLD.", float64(*generation.Slow))
+	}
+
+	m.counter("ouija_cost_tokens_total", "Tokens generated, as counted for COST_PER_TOKEN.", float64(snapshot.Usage.Tokens))
+	m.counter("ouija_cost_total", "Cost of the tokens generated, at COST_PER_TOKEN.", snapshot.Usage.Cost)
+
+	if model := snapshot.Model; model != nil {
+		m.counter("ouija_ollama_prompt_eval_tokens_total", "Prompt tokens Ollama evaluated.", float64(model.PromptTokens))
+		m.counter("ouija_ollama_prompt_eval_seconds_total", "Time Ollama spent evaluating prompts.", model.PromptSeconds)
+		m.counter("ouija_ollama_eval_tokens_total", "Tokens Ollama generated.", float64(model.Tokens))
+		m.counter("ouija_ollama_eval_seconds_total", "Time Ollama spent generating tokens.", model.Seconds)
+		m.gauge("ouija_ollama_tokens_per_second", "Generation speed of the latest answer, as reported by Ollama.", model.TokensPerSecond)
+	}
+
+	if cache := snapshot.Cache; cache != nil {
+		m.counter("ouija_cache_hits_total", "Answer cache lookups that found an answer.", float64(cache.Hits))
+		m.counter("ouija_cache_misses_total", "Answer cache lookups that found nothing.", float64(cache.Misses))
+		m.gauge("ouija_cache_entries", "Answers currently cached.", float64(cache.Entries))
+	}
+
+	if history := snapshot.History; history != nil {
+		m.gauge("ouija_history_pairs", "Q&A pairs currently held in history.", float64(history.Pairs), "backend", history.Backend)
+		m.gauge("ouija_history_max_pairs", "Most Q&A pairs history may hold (MAX_HISTORY_SIZE).", float64(history.MaxPairs), "backend", history.Backend)
+	}
+
+	if queue := snapshot.Queue; queue != nil {
+		m.gauge("ouija_generation_queue_depth", "Requests waiting for a generation slot.", float64(queue.Depth))
+		m.summary("ouija_generation_queue_wait_seconds", "Time queued requests waited for a generation slot.", nil, queue.WaitSeconds, queue.Waits)
+	}
+
+	if storage := snapshot.Storage; storage != nil {
+		ops := make([]string, 0, len(storage.Operations))
+		for op := range storage.Operations {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			m.histogram("ouija_storage_duration_seconds", "Time spent in history storage calls.", storage.Operations[op], "operation", op, "backend", storage.Backend)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(m.out.String()))
+}
+
+// metricsJSONHandler serves the same metrics as /metrics as a plain JSON
+// object, for deployments without Prometheus
+func (app *App) metricsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, r, app.collectMetrics(), http.StatusOK)
+}
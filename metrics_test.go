@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape fetches /metrics and /metrics.json from app
+func scrape(t *testing.T, app *App) (string, MetricsSnapshot) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	app.metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	text := rec.Body.String()
+
+	rec = httptest.NewRecorder()
+	app.metricsJSONHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics.json", nil))
+	var snapshot MetricsSnapshot
+	if err := json.NewDecoder(rec.Body).Decode(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	return text, snapshot
+}
+
+func TestCostMetrics(t *testing.T) {
+	tests := []struct {
+		name         string
+		costPerToken float64
+		questions    int
+		wantCost     string
+	}{
+		{name: "unpriced", questions: 1, wantCost: "ouija_cost_total 0\n"},
+		{name: "priced", costPerToken: 0.5, questions: 2, wantCost: "ouija_cost_total 4\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newFakeOllama(t, "YES", " IT", " WILL", " RAIN")
+			client := newTestOllamaClient(t, srv.URL, nil)
+			app := newTestApp(t, client)
+			app.costs = newCostMeter(tt.costPerToken)
+
+			for i := 0; i < tt.questions; i++ {
+				if rec := askJSON(app, `{"question":"Will it rain?"}`, nil); rec.Code != http.StatusOK {
+					t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+				}
+			}
+
+			text, snapshot := scrape(t, app)
+			wantTokens := int64(4 * tt.questions)
+			if snapshot.Usage.Tokens != wantTokens || snapshot.Usage.Cost != float64(wantTokens)*tt.costPerToken {
+				t.Errorf("/metrics.json usage %+v, want %d tokens at %v", snapshot.Usage, wantTokens, tt.costPerToken)
+			}
+			if want := "# TYPE ouija_cost_tokens_total counter\n"; !strings.Contains(text, want) {
+				t.Errorf("/metrics lacks %q", want)
+			}
+			if !strings.Contains(text, tt.wantCost) {
+				t.Errorf("/metrics lacks %q:\n%s", tt.wantCost, text)
+			}
+		})
+	}
+}
+
+func TestDurationHistogram(t *testing.T) {
+	tests := []struct {
+		name         string
+		observations []time.Duration
+		want         map[float64]int64 // cumulative count at some bounds
+		wantCount    int64
+	}{
+		{name: "empty", want: map[float64]int64{0.0001: 0, 5: 0}},
+		{
+			name:         "cumulative",
+			observations: []time.Duration{50 * time.Microsecond, 2 * time.Millisecond, 2 * time.Millisecond, 200 * time.Millisecond},
+			want:         map[float64]int64{0.0001: 1, 0.001: 1, 0.005: 3, 0.1: 3, 0.5: 4, 5: 4},
+			wantCount:    4,
+		},
+		{
+			name:         "on a bound counts in its bucket",
+			observations: []time.Duration{time.Millisecond},
+			want:         map[float64]int64{0.0005: 0, 0.001: 1},
+			wantCount:    1,
+		},
+		{
+			name:         "over the last bound counts only in +Inf",
+			observations: []time.Duration{time.Minute},
+			want:         map[float64]int64{5: 0},
+			wantCount:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h durationHistogram
+			var sum time.Duration
+			for _, d := range tt.observations {
+				h.observe(d)
+				sum += d
+			}
+
+			stats := h.stats()
+			if len(stats.Buckets) != len(storageBuckets) {
+				t.Fatalf("%d buckets, want %d", len(stats.Buckets), len(storageBuckets))
+			}
+			for _, bucket := range stats.Buckets {
+				if want, ok := tt.want[bucket.LE]; ok && bucket.Count != want {
+					t.Errorf("bucket le=%v has %d, want %d", bucket.LE, bucket.Count, want)
+				}
+			}
+			if stats.Count != tt.wantCount || stats.Sum != sum.Seconds() {
+				t.Errorf("count %d, sum %v, want %d and %v", stats.Count, stats.Sum, tt.wantCount, sum.Seconds())
+			}
+		})
+	}
+}
+
+func TestStorageMetrics(t *testing.T) {
+	app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+	app.storage = NewMeteredStorage(app.storage, "memory")
+
+	for i := 0; i < 2; i++ {
+		if rec := askJSON(app, `{"question":"Will it rain?"}`, nil); rec.Code != http.StatusOK {
+			t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+		}
+	}
+	app.storage.GetAll()
+
+	text, snapshot := scrape(t, app)
+	for _, want := range []string{
+		"# TYPE ouija_storage_duration_seconds histogram\n",
+		`ouija_storage_duration_seconds_bucket{backend="memory",le="+Inf",operation="add"} 2` + "\n",
+		`ouija_storage_duration_seconds_count{backend="memory",operation="add"} 2` + "\n",
+		`ouija_storage_duration_seconds_count{backend="memory",operation="get_all"} 1` + "\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("/metrics lacks %q", want)
+		}
+	}
+
+	if snapshot.Storage == nil || snapshot.Storage.Backend != "memory" || snapshot.Storage.Operations["add"].Count != 2 {
+		t.Errorf("/metrics.json storage %+v, want 2 adds to memory", snapshot.Storage)
+	}
+}
+
+func TestHealthStorage(t *testing.T) {
+	tests := []struct {
+		name        string
+		metered     bool
+		wantStorage bool
+	}{
+		{name: "unmetered", metered: false},
+		{name: "metered", metered: true, wantStorage: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+			if tt.metered {
+				app.storage = NewMeteredStorage(app.storage, "memory")
+			}
+			app.storage.GetAll()
+
+			rec := httptest.NewRecorder()
+			app.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200", rec.Code)
+			}
+			var health HealthResponse
+			if err := json.NewDecoder(rec.Body).Decode(&health); err != nil {
+				t.Fatal(err)
+			}
+			if health.Status != "ok" || (health.Storage != nil) != tt.wantStorage {
+				t.Fatalf("health %+v, want storage = %v", health, tt.wantStorage)
+			}
+			if tt.wantStorage {
+				if _, ok := health.Storage.P99Ms["get_all"]; !ok || health.Storage.Backend != "memory" {
+					t.Errorf("storage health %+v, want get_all's p99", *health.Storage)
+				}
+			}
+		})
+	}
+}
@@ -1,39 +1,171 @@
 package main
 
 import (
+	"context"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
 )
 
-// loggingMiddleware logs all HTTP requests
-func loggingMiddleware(next http.Handler) http.Handler {
+// logSampler decides which requests are written to the access log. Only one
+// in rate fast, successful requests is logged; errors and slow requests
+// always are.
+type logSampler struct {
+	rate          uint64
+	slowThreshold time.Duration // 0 never treats a request as slow
+	count         atomic.Uint64
+}
+
+// newLogSampler creates a sampler logging 1 in rate requests, or all of them
+// when rate is 1 or less
+func newLogSampler(rate int, slowThreshold time.Duration) *logSampler {
+	return &logSampler{rate: uint64(max(rate, 1)), slowThreshold: slowThreshold}
+}
+
+// shouldLog reports whether a request that finished with status after
+// elapsed should be logged
+func (s *logSampler) shouldLog(status int, elapsed time.Duration) bool {
+	// Never sample away failures or slow requests
+	if status < 200 || status >= 300 {
+		return true
+	}
+	if s.slowThreshold > 0 && elapsed >= s.slowThreshold {
+		return true
+	}
+	if s.rate == 1 {
+		return true
+	}
+
+	// Only sampled requests advance the counter, so exactly 1 in rate of them is logged
+	return (s.count.Add(1)-1)%s.rate == 0
+}
+
+// loggingMiddleware logs HTTP requests in the given format, sampled by
+// sampler. When anonymizeIPs is set, client addresses are masked before they
+// are written to the log.
+func loggingMiddleware(anonymizeIPs bool, sampler *logSampler, format *accessLogFormat) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			// Create response writer wrapper to capture status code
+			wrapper := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+			next.ServeHTTP(wrapper, r)
+
+			elapsed := time.Since(start)
+			if !sampler.shouldLog(wrapper.statusCode, elapsed) {
+				return
+			}
+
+			remoteAddr := r.RemoteAddr
+			if anonymizeIPs {
+				host, _, err := net.SplitHostPort(remoteAddr)
+				if err != nil {
+					host = remoteAddr
+				}
+				remoteAddr = anonymizeIP(host)
+			}
+
+			format.write(AccessLogEntry{
+				Time:       start,
+				RemoteAddr: remoteAddr,
+				Method:     r.Method,
+				URI:        r.RequestURI,
+				Proto:      r.Proto,
+				Status:     wrapper.statusCode,
+				Bytes:      wrapper.bytes,
+				Duration:   elapsed,
+				Referer:    r.Referer(),
+				UserAgent:  r.UserAgent(),
+				RequestID:  requestIDFromContext(r.Context()),
+			})
+		})
+	}
+}
+
+// recoverMiddleware turns a panic in a handler into a 500 response instead of
+// dropping the connection
+func recoverMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.RequestURI, err, debug.Stack())
+				respondWithError(w, r, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
 
-		// Create response writer wrapper to capture status code
-		wrapper := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+// requestIDContextKey is the context key for the tracing request ID
+type requestIDContextKey struct{}
 
-		next.ServeHTTP(wrapper, r)
+// requestIDFromContext returns the tracing request ID carried by ctx, if any
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
 
-		log.Printf(
-			"%s %s %d %v %s",
-			r.Method,
-			r.RequestURI,
-			wrapper.statusCode,
-			time.Since(start),
-			r.RemoteAddr,
-		)
+// requestIDMiddleware tags each request with an X-Request-ID, reusing the
+// caller's when it is well formed, and echoes it in the response
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validIdempotencyKey(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// bodyLimitMiddleware caps the size of request bodies. Bodies declaring a
+// larger Content-Length get 413 without being read. Chunked bodies have no
+// length up front, so they are counted as they are read: reads past the
+// limit fail with *http.MaxBytesError, which handlers report with
+// respondBodyTooLarge.
+func bodyLimitMiddleware(maxBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				respondBodyTooLarge(w, r)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// respondBodyTooLarge answers 413 and closes the connection. The server
+// would otherwise try to read the rest of the body before replying, since
+// the wrapped ResponseWriter hides the limit being hit from it, and a client
+// still sending a chunked body would never get the response.
+func respondBodyTooLarge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Connection", "close")
+	respondWithError(w, r, "Request body too large", http.StatusRequestEntityTooLarge)
+}
+
 // responseWriter wraps http.ResponseWriter to capture status code
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -41,6 +173,18 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController so
+// streaming handlers can flush and adjust deadlines
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // securityHeadersMiddleware adds security headers to all responses
 func securityHeadersMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -63,58 +207,185 @@ func securityHeadersMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// limiterIdleTimeout is how long an IP's limiter is kept after its last request
+const limiterIdleTimeout = 5 * time.Minute
+
+// RATE_LIMIT_ALGORITHM values
+const (
+	// rateLimitTokenBucket allows bursts of up to twice the rate
+	rateLimitTokenBucket = "tokenbucket"
+	// rateLimitSlidingWindow allows about rate requests in any second, without bursts
+	rateLimitSlidingWindow = "slidingwindow"
+)
+
+// validRateLimitAlgorithm reports whether a is a supported RATE_LIMIT_ALGORITHM
+func validRateLimitAlgorithm(a string) bool {
+	return a == rateLimitTokenBucket || a == rateLimitSlidingWindow
+}
+
+// requestLimiter decides whether one client's request may proceed, and if
+// not, how long until it would
+type requestLimiter interface {
+	allow(now time.Time) (bool, time.Duration)
+}
+
+// tokenBucket is a requestLimiter refilling at rate tokens per second, with
+// room for a burst of twice that
+type tokenBucket struct {
+	limiter *rate.Limiter
+}
+
+// newTokenBucket creates a token bucket for requestsPerSecond
+func newTokenBucket(requestsPerSecond int) *tokenBucket {
+	return &tokenBucket{limiter: rate.NewLimiter(rate.Limit(requestsPerSecond), requestsPerSecond*2)}
+}
+
+// allow takes a token if one is available, otherwise reporting when the
+// next one will be
+func (b *tokenBucket) allow(now time.Time) (bool, time.Duration) {
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// slidingWindow is a requestLimiter allowing limit requests per window. It
+// estimates the count over the last window from the current and previous
+// fixed windows, weighting the previous one by how much of it still
+// overlaps, so there is no burst at window boundaries.
+type slidingWindow struct {
+	limit    int
+	window   time.Duration
+	start    time.Time // start of the current fixed window
+	current  int
+	previous int
+}
+
+// newSlidingWindow creates a sliding window allowing limit requests per window
+func newSlidingWindow(limit int, window time.Duration) *slidingWindow {
+	return &slidingWindow{limit: limit, window: window}
+}
+
+// allow counts the request if the estimated count leaves room for it,
+// otherwise reporting when the estimate will have dropped enough. Calls are
+// serialized by the rateLimiter's lock.
+func (s *slidingWindow) allow(now time.Time) (bool, time.Duration) {
+	if elapsed := now.Sub(s.start); elapsed >= s.window {
+		// Roll over; after more than one idle window the previous one is empty
+		s.previous = s.current
+		if elapsed >= 2*s.window {
+			s.previous = 0
+		}
+		s.current = 0
+		s.start = now.Truncate(s.window)
+	}
+
+	overlap := 1 - float64(now.Sub(s.start))/float64(s.window)
+	if float64(s.previous)*overlap+float64(s.current) >= float64(s.limit) {
+		return false, s.retryAfter(now)
+	}
+	s.current++
+	return true, 0
+}
+
+// retryAfter estimates how long until a request would be allowed, assuming
+// none are counted meanwhile
+func (s *slidingWindow) retryAfter(now time.Time) time.Duration {
+	end := s.start.Add(s.window)
+	if s.current >= s.limit {
+		// The current window is full on its own, so wait for it to become
+		// the previous one and overlap the next little enough
+		return end.Sub(now) + time.Duration(float64(s.window)*(1-float64(s.limit)/float64(s.current)))
+	}
+	// Wait for the previous window to overlap little enough
+	at := s.start.Add(time.Duration(float64(s.window) * (1 - float64(s.limit-s.current)/float64(s.previous))))
+	return max(at.Sub(now), 0)
+}
+
 // rateLimiter holds rate limiters for each IP address
 type rateLimiter struct {
-	limiters map[string]*rate.Limiter
-	mu       sync.RWMutex
-	rate     int
+	limiters    map[string]*limiterEntry
+	mu          sync.Mutex
+	newLimiter  func() requestLimiter
+	idleTimeout time.Duration
+	lastSweep   time.Time
+	// now is the time source, replaceable so eviction can be tested without sleeping
+	now func() time.Time
+}
+
+// limiterEntry is a rate limiter and when it was last used
+type limiterEntry struct {
+	limiter  requestLimiter
+	lastSeen time.Time
 }
 
-// newRateLimiter creates a new rate limiter
-func newRateLimiter(requestsPerSecond int) *rateLimiter {
+// newRateLimiter creates a new rate limiter using algorithm, one of the
+// RATE_LIMIT_ALGORITHM values
+func newRateLimiter(requestsPerSecond int, algorithm string) *rateLimiter {
+	newLimiter := func() requestLimiter { return newTokenBucket(requestsPerSecond) }
+	if algorithm == rateLimitSlidingWindow {
+		newLimiter = func() requestLimiter { return newSlidingWindow(requestsPerSecond, time.Second) }
+	}
+
 	return &rateLimiter{
-		limiters: make(map[string]*rate.Limiter),
-		rate:     requestsPerSecond,
+		limiters:    make(map[string]*limiterEntry),
+		newLimiter:  newLimiter,
+		idleTimeout: limiterIdleTimeout,
+		now:         time.Now,
 	}
 }
 
-// getLimiter returns the rate limiter for a given IP
-func (rl *rateLimiter) getLimiter(ip string) *rate.Limiter {
+// allow reports whether a request from ip is within its rate limit, and if
+// not, how long until it would be
+func (rl *rateLimiter) allow(ip string) (bool, time.Duration) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	limiter, exists := rl.limiters[ip]
+	now := rl.now()
+
+	// Periodically evict limiters that have been idle for too long
+	if now.Sub(rl.lastSweep) >= rl.idleTimeout {
+		for key, entry := range rl.limiters {
+			if now.Sub(entry.lastSeen) >= rl.idleTimeout {
+				delete(rl.limiters, key)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	entry, exists := rl.limiters[ip]
 	if !exists {
-		limiter = rate.NewLimiter(rate.Limit(rl.rate), rl.rate*2)
-		rl.limiters[ip] = limiter
-
-		// Clean up old limiters after 5 minutes
-		go func() {
-			time.Sleep(5 * time.Minute)
-			rl.mu.Lock()
-			delete(rl.limiters, ip)
-			rl.mu.Unlock()
-		}()
+		entry = &limiterEntry{limiter: rl.newLimiter()}
+		rl.limiters[ip] = entry
 	}
+	entry.lastSeen = now
 
-	return limiter
+	return entry.limiter.allow(now)
 }
 
-// rateLimitMiddleware implements per-IP rate limiting
-func rateLimitMiddleware(requestsPerSecond int) func(http.Handler) http.Handler {
-	limiter := newRateLimiter(requestsPerSecond)
+// rateLimitMiddleware implements per-IP rate limiting with the given
+// RATE_LIMIT_ALGORITHM. Clients resolving to an address in exempt are never
+// limited.
+func rateLimitMiddleware(requestsPerSecond int, algorithm string, resolver *ipResolver, exempt ipRanges) func(http.Handler) http.Handler {
+	limiter := newRateLimiter(requestsPerSecond, algorithm)
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Extract IP address (handle X-Forwarded-For for proxies)
-			ip := r.RemoteAddr
-			if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-				ip = forwarded
+			// Resolve the client IP, honoring X-Forwarded-For from trusted proxies only
+			ip := resolver.clientIP(r)
+
+			// Trusted clients such as monitoring probes skip the limiter entirely
+			if exempt.contains(ip) {
+				next.ServeHTTP(w, r)
+				return
 			}
 
 			// Check rate limit
-			if !limiter.getLimiter(ip).Allow() {
-				respondWithError(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			if ok, retryAfter := limiter.allow(ip.String()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(retryAfter.Seconds())), 1)))
+				respondWithError(w, r, "Rate limit exceeded", http.StatusTooManyRequests)
 				return
 			}
 
@@ -122,3 +393,105 @@ func rateLimitMiddleware(requestsPerSecond int) func(http.Handler) http.Handler
 		})
 	}
 }
+
+// connLimiter counts open long-lived connections per IP
+type connLimiter struct {
+	maxPerIP int
+	mu       sync.Mutex
+	active   map[string]int
+}
+
+// newConnLimiter creates a limiter allowing maxPerIP connections per IP
+func newConnLimiter(maxPerIP int) *connLimiter {
+	return &connLimiter{maxPerIP: maxPerIP, active: make(map[string]int)}
+}
+
+// acquire claims a connection slot for ip, returning false if it is at its
+// limit. A successful acquire must be paired with a release.
+func (cl *connLimiter) acquire(ip string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.active[ip] >= cl.maxPerIP {
+		return false
+	}
+	cl.active[ip]++
+	return true
+}
+
+// release frees a connection slot for ip
+func (cl *connLimiter) release(ip string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	// Drop idle IPs so the map doesn't grow with every visitor
+	if cl.active[ip]--; cl.active[ip] <= 0 {
+		delete(cl.active, ip)
+	}
+}
+
+// connLimitMiddleware caps simultaneous connections per client IP for
+// long-lived endpoints such as streams. Slots are released when the handler
+// returns, however the connection ended.
+func connLimitMiddleware(maxPerIP int, resolver *ipResolver) func(http.Handler) http.Handler {
+	limiter := newConnLimiter(maxPerIP)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := resolver.clientIP(r).String()
+			if !limiter.acquire(ip) {
+				respondWithError(w, r, "Too many spirits summoned from your address, close a reading first", http.StatusTooManyRequests)
+				return
+			}
+			defer limiter.release(ip)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestTimeoutMiddleware gives each request a single deadline, carried by
+// its context, that everything it does shares: waiting for a generation
+// slot, model calls, retries, regenerations and back-off delays. However
+// many of those stack up, the request can't outlive the deadline. A timeout
+// of 0 or less leaves requests unbounded.
+func requestTimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// prettyJSONContextKey is the context key for the pretty JSON preference
+type prettyJSONContextKey struct{}
+
+// prettyJSONFromContext reports whether JSON responses should be indented
+func prettyJSONFromContext(ctx context.Context) bool {
+	pretty, _ := ctx.Value(prettyJSONContextKey{}).(bool)
+	return pretty
+}
+
+// prettyJSONMiddleware records whether JSON responses should be indented for
+// humans: a ?pretty= query parameter wins, otherwise the server default applies
+func prettyJSONMiddleware(defaultPretty bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pretty := defaultPretty
+			if value := r.URL.Query().Get("pretty"); value != "" {
+				if parsed, err := strconv.ParseBool(value); err == nil {
+					pretty = parsed
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), prettyJSONContextKey{}, pretty)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAccessLogAnonymizesIPs(t *testing.T) {
+	tests := []struct {
+		name       string
+		anonymize  bool
+		remoteAddr string
+		want       string
+		notWant    string
+	}{
+		{name: "IPv4 kept", remoteAddr: "203.0.113.57:4321", want: "203.0.113.57:4321"},
+		{name: "IPv4 masked", anonymize: true, remoteAddr: "203.0.113.57:4321", want: "203.0.113.0", notWant: "203.0.113.57"},
+		{name: "IPv6 masked", anonymize: true, remoteAddr: "[2001:db8:1:2:3:4:5:6]:4321", want: "2001:db8:1::", notWant: "5:6"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			format := &accessLogFormat{logger: log.New(&buf, "", 0), format: formatJSONAccess}
+			handler := loggingMiddleware(tt.anonymize, newLogSampler(1, 0), format)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			line := buf.String()
+			if !strings.Contains(line, `"remote_addr":"`+tt.want+`"`) {
+				t.Errorf("access log %q doesn't have remote_addr %s", line, tt.want)
+			}
+			if tt.notWant != "" && strings.Contains(line, tt.notWant) {
+				t.Errorf("access log %q reveals %s", line, tt.notWant)
+			}
+		})
+	}
+}
+
+// fakeClock is a time source that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// newTestRateLimiter creates a rateLimiter driven by a fake clock
+func newTestRateLimiter(requestsPerSecond int, algorithm string) (*rateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rl := newRateLimiter(requestsPerSecond, algorithm)
+	rl.now = clock.Now
+	return rl, clock
+}
+
+// allowed counts how many of n immediate requests from ip are allowed
+func allowed(rl *rateLimiter, ip string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if ok, _ := rl.allow(ip); ok {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	tests := []struct {
+		name    string
+		advance time.Duration
+		want    int
+	}{
+		{name: "no refill", want: 0},
+		{name: "partial refill", advance: 500 * time.Millisecond, want: 2},
+		{name: "one second refills the rate", advance: time.Second, want: 4},
+		{name: "refill is capped at the burst", advance: time.Minute, want: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, clock := newTestRateLimiter(4, rateLimitTokenBucket)
+
+			// The burst is twice the rate
+			if got := allowed(rl, "203.0.113.1", 20); got != 8 {
+				t.Fatalf("burst allowed %d requests, want 8", got)
+			}
+			ok, retryAfter := rl.allow("203.0.113.1")
+			if ok || retryAfter <= 0 || retryAfter > 250*time.Millisecond {
+				t.Fatalf("exhausted bucket: allow = %v, %v, want false within 250ms", ok, retryAfter)
+			}
+
+			clock.advance(tt.advance)
+			if got := allowed(rl, "203.0.113.1", 20); got != tt.want {
+				t.Errorf("allowed %d requests after %v, want %d", got, tt.advance, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSlidingWindow(t *testing.T) {
+	rl, clock := newTestRateLimiter(4, rateLimitSlidingWindow)
+
+	// No burst beyond the rate
+	if got := allowed(rl, "203.0.113.1", 20); got != 4 {
+		t.Fatalf("window allowed %d requests, want 4", got)
+	}
+	ok, retryAfter := rl.allow("203.0.113.1")
+	if ok || retryAfter != time.Second {
+		t.Fatalf("full window: allow = %v, %v, want false after 1s", ok, retryAfter)
+	}
+
+	// Half way into the next window, half the previous one still counts
+	clock.advance(1500 * time.Millisecond)
+	if got := allowed(rl, "203.0.113.1", 20); got != 2 {
+		t.Errorf("allowed %d requests half way through the next window, want 2", got)
+	}
+
+	// Two idle windows clear the history
+	clock.advance(2 * time.Second)
+	if got := allowed(rl, "203.0.113.1", 20); got != 4 {
+		t.Errorf("allowed %d requests after idling, want 4", got)
+	}
+}
+
+func TestRateLimiterPerIP(t *testing.T) {
+	for _, algorithm := range []string{rateLimitTokenBucket, rateLimitSlidingWindow} {
+		t.Run(algorithm, func(t *testing.T) {
+			rl, _ := newTestRateLimiter(2, algorithm)
+
+			allowed(rl, "203.0.113.1", 20)
+			if ok, _ := rl.allow("203.0.113.1"); ok {
+				t.Fatal("exhausted client allowed")
+			}
+			if ok, _ := rl.allow("203.0.113.2"); !ok {
+				t.Error("another client limited by the first one's requests")
+			}
+		})
+	}
+}
+
+func TestRateLimiterEvictsIdle(t *testing.T) {
+	rl, clock := newTestRateLimiter(1, rateLimitTokenBucket)
+
+	rl.allow("203.0.113.1")
+	clock.advance(limiterIdleTimeout / 2)
+	rl.allow("203.0.113.2")
+
+	// The first client has now been idle for the timeout, the second hasn't
+	clock.advance(limiterIdleTimeout / 2)
+	rl.allow("203.0.113.3")
+
+	for ip, wantKept := range map[string]bool{"203.0.113.1": false, "203.0.113.2": true, "203.0.113.3": true} {
+		if _, kept := rl.limiters[ip]; kept != wantKept {
+			t.Errorf("%s kept = %v, want %v", ip, kept, wantKept)
+		}
+	}
+}
+
+func TestRateLimitRetryAfter(t *testing.T) {
+	tests := []struct {
+		name      string
+		rate      int
+		algorithm string
+		want      int
+	}{
+		{name: "token bucket", rate: 1, algorithm: rateLimitTokenBucket, want: 1},
+		{name: "sliding window", rate: 2, algorithm: rateLimitSlidingWindow, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := rateLimitMiddleware(tt.rate, tt.algorithm, &ipResolver{}, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			var rec *httptest.ResponseRecorder
+			for i := 0; i < 10; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "203.0.113.1:1234"
+				rec = httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code == http.StatusTooManyRequests {
+					break
+				}
+			}
+
+			if rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("status %d, want 429", rec.Code)
+			}
+			retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+			if err != nil || retryAfter < 1 || retryAfter > tt.want {
+				t.Errorf("Retry-After %q, want 1 to %d seconds", rec.Header().Get("Retry-After"), tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitAlgorithmBurst(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		want      int
+	}{
+		// The token bucket lets a burst of twice the rate through, the
+		// sliding window never more than the rate
+		{algorithm: rateLimitTokenBucket, want: 10},
+		{algorithm: rateLimitSlidingWindow, want: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			handler := rateLimitMiddleware(5, tt.algorithm, &ipResolver{}, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			passed := 0
+			for i := 0; i < 15; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = "203.0.113.1:1234"
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code == http.StatusOK {
+					passed++
+				}
+			}
+			if passed != tt.want {
+				t.Errorf("%d of 15 rapid requests passed, want %d", passed, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidRateLimitAlgorithm(t *testing.T) {
+	for algorithm, want := range map[string]bool{"tokenbucket": true, "slidingwindow": true, "fixedwindow": false, "": false} {
+		if got := validRateLimitAlgorithm(algorithm); got != want {
+			t.Errorf("validRateLimitAlgorithm(%q) = %v, want %v", algorithm, got, want)
+		}
+	}
+}
+
+// countingBody is a request body recording how much of it was read
+type countingBody struct {
+	strings.Reader
+	read int
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += n
+	return n, err
+}
+
+func (b *countingBody) Close() error { return nil }
+
+func TestRateLimitBeforeBody(t *testing.T) {
+	// The chain main builds, up to the body limit
+	router := mux.NewRouter()
+	router.Use(recoverMiddleware)
+	router.Use(requestIDMiddleware)
+	router.Use(rateLimitMiddleware(1, rateLimitTokenBucket, &ipResolver{}, nil))
+	router.Use(bodyLimitMiddleware(1 << 20))
+	router.HandleFunc("/ask", func(w http.ResponseWriter, r *http.Request) {
+		var req AskRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}).Methods(http.MethodPost)
+
+	tests := []struct {
+		name       string
+		wantStatus int
+		wantRead   bool
+	}{
+		// A rate of 1 allows a burst of 2
+		{name: "first", wantStatus: http.StatusOK, wantRead: true},
+		{name: "second", wantStatus: http.StatusOK, wantRead: true},
+		{name: "limited", wantStatus: http.StatusTooManyRequests, wantRead: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &countingBody{Reader: *strings.NewReader(`{"question":"Will it rain?"}`)}
+			req := httptest.NewRequest(http.MethodPost, "/ask", body)
+			req.RemoteAddr = "203.0.113.1:1234"
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if read := body.read > 0; read != tt.wantRead {
+				t.Errorf("body read = %v (%d bytes), want %v", read, body.read, tt.wantRead)
+			}
+		})
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		chunked    bool
+		wantStatus int
+	}{
+		{name: "within the limit", body: `{"question":"Will it rain?"}`, wantStatus: http.StatusOK},
+		{name: "declared too large", body: strings.Repeat("x", 100), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked too large", body: strings.Repeat("x", 100), chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	handler := bodyLimitMiddleware(64)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				respondBodyTooLarge(w, r)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/ask", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestChunkedBodyTooLarge(t *testing.T) {
+	app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+	// The logging wrapper is what hid the limit from the server before
+	format := &accessLogFormat{logger: log.New(io.Discard, "", 0), format: formatJSONAccess}
+	handler := loggingMiddleware(false, newLogSampler(1, 0), format)(bodyLimitMiddleware(64)(http.HandlerFunc(app.askHandler)))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	body := `{"question":"` + strings.Repeat("x", 200) + `"}`
+	tests := []struct {
+		name string
+		// terminated sends the final empty chunk; otherwise the client keeps
+		// the body open, as if still sending
+		terminated bool
+	}{
+		{name: "terminated", terminated: true},
+		{name: "still sending"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+			request := "POST /ask HTTP/1.1\r\nHost: board\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n"
+			if tt.terminated {
+				request += "0\r\n\r\n"
+			}
+			if _, err := io.WriteString(conn, request); err != nil {
+				t.Fatal(err)
+			}
+
+			// A hang shows up as the deadline passing
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("no response: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Errorf("status %d, want 413", resp.StatusCode)
+			}
+			if !resp.Close {
+				t.Error("connection kept open after a partly read body")
+			}
+		})
+	}
+}
+
+func TestCORSPreflightLastEventID(t *testing.T) {
+	policy, err := newCORSPolicy([]string{"https://board.example"}, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := corsMiddleware(policy)(http.NotFoundHandler())
+
+	// EventSource reconnecting cross-origin sends Last-Event-ID
+	req := httptest.NewRequest(http.MethodOptions, "/ask/stream", nil)
+	req.Header.Set("Origin", "https://board.example")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "last-event-id")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204", rec.Code)
+	}
+	if allowed := rec.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(allowed, "Last-Event-ID") {
+		t.Errorf("Access-Control-Allow-Headers %q, want Last-Event-ID allowed", allowed)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	handler := requestIDMiddleware(recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("the planchette flew off the board")
+	})))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ask", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "planchette") {
+		t.Errorf("panic leaked to the client: %s", rec.Body)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{name: "generated"},
+		{name: "reused", incoming: "req-1234", wantSame: true},
+		{name: "malformed replaced", incoming: "bad id\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = r.Context().Value(requestIDContextKey{}).(string)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/ask", nil)
+			if tt.incoming != "" {
+				req.Header.Set("X-Request-ID", tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			got := rec.Header().Get("X-Request-ID")
+			if got == "" || got != seen {
+				t.Fatalf("X-Request-ID %q, handler saw %q", got, seen)
+			}
+			if (got == tt.incoming) != tt.wantSame {
+				t.Errorf("X-Request-ID %q, incoming %q, want reused = %v", got, tt.incoming, tt.wantSame)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"slices"
+)
+
+// modelNames returns the models a request may ask for: OLLAMA_MODEL and
+// then those listed in OLLAMA_MODELS
+func (app *App) modelNames() []string {
+	names := []string{app.config.OllamaModel}
+	for _, name := range app.config.OllamaModels {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// validModel reports whether a request may ask for the named model
+func (app *App) validModel(name string) bool {
+	return slices.Contains(app.modelNames(), name)
+}
+
+// modelContextKey is the context key for a request's chosen model
+type modelContextKey struct{}
+
+// contextWithModel returns a context asking for the named model. An empty
+// name leaves OLLAMA_MODEL in place.
+func contextWithModel(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, modelContextKey{}, name)
+}
+
+// modelFromContext returns the model requested for ctx, "" for OLLAMA_MODEL
+func modelFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(modelContextKey{}).(string)
+	return name
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OllamaTagsResponse represents the response of Ollama's /api/tags endpoint
+type OllamaTagsResponse struct {
+	Models []struct {
+		Name string `json:"name"`
+	} `json:"models"`
+}
+
+// modelWatcher periodically checks that the configured model is available in
+// Ollama and caches the result, so readiness probes don't hit Ollama each time
+type modelWatcher struct {
+	tagsURL  string
+	model    string
+	interval time.Duration
+	client   *http.Client
+	ready    atomic.Bool
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newModelWatcher creates a watcher for model on the Ollama instance serving generateURL
+func newModelWatcher(generateURL, model string, interval, timeout time.Duration) (*modelWatcher, error) {
+	tagsURL, err := ollamaTagsURL(generateURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &modelWatcher{
+		tagsURL:  tagsURL,
+		model:    model,
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// ollamaTagsURL derives the /api/tags URL from the configured generate URL
+func ollamaTagsURL(generateURL string) (string, error) {
+	u, err := url.Parse(generateURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid Ollama URL: %w", err)
+	}
+
+	if strings.HasSuffix(u.Path, "/api/generate") {
+		u.Path = strings.TrimSuffix(u.Path, "/api/generate") + "/api/tags"
+	} else {
+		u.Path = "/api/tags"
+	}
+	return u.String(), nil
+}
+
+// Start checks the model in the background immediately and then on every interval
+func (mw *modelWatcher) Start() {
+	mw.wg.Add(1)
+	go func() {
+		defer mw.wg.Done()
+
+		mw.check()
+
+		ticker := time.NewTicker(mw.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				mw.check()
+			case <-mw.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the watcher
+func (mw *modelWatcher) Stop() {
+	close(mw.stop)
+	mw.wg.Wait()
+}
+
+// Ready reports whether the model was available at the last check
+func (mw *modelWatcher) Ready() bool {
+	return mw.ready.Load()
+}
+
+// check queries Ollama for the model and updates the cached status
+func (mw *modelWatcher) check() {
+	available, err := mw.modelAvailable()
+	if err != nil {
+		log.Printf("Error checking Ollama model availability: %v", err)
+	}
+
+	if previous := mw.ready.Swap(available); previous != available {
+		log.Printf("Ollama model %q available: %t", mw.model, available)
+	}
+}
+
+// modelAvailable asks Ollama whether the model has been pulled
+func (mw *modelWatcher) modelAvailable() (bool, error) {
+	resp, err := mw.client.Get(mw.tagsURL)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected Ollama status: %d", resp.StatusCode)
+	}
+
+	var tags OllamaTagsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return false, fmt.Errorf("failed to parse Ollama tags: %w", err)
+	}
+
+	for _, m := range tags.Models {
+		// Models without an explicit tag are listed as "name:latest"
+		if m.Name == mw.model || m.Name == mw.model+":latest" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// namespaceHeaderName selects the history namespace, e.g. for themed boards
+const namespaceHeaderName = "X-Board-Namespace"
+
+// namespaceNamePattern is what a namespace name may look like
+var namespaceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// namespaceContextKey is the context key for the request's history namespace
+type namespaceContextKey struct{}
+
+// contextWithNamespace returns a context carrying the history namespace
+func contextWithNamespace(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, namespaceContextKey{}, name)
+}
+
+// namespaceFromContext returns the history namespace carried by ctx, ""
+// for the default history
+func namespaceFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(namespaceContextKey{}).(string)
+	return name
+}
+
+// namespaceStore keeps a separate history per allowed namespace, next to
+// the default history
+type namespaceStore struct {
+	spaces map[string]Storage
+}
+
+// newNamespaceStore creates a history for each allowed name with
+// newStorage. Names must match namespaceNamePattern and there may be at
+// most maxNamespaces of them.
+func newNamespaceStore(names []string, maxNamespaces int, newStorage func(name string) Storage) (*namespaceStore, error) {
+	if len(names) > maxNamespaces {
+		return nil, fmt.Errorf("%d namespaces configured, at most %d allowed", len(names), maxNamespaces)
+	}
+
+	spaces := make(map[string]Storage, len(names))
+	for _, name := range names {
+		if !namespaceNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid namespace %q", name)
+		}
+		if _, exists := spaces[name]; exists {
+			return nil, fmt.Errorf("duplicate namespace %q", name)
+		}
+		spaces[name] = newStorage(name)
+	}
+	return &namespaceStore{spaces: spaces}, nil
+}
+
+// Namespace returns the history of an allowed namespace
+func (ns *namespaceStore) Namespace(name string) (Storage, bool) {
+	storage, ok := ns.spaces[name]
+	return storage, ok
+}
+
+// Close closes every namespace's history
+func (ns *namespaceStore) Close() error {
+	for _, storage := range ns.spaces {
+		if err := storage.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namespaceSnapshotPath returns where a namespace's history is snapshotted:
+// next to SNAPSHOT_PATH with the name before the extension, e.g.
+// answers.love.json
+func namespaceSnapshotPath(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// namespaceMiddleware rejects requests for namespaces that aren't allowed
+// and records the requested namespace for the handlers
+func namespaceMiddleware(ns *namespaceStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := r.Header.Get(namespaceHeaderName)
+			if name == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if _, ok := ns.Namespace(name); !ok {
+				respondWithError(w, r, "Unknown board namespace", http.StatusBadRequest)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(contextWithNamespace(r.Context(), name)))
+		})
+	}
+}
+
+// storageFor returns the history for the namespace carried by ctx, falling
+// back to the default history
+func (app *App) storageFor(ctx context.Context) Storage {
+	if name := namespaceFromContext(ctx); name != "" && app.namespaces != nil {
+		if storage, ok := app.namespaces.Namespace(name); ok {
+			return storage
+		}
+	}
+	return app.storage
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNamespaceSnapshotPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "answers.json", want: "answers.love.json"},
+		{path: "/data/history.snapshot.json", want: "/data/history.snapshot.love.json"},
+		{path: "answers", want: "answers.love"},
+	}
+
+	for _, tt := range tests {
+		if got := namespaceSnapshotPath(tt.path, "love"); got != tt.want {
+			t.Errorf("namespaceSnapshotPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestStatsPerNamespace(t *testing.T) {
+	app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+	namespaces, err := newNamespaceStore([]string{"love"}, 4, func(string) Storage {
+		return NewMeteredStorage(NewMemoryStorage(10, 0), "memory")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.namespaces = namespaces
+
+	love, _ := namespaces.Namespace("love")
+	for _, question := range []string{"Does she love me?", "Will he call?"} {
+		if err := love.Add(context.Background(), QAPair{Question: question, Answer: "YES"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		wantSize  int
+	}{
+		{name: "default history", wantSize: 0},
+		{name: "namespace history", namespace: "love", wantSize: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := namespaceMiddleware(namespaces)(http.HandlerFunc(app.statsHandler))
+			req := httptest.NewRequest(http.MethodGet, "/stats", nil)
+			if tt.namespace != "" {
+				req.Header.Set(namespaceHeaderName, tt.namespace)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			var stats StatsResponse
+			if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+				t.Fatal(err)
+			}
+			if stats.HistorySize != tt.wantSize {
+				t.Errorf("history_size = %d, want %d", stats.HistorySize, tt.wantSize)
+			}
+			if stats.Namespace != tt.namespace {
+				t.Errorf("namespace = %q, want %q", stats.Namespace, tt.namespace)
+			}
+			if tt.namespace != "" && (stats.Storage == nil || stats.Storage.Operations["add"].Count != 2) {
+				t.Errorf("namespace storage stats = %+v, want 2 timed adds", stats.Storage)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// NDJSONDone is the final line of an NDJSON answer stream
+type NDJSONDone struct {
+	Done      bool   `json:"done"`
+	Answer    string `json:"answer"`
+	RequestID string `json:"request_id"`
+}
+
+// NDJSONError is an error line of an NDJSON answer stream. Shutdown is set
+// when the server is closing and the client should retry shortly.
+type NDJSONError struct {
+	Error    string `json:"error"`
+	Shutdown bool   `json:"shutdown,omitempty"`
+}
+
+// askNDJSONHandler answers a question as newline-delimited JSON: one
+// {"chunk":"..."} line per chunk, then {"done":true,"answer":"..."}, or an
+// {"error":"..."} line if generation fails part way. It takes the same
+// request and ?chunk= param as /ask/stream.
+func (app *App) askNDJSONHandler(w http.ResponseWriter, r *http.Request) {
+	app.serveStream(w, r, "application/x-ndjson", func(w http.ResponseWriter) eventStream {
+		return newNDJSONStream(w)
+	})
+}
+
+// ndjsonStream writes stream events as one JSON object per line
+type ndjsonStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	mu sync.Mutex
+}
+
+// newNDJSONStream prepares w for a long-lived NDJSON stream
+func newNDJSONStream(w http.ResponseWriter) *ndjsonStream {
+	return &ndjsonStream{w: w, rc: newStreamController(w)}
+}
+
+// send writes an event as a single JSON line and flushes it
+func (s *ndjsonStream) send(event string, payload interface{}) error {
+	switch p := payload.(type) {
+	case AskResponse:
+		payload = NDJSONDone{Done: true, Answer: p.Answer, RequestID: p.RequestID}
+	case ErrorResponse:
+		payload = NDJSONError{Error: p.Error, Shutdown: event == "shutdown"}
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := fmt.Fprintf(s.w, "%s\n", data); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Question normalization steps, named as in QUESTION_NORMALIZATION
+const (
+	normalizeLowercase          = "lowercase"
+	normalizeTrim               = "trim"
+	normalizeCollapseWhitespace = "collapse_whitespace"
+	normalizeStripPunctuation   = "strip_punctuation"
+	normalizeFoldAccents        = "fold_accents"
+)
+
+// normalizeSteps maps each step name to what it does
+var normalizeSteps = map[string]func(string) string{
+	normalizeLowercase: strings.ToLower,
+	normalizeTrim:      strings.TrimSpace,
+	normalizeCollapseWhitespace: func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	},
+	normalizeStripPunctuation: func(s string) string {
+		return strings.TrimRightFunc(s, func(r rune) bool {
+			return unicode.IsPunct(r) || unicode.IsSpace(r)
+		})
+	},
+	normalizeFoldAccents: foldAccents,
+}
+
+// questionNormalizer reduces questions to a canonical form, so the features
+// matching one question against another, the answer cache and idempotency
+// retries, agree on which ones are the same. Steps run in the configured
+// order.
+type questionNormalizer struct {
+	steps []func(string) string
+}
+
+// newQuestionNormalizer creates a normalizer running the named steps in order
+func newQuestionNormalizer(names []string) (*questionNormalizer, error) {
+	n := &questionNormalizer{}
+	for _, name := range names {
+		step, ok := normalizeSteps[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown question normalization step %q", name)
+		}
+		n.steps = append(n.steps, step)
+	}
+	return n, nil
+}
+
+// normalizeQuestion returns the canonical form of a question
+func (n *questionNormalizer) normalizeQuestion(question string) string {
+	for _, step := range n.steps {
+		question = step(question)
+	}
+	return question
+}
+
+// accentFolds maps accented Latin letters to their base letter
+var accentFolds = func() map[rune]rune {
+	groups := map[rune]string{
+		'a': "àáâãäåāăą", 'A': "ÀÁÂÃÄÅĀĂĄ",
+		'c': "çćĉċč", 'C': "ÇĆĈĊČ",
+		'd': "ďđ", 'D': "ĎĐ",
+		'e': "èéêëēĕėęě", 'E': "ÈÉÊËĒĔĖĘĚ",
+		'g': "ĝğġģ", 'G': "ĜĞĠĢ",
+		'h': "ĥħ", 'H': "ĤĦ",
+		'i': "ìíîïĩīĭįı", 'I': "ÌÍÎÏĨĪĬĮİ",
+		'j': "ĵ", 'J': "Ĵ",
+		'k': "ķ", 'K': "Ķ",
+		'l': "ĺļľŀł", 'L': "ĹĻĽĿŁ",
+		'n': "ñńņňŉ", 'N': "ÑŃŅŇ",
+		'o': "òóôõöøōŏő", 'O': "ÒÓÔÕÖØŌŎŐ",
+		'r': "ŕŗř", 'R': "ŔŖŘ",
+		's': "śŝşš", 'S': "ŚŜŞŠ",
+		't': "ţťŧ", 'T': "ŢŤŦ",
+		'u': "ùúûüũūŭůűų", 'U': "ÙÚÛÜŨŪŬŮŰŲ",
+		'w': "ŵ", 'W': "Ŵ",
+		'y': "ýÿŷ", 'Y': "ÝŸŶ",
+		'z': "źżž", 'Z': "ŹŻŽ",
+	}
+
+	folds := make(map[rune]rune)
+	for base, accented := range groups {
+		for _, r := range accented {
+			folds[r] = base
+		}
+	}
+	return folds
+}()
+
+// foldAccents replaces accented Latin letters with their base letter, so
+// "¿Qué será?" and "¿Que sera?" normalize alike
+func foldAccents(s string) string {
+	return strings.Map(func(r rune) rune {
+		if base, ok := accentFolds[r]; ok {
+			return base
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestNormalizeSteps(t *testing.T) {
+	tests := []struct {
+		step     string
+		question string
+		want     string
+	}{
+		{step: normalizeLowercase, question: "Will It RAIN?", want: "will it rain?"},
+		{step: normalizeTrim, question: "  Will it rain? \n", want: "Will it rain?"},
+		{step: normalizeCollapseWhitespace, question: " Will \t it\n\nrain? ", want: "Will it rain?"},
+		{step: normalizeStripPunctuation, question: "Will it rain?!? ", want: "Will it rain"},
+		{step: normalizeStripPunctuation, question: "Is 3.5 enough?", want: "Is 3.5 enough"},
+		{step: normalizeFoldAccents, question: "¿Qué será, señor?", want: "¿Que sera, senor?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			n, err := newQuestionNormalizer([]string{tt.step})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := n.normalizeQuestion(tt.question); got != tt.want {
+				t.Errorf("normalizeQuestion(%q) = %q, want %q", tt.question, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeComposition(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []string
+		a, b  string
+		same  bool
+	}{
+		{
+			name:  "default steps",
+			steps: []string{normalizeLowercase, normalizeTrim, normalizeCollapseWhitespace},
+			a:     "Will it   rain?",
+			b:     " will IT rain? ",
+			same:  true,
+		},
+		{
+			name:  "default steps keep punctuation",
+			steps: []string{normalizeLowercase, normalizeTrim, normalizeCollapseWhitespace},
+			a:     "Will it rain?",
+			b:     "Will it rain",
+		},
+		{
+			name:  "every step",
+			steps: []string{normalizeLowercase, normalizeTrim, normalizeCollapseWhitespace, normalizeStripPunctuation, normalizeFoldAccents},
+			a:     "  ¿QUÉ   será? ",
+			b:     "¿que sera",
+			same:  true,
+		},
+		{
+			name: "no steps",
+			a:    "Will it rain?",
+			b:    "will it rain?",
+			same: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := newQuestionNormalizer(tt.steps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, b := n.normalizeQuestion(tt.a), n.normalizeQuestion(tt.b)
+			if (a == b) != tt.same {
+				t.Errorf("%q and %q normalize to %q and %q, want same = %v", tt.a, tt.b, a, b, tt.same)
+			}
+		})
+	}
+}
+
+func TestNormalizeUnknownStep(t *testing.T) {
+	if _, err := newQuestionNormalizer([]string{normalizeTrim, "stem"}); err == nil {
+		t.Error("unknown step accepted")
+	}
+}
@@ -4,110 +4,825 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// fallbackAnswer is given when the spirits (Ollama) cannot produce an answer
+const fallbackAnswer = "The spirits cannot answer at this time. Try again later."
+
+// goodbyeAnswer is the board's reply to farewells, see DETERMINISTIC_GOODBYE
+const goodbyeAnswer = "Goodbye."
+
+// dryRunAnswer is every answer in DRY_RUN mode
+const dryRunAnswer = "The spirits are only rehearsing."
+
+// modelMissingAnswer is given when the configured model isn't pulled
+const modelMissingAnswer = "The board cannot find its voice."
+
+// ErrModelNotFound is returned when Ollama does not have the requested model
+var ErrModelNotFound = errors.New("ollama model not found")
+
+// ErrOllamaUnreachable is returned when Ollama cannot be connected to, or the
+// connection fails part way through a response
+var ErrOllamaUnreachable = errors.New("ollama unreachable")
+
+// ErrOllamaTimeout is returned when Ollama doesn't answer within OLLAMA_TIMEOUT
+var ErrOllamaTimeout = errors.New("ollama timed out")
+
+// ErrOllamaStatus is returned for unexpected, non-200 Ollama responses
+var ErrOllamaStatus = errors.New("unexpected ollama status")
+
+// ErrEmptyResponse is returned when Ollama produces no answer text
+var ErrEmptyResponse = errors.New("empty response from ollama")
+
+// ErrInvalidStructuredAnswer is returned when a JSON-format answer doesn't match StructuredAnswer
+var ErrInvalidStructuredAnswer = errors.New("invalid structured answer")
+
+// structuredPromptSuffix asks the model for the StructuredAnswer shape
+const structuredPromptSuffix = ` Respond only with a JSON object of the form {"answer": "<your short answer>", "confidence": <number from 0 to 1>}.`
+
+// structuredMinTokens is the minimum num_predict for JSON-format answers
+const structuredMinTokens = 64
+
+// ErrFirstByteTimeout is returned when Ollama sends nothing within
+// OLLAMA_FIRST_BYTE_TIMEOUT. It is also an ErrOllamaTimeout.
+var ErrFirstByteTimeout = fmt.Errorf("%w waiting for the first byte", ErrOllamaTimeout)
+
+// ErrPromptTooLarge is returned when a composed prompt exceeds MAX_PROMPT_TOKENS
+var ErrPromptTooLarge = errors.New("prompt exceeds token budget")
+
+const (
+	// maxRegenerationsCap bounds MIN_ANSWER_RETRIES regardless of configuration
+	maxRegenerationsCap = 5
+	// baseTemperature approximates Ollama's default, raised by temperatureStep
+	// on each regeneration of a too-short answer
+	baseTemperature = 0.8
+	temperatureStep = 0.1
 )
 
 // OllamaClient handles communication with the Ollama API
 type OllamaClient struct {
-	url       string
-	model     string
-	timeout   time.Duration
-	maxTokens int
-	client    *http.Client
+	url           string
+	model         string
+	timeout       time.Duration
+	maxTokens     int
+	stripPrefixes []string
+	prompts       atomic.Pointer[promptSet]
+	answerSuffix  *template.Template
+	// modelTokens overrides maxTokens by model name, see OLLAMA_MODEL_TOKENS
+	modelTokens map[string]int
+	// cache holds previous answers, nil when caching is disabled
+	cache *answerCache
+	// firstByteTimeout bounds the wait for the first streamed line, 0 for none
+	firstByteTimeout time.Duration
+	// maxPromptTokens is the estimated token budget for a prompt, 0 for no limit
+	maxPromptTokens int
+	// Answers shorter than minAnswerLength runes are regenerated up to maxRegenerations times
+	minAnswerLength  int
+	maxRegenerations int
+	// emptyAnswerRetries is how many times an empty answer is retried before the fallback
+	emptyAnswerRetries int
+	// rateLimitRetries is how many 429s with a Retry-After are waited out, 0 to fail at once
+	rateLimitRetries int
+	// answerHTML is how markup in answers is handled, see sanitizeAnswerHTML
+	answerHTML string
+	// overload backs off from Ollama after 503 responses
+	overload *overloadBreaker
+	// guard fences questions off in the prompt, nil when PROMPT_GUARD is off
+	guard *questionGuard
+	// farewell matches farewell questions, nil when DETERMINISTIC_GOODBYE is off
+	farewell *regexp.Regexp
+	// variation picks a mood and temperature per question, nil when off
+	variation *answerVariation
+	// normalizer decides which questions share a cache entry
+	normalizer *questionNormalizer
+	// defaultPersonality is the BOARD_PERSONALITY preset, used unless a
+	// request asks for another
+	defaultPersonality string
+	// collapseSpaces tidies spacing in answers, see COLLAPSE_ANSWER_SPACES
+	collapseSpaces bool
+	// evals totals the token counts and timings Ollama reports
+	evals evalMetrics
+	// debug logs Ollama's timings for every answer, see DEBUG
+	debug bool
+	// stripEcho removes the question from the start of answers that repeat
+	// it, see STRIP_QUESTION_ECHO
+	stripEcho bool
+	// confidence asks for and parses a confidence marker, see ANSWER_CONFIDENCE
+	confidence bool
+	// rng picks the confidence of answers without a marker
+	rng *lockedRand
+	// dryRun logs prompts and answers dryRunAnswer without calling Ollama
+	dryRun bool
+	// filter masks or regenerates answers with unwanted words, nil when off
+	filter *answerFilter
+	// Generations taking longer than slowThreshold are logged and counted
+	// in slowGenerations; 0 disables the check
+	slowThreshold   time.Duration
+	slowGenerations atomic.Int64
+	// followUps feeds each session's last Ollama context into its next
+	// question, dropping contexts longer than maxFollowUpContext tokens
+	followUps          bool
+	maxFollowUpContext int
+	client             *http.Client
 }
 
 // OllamaRequest represents the request payload to Ollama API
 type OllamaRequest struct {
-	Model  string        `json:"model"`
-	Prompt string        `json:"prompt"`
-	Stream bool          `json:"stream"`
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+	Stream bool   `json:"stream"`
+	// Format is "json" to force Ollama to produce valid JSON
+	Format  string        `json:"format,omitempty"`
 	Options OllamaOptions `json:"options"`
+	// Context continues an earlier conversation, see OLLAMA_FOLLOW_UPS
+	Context []int `json:"context,omitempty"`
+}
+
+// StructuredAnswer is a JSON-format answer from the model
+type StructuredAnswer struct {
+	Answer     string  `json:"answer"`
+	Confidence float64 `json:"confidence"`
 }
 
 // OllamaOptions contains generation options
 type OllamaOptions struct {
-	NumPredict int `json:"num_predict"`
+	NumPredict  int      `json:"num_predict"`
+	Temperature *float64 `json:"temperature,omitempty"`
+}
+
+// OllamaErrorResponse represents an error body returned by the Ollama API
+type OllamaErrorResponse struct {
+	Error string `json:"error"`
 }
 
 // OllamaResponse represents a single line of the streaming response
 type OllamaResponse struct {
 	Response string `json:"response"`
 	Done     bool   `json:"done"`
+	// Context encodes the conversation so far, sent with the final line
+	Context []int `json:"context,omitempty"`
+	// Token counts and timings, in nanoseconds, sent with the final line
+	TotalDuration      int64 `json:"total_duration,omitempty"`
+	LoadDuration       int64 `json:"load_duration,omitempty"`
+	PromptEvalCount    int64 `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64 `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int64 `json:"eval_count,omitempty"`
+	EvalDuration       int64 `json:"eval_duration,omitempty"`
 }
 
-// NewOllamaClient creates a new Ollama client
-func NewOllamaClient(url, model string, timeout time.Duration, maxTokens int) *OllamaClient {
-	return &OllamaClient{
-		url:       url,
-		model:     model,
-		timeout:   timeout,
-		maxTokens: maxTokens,
+// parseModelTokens parses OLLAMA_MODEL_TOKENS entries into num_predict
+// values by model name
+func parseModelTokens(entries map[string]string) (map[string]int, error) {
+	tokens := make(map[string]int, len(entries))
+	for model, value := range entries {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid OLLAMA_MODEL_TOKENS value %q for %q, expected a positive number", value, model)
+		}
+		tokens[model] = n
+	}
+	return tokens, nil
+}
+
+// NewOllamaClient creates a new Ollama client from the application config.
+// It fails if any configured prompt template cannot be loaded.
+func NewOllamaClient(config *Config) (*OllamaClient, error) {
+	prompts, err := loadPromptSet(config.PromptTemplateFile, config.ModelPromptTemplates)
+	if err != nil {
+		return nil, err
+	}
+
+	modelTokens, err := parseModelTokens(config.OllamaModelTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	var answerSuffix *template.Template
+	if config.AnswerSuffix != "" {
+		answerSuffix, err = template.New("suffix").Option("missingkey=error").Parse(config.AnswerSuffix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ANSWER_SUFFIX: %w", err)
+		}
+	}
+
+	if !validAnswerHTMLMode(config.EscapeAnswerHTML) {
+		return nil, fmt.Errorf("invalid ESCAPE_ANSWER_HTML %q, expected off, escape or strip", config.EscapeAnswerHTML)
+	}
+
+	var guard *questionGuard
+	if config.PromptGuard {
+		guard, err = newQuestionGuard(config.QuestionDelimiters)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var farewell *regexp.Regexp
+	if config.DeterministicGoodbye {
+		farewell, err = farewellPattern(config.FarewellKeywords)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	normalizer, err := newQuestionNormalizer(config.QuestionNormalization)
+	if err != nil {
+		return nil, err
+	}
+
+	if !validPersonality(config.BoardPersonality) {
+		return nil, fmt.Errorf("unknown BOARD_PERSONALITY %q, expected one of %v", config.BoardPersonality, personalityNames())
+	}
+
+	filter, err := newAnswerFilter(config.AnswerFilter, config.AnswerFilterWords)
+	if err != nil {
+		return nil, err
+	}
+
+	var cache *answerCache
+	if config.AnswerCacheSize > 0 || config.CacheMaxBytes > 0 {
+		cache = newAnswerCache(config.AnswerCacheSize, config.CacheMaxBytes)
+	}
+
+	client := &OllamaClient{
+		url:                config.OllamaURL,
+		model:              config.OllamaModel,
+		timeout:            config.OllamaTimeout,
+		maxTokens:          config.MaxTokens,
+		modelTokens:        modelTokens,
+		stripPrefixes:      config.StripPrefixes,
+		answerSuffix:       answerSuffix,
+		cache:              cache,
+		firstByteTimeout:   config.OllamaFirstByteTimeout,
+		maxPromptTokens:    config.MaxPromptTokens,
+		minAnswerLength:    config.MinAnswerLength,
+		maxRegenerations:   min(max(config.MinAnswerRetries, 0), maxRegenerationsCap),
+		emptyAnswerRetries: min(max(config.EmptyAnswerRetries, 0), maxRegenerationsCap),
+		rateLimitRetries:   min(max(config.RateLimitRetries, 0), maxRegenerationsCap),
+		answerHTML:         config.EscapeAnswerHTML,
+		overload:           newOverloadBreaker(),
+		guard:              guard,
+		farewell:           farewell,
+		normalizer:         normalizer,
+		filter:             filter,
+		dryRun:             config.DryRun,
+		confidence:         config.AnswerConfidence,
+		stripEcho:          config.StripQuestionEcho,
+		debug:              config.Debug,
+		slowThreshold:      config.SlowGenerationThreshold,
+		defaultPersonality: config.BoardPersonality,
+		collapseSpaces:     config.CollapseAnswerSpaces,
+		followUps:          config.OllamaFollowUps,
+		maxFollowUpContext: config.OllamaFollowUpMaxContext,
+		variation:          newAnswerVariation(config.AnswerMoods, config.TemperatureJitter, config.VariationSeed),
+		rng:                newLockedRand(config.VariationSeed),
 		client: &http.Client{
-			Timeout: timeout,
+			Timeout: config.OllamaTimeout,
 		},
 	}
+	client.prompts.Store(prompts)
+	return client, nil
 }
 
-// GenerateAnswer generates an answer using the Ollama API
-func (c *OllamaClient) GenerateAnswer(ctx context.Context, question string) (string, error) {
+// RetryAfter returns how long clients should wait while Ollama is overloaded
+func (c *OllamaClient) RetryAfter() time.Duration {
+	return c.overload.RetryAfter()
+}
+
+// CacheStats reports the answer cache's size; ok is false when caching is disabled
+func (c *OllamaClient) CacheStats() (stats CacheStats, ok bool) {
+	if c.cache == nil {
+		return CacheStats{}, false
+	}
+	return c.cache.Stats(), true
+}
+
+// SlowGenerations reports how many generations exceeded
+// SLOW_GENERATION_THRESHOLD; ok is false when the check is disabled
+func (c *OllamaClient) SlowGenerations() (count int64, ok bool) {
+	if c.slowThreshold <= 0 {
+		return 0, false
+	}
+	return c.slowGenerations.Load(), true
+}
+
+// checkSlow logs and counts a generation of question for ctx that started
+// at start, if it took longer than the slow threshold
+func (c *OllamaClient) checkSlow(ctx context.Context, question string, start time.Time) {
+	if c.slowThreshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > c.slowThreshold {
+		c.slowGenerations.Add(1)
+		log.Printf("Warning: slow generation model=%q question_length=%d duration=%v threshold=%v",
+			c.modelFor(ctx), utf8.RuneCountInString(question), elapsed.Round(time.Millisecond), c.slowThreshold)
+	}
+}
+
+// EvalStats reports the token counts and timings Ollama has reported
+func (c *OllamaClient) EvalStats() (EvalStats, bool) {
+	return c.evals.stats(), true
+}
+
+// recordEval records the counts and timings from model's final response line
+func (c *OllamaClient) recordEval(resp OllamaResponse, model string) {
+	// Loading the model for Warmup evaluates nothing
+	if resp.EvalCount == 0 {
+		return
+	}
+
+	tokensPerSecond := c.evals.observe(resp)
+	if c.debug {
+		log.Printf("Debug: ollama eval model=%q prompt_eval_count=%d prompt_eval_duration=%v eval_count=%d eval_duration=%v load_duration=%v total_duration=%v tokens_per_second=%.1f",
+			model, resp.PromptEvalCount, time.Duration(resp.PromptEvalDuration), resp.EvalCount, time.Duration(resp.EvalDuration),
+			time.Duration(resp.LoadDuration), time.Duration(resp.TotalDuration), tokensPerSecond)
+	}
+}
+
+// personality returns the personality preset to answer ctx in
+func (c *OllamaClient) personality(ctx context.Context) string {
+	if name := personalityFromContext(ctx); name != "" {
+		return name
+	}
+	return c.defaultPersonality
+}
+
+// modelFor returns the model to answer ctx with
+func (c *OllamaClient) modelFor(ctx context.Context) string {
+	if name := modelFromContext(ctx); name != "" {
+		return name
+	}
+	return c.model
+}
+
+// SetPrompts swaps in a new set of prompt templates
+func (c *OllamaClient) SetPrompts(prompts *promptSet) {
+	c.prompts.Store(prompts)
+}
+
+// buildPrompt validates and sanitizes a question and renders it into a
+// prompt in the personality requested for ctx
+func (c *OllamaClient) buildPrompt(ctx context.Context, question string) (string, error) {
 	// Validate input
-	if len(question) > 1000 {
+	if len(question) > maxQuestionLength {
 		return "", errors.New("question too long")
 	}
 
-	// Sanitize question
+	// Sanitize question and fence it off from the instructions
 	question = sanitizeInput(question)
+	if c.guard != nil {
+		question = c.guard.wrap(question)
+	}
 
-	// Create mystical prompt
-	prompt := fmt.Sprintf(
-		"Pretend that you are a Ouija board. As a mystical Ouija board, answer the following question in a short answer. "+
-			"Respond without using any actions, such as *smiles*, *laughs*, or any text within asterisks. "+
-			"If the question is a yes or no question, answer with a yes or a no. "+
-			"If the user says goodbye, bye, or farewell, respond with 'Goodbye.' Question: %s",
-		question,
-	)
-
-	// Create request payload
-	reqPayload := OllamaRequest{
-		Model:  c.model,
-		Prompt: prompt,
-		Stream: true,
-		Options: OllamaOptions{
-			NumPredict: c.maxTokens,
-		},
+	// Create mystical prompt from the template for this model
+	prompt, err := c.prompts.Load().Render(c.modelFor(ctx), c.personality(ctx), question)
+	if err != nil {
+		return "", err
+	}
+	if mood := c.variation.moodInstruction(); mood != "" {
+		prompt += "\n" + mood
+	}
+	if c.guard != nil {
+		prompt += "\n" + c.guard.instruction()
+	}
+
+	// Refuse prompts that would overflow the model's context window and
+	// produce garbage. Earlier turns are trimmed by fitConversation, but a
+	// question that doesn't fit on its own can only be rejected.
+	if c.maxPromptTokens > 0 {
+		if tokens := estimateTokens(prompt); tokens > c.maxPromptTokens {
+			log.Printf("Warning: prompt of ~%d tokens exceeds MAX_PROMPT_TOKENS (%d)", tokens, c.maxPromptTokens)
+			return "", ErrPromptTooLarge
+		}
+	}
+
+	return prompt, nil
+}
+
+// fitConversation trims the oldest tokens of a follow-up's conversation
+// context so that it and prompt stay within MAX_PROMPT_TOKENS, keeping the
+// most recent turns
+func (c *OllamaClient) fitConversation(prompt string, conversation []int) []int {
+	if c.maxPromptTokens <= 0 || conversation == nil {
+		return conversation
+	}
+
+	budget := max(c.maxPromptTokens-estimateTokens(prompt), 0)
+	if len(conversation) <= budget {
+		return conversation
+	}
+	log.Printf("Trimming follow-up context from %d to %d tokens to fit MAX_PROMPT_TOKENS (%d)", len(conversation), budget, c.maxPromptTokens)
+	return conversation[len(conversation)-budget:]
+}
+
+// estimateTokens roughly estimates the token count of text, assuming about
+// four characters per token as is typical for English with common tokenizers
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// GenerateAnswer generates an answer using the Ollama API. Failures are
+// returned as the typed errors above (ErrOllamaUnreachable, ErrOllamaTimeout,
+// ErrModelNotFound, ErrEmptyResponse, ...) so callers can decide whether to
+// fall back, retry or report them.
+func (c *OllamaClient) GenerateAnswer(ctx context.Context, question string) (string, error) {
+	prompt, err := c.buildPrompt(ctx, question)
+	if err != nil {
+		return "", err
+	}
+
+	// Dry runs exercise everything but the model
+	if c.dryRun {
+		log.Printf("Dry run prompt: %q", prompt)
+		return c.appendSuffix(ctx, dryRunAnswer), nil
+	}
+
+	// Farewells get the board's goodbye without asking the model
+	if c.isFarewell(question) {
+		return c.appendSuffix(ctx, goodbyeAnswer), nil
+	}
+
+	if c.confidence {
+		prompt += "\n" + confidenceInstruction
+	}
+
+	// Serve repeated questions to the same model from the cache
+	// A follow-up depends on what came before, so it is never answered
+	// from or added to the cache
+	session, conversation := c.conversation(ctx)
+	useCache := c.cache != nil && !cacheBypassed(ctx) && conversation == nil
+	conversation = c.fitConversation(prompt, conversation)
+	cacheKey := answerCacheKey(c.normalizer.normalizeQuestion(sanitizeInput(question)), c.modelFor(ctx), c.personality(ctx))
+	if useCache {
+		if cached, ok := c.cache.Get(cacheKey); ok {
+			if c.confidence {
+				var confidence int
+				cached, confidence = extractConfidence(cached, c.rng)
+				reportConfidence(ctx, confidence)
+			}
+			return c.appendSuffix(ctx, cached), nil
+		}
+	}
+
+	// Only time spent on the model counts towards the slow threshold, so
+	// the clock starts after the cache
+	defer c.checkSlow(ctx, question, time.Now())
+
+	// All attempts share the Ollama timeout, so retries can't stretch a
+	// request past it
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	// Generate, retrying empty answers as they are and regenerating short
+	// answers with a slightly higher temperature. Filtered answers are
+	// regenerated once, if ANSWER_FILTER asks for it.
+	var result string
+	var resultContext []int
+	var resultConfidence int
+	regenerations, emptyRetries := 0, 0
+	filterRetried := false
+	offset := c.variation.temperatureOffset()
+	for {
+		options := OllamaOptions{NumPredict: c.numPredict(c.modelFor(ctx))}
+		if regenerations > 0 || offset != 0 {
+			temperature := max(baseTemperature+offset+temperatureStep*float64(regenerations), 0)
+			options.Temperature = &temperature
+		}
+
+		text, nextContext, err := c.generateWithRetryAfter(ctx, OllamaRequest{Prompt: prompt, Options: options, Context: conversation}, nil)
+		if err != nil {
+			if result == "" {
+				return "", err
+			}
+			// Keep a short answer from an earlier attempt over the error
+			break
+		}
+
+		confidence := 0
+		if c.confidence {
+			text, confidence = extractConfidence(text, c.rng)
+		}
+		if c.stripEcho {
+			text = stripQuestionEcho(strings.TrimSpace(text), question)
+		}
+		answer := c.postProcess(text)
+		if answer == "" {
+			// Some models occasionally return nothing at all, which is
+			// usually transient
+			if emptyRetries >= c.emptyAnswerRetries || ctx.Err() != nil {
+				break
+			}
+			emptyRetries++
+			log.Printf("Empty answer from Ollama, retrying (%d/%d)", emptyRetries, c.emptyAnswerRetries)
+			continue
+		}
+		result, resultContext, resultConfidence = answer, nextContext, confidence
+
+		if c.filter.regenerates() && !filterRetried && c.filter.matches(result) && ctx.Err() == nil {
+			filterRetried = true
+			log.Printf("Answer matched ANSWER_FILTER, regenerating")
+			continue
+		}
+
+		if utf8.RuneCountInString(result) >= c.minAnswerLength || regenerations >= c.maxRegenerations || ctx.Err() != nil {
+			break
+		}
+		regenerations++
+	}
+
+	if result == "" {
+		return "", ErrEmptyResponse
+	}
+	c.remember(session, resultContext)
+	result = c.filter.mask(result)
+
+	// Only genuine model answers are cached
+	cached := result
+	if c.confidence {
+		reportConfidence(ctx, resultConfidence)
+		cached = withConfidence(result, resultConfidence)
+	}
+	if useCache {
+		c.cache.Put(cacheKey, cached)
+	}
+
+	return c.appendSuffix(ctx, result), nil
+}
+
+// StreamAnswer generates an answer, passing each chunk to onChunk as it
+// arrives. An error is returned if generation fails part way or produces
+// nothing, so callers can tell a broken stream from a completed one. The
+// returned answer has filler prefixes stripped and the suffix applied.
+// Chunks are sanitized per ESCAPE_ANSWER_HTML and filtered words masked
+// before onChunk sees them.
+func (c *OllamaClient) StreamAnswer(ctx context.Context, question string, onChunk func(string) error) (string, error) {
+	prompt, err := c.buildPrompt(ctx, question)
+	if err != nil {
+		return "", err
+	}
+
+	if c.dryRun {
+		log.Printf("Dry run prompt: %q", prompt)
+		if err := onChunk(dryRunAnswer); err != nil {
+			return "", err
+		}
+		return c.appendSuffix(ctx, dryRunAnswer), nil
 	}
 
+	if c.isFarewell(question) {
+		if err := onChunk(goodbyeAnswer); err != nil {
+			return "", err
+		}
+		return c.appendSuffix(ctx, goodbyeAnswer), nil
+	}
+
+	options := OllamaOptions{NumPredict: c.numPredict(c.modelFor(ctx))}
+	if offset := c.variation.temperatureOffset(); offset != 0 {
+		temperature := max(baseTemperature+offset, 0)
+		options.Temperature = &temperature
+	}
+
+	session, conversation := c.conversation(ctx)
+	conversation = c.fitConversation(prompt, conversation)
+
+	// A stream's time includes waiting on its client, so a slow reader can
+	// make a generation count as slow
+	defer c.checkSlow(ctx, question, time.Now())
+
+	stream := c.newAnswerStream(question, onChunk)
+	text, nextContext, err := c.generateWithRetryAfter(ctx, OllamaRequest{Prompt: prompt, Options: options, Context: conversation}, stream.write)
+	if err != nil {
+		return "", err
+	}
+
+	if c.stripEcho {
+		text = stripQuestionEcho(strings.TrimSpace(text), question)
+	}
+	result := c.postProcess(text)
+	if result == "" {
+		return "", ErrEmptyResponse
+	}
+	if err := stream.flush(); err != nil {
+		return "", err
+	}
+	c.remember(session, nextContext)
+
+	// What was streamed can't be taken back, so streams are only masked
+	result = c.filter.mask(result)
+	return c.appendSuffix(ctx, result), nil
+}
+
+// GenerateStructuredAnswer asks Ollama for a JSON answer with a confidence
+// score, using Ollama's JSON format mode, and validates the result
+func (c *OllamaClient) GenerateStructuredAnswer(ctx context.Context, question string) (StructuredAnswer, error) {
+	prompt, err := c.buildPrompt(ctx, question)
+	if err != nil {
+		return StructuredAnswer{}, err
+	}
+	prompt += structuredPromptSuffix
+
+	if c.dryRun {
+		log.Printf("Dry run prompt: %q", prompt)
+		return StructuredAnswer{Answer: c.appendSuffix(ctx, dryRunAnswer), Confidence: 1}, nil
+	}
+
+	defer c.checkSlow(ctx, question, time.Now())
+
+	// JSON needs more room than the short free-text answers
+	text, _, err := c.generate(ctx, OllamaRequest{
+		Prompt:  prompt,
+		Format:  "json",
+		Options: OllamaOptions{NumPredict: max(c.numPredict(c.modelFor(ctx)), structuredMinTokens)},
+	}, nil)
+	if err != nil {
+		return StructuredAnswer{}, err
+	}
+
+	var answer StructuredAnswer
+	if err := json.Unmarshal([]byte(text), &answer); err != nil {
+		return StructuredAnswer{}, fmt.Errorf("%w: %v", ErrInvalidStructuredAnswer, err)
+	}
+
+	answer.Answer = c.postProcess(answer.Answer)
+	if answer.Answer == "" {
+		return StructuredAnswer{}, fmt.Errorf("%w: missing answer", ErrInvalidStructuredAnswer)
+	}
+	answer.Confidence = min(max(answer.Confidence, 0), 1)
+	answer.Answer = c.appendSuffix(ctx, c.filter.mask(answer.Answer))
+
+	return answer, nil
+}
+
+// conversation returns the session asking and, with OLLAMA_FOLLOW_UPS on,
+// the Ollama context its last answer left; nil starts a fresh conversation
+func (c *OllamaClient) conversation(ctx context.Context) (*Session, []int) {
+	if !c.followUps {
+		return nil, nil
+	}
+	session := sessionFromContext(ctx)
+	if session == nil {
+		return nil, nil
+	}
+	return session, session.OllamaContext()
+}
+
+// remember keeps the context of a session's latest answer for its next
+// question. Contexts longer than maxFollowUpContext are dropped, so the
+// next question starts afresh rather than the context growing without bound.
+func (c *OllamaClient) remember(session *Session, conversation []int) {
+	if session == nil {
+		return
+	}
+	if len(conversation) > c.maxFollowUpContext {
+		conversation = nil
+	}
+	session.SetOllamaContext(conversation)
+}
+
+// Warmup asks Ollama to load the model, without generating anything, so the
+// first question doesn't pay for it. It is bounded by OLLAMA_TIMEOUT.
+func (c *OllamaClient) Warmup(ctx context.Context) error {
+	if c.dryRun {
+		return nil
+	}
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	// An empty prompt only loads the model
+	_, _, err := c.generate(ctx, OllamaRequest{}, nil)
+	return err
+}
+
+// generateWithRetryAfter calls generate, waiting out up to rateLimitRetries
+// 429 responses for as long as their Retry-After asks, within ctx's deadline
+func (c *OllamaClient) generateWithRetryAfter(ctx context.Context, reqPayload OllamaRequest, onChunk func(string) error) (string, []int, error) {
+	for attempt := 0; ; attempt++ {
+		text, conversation, err := c.generate(ctx, reqPayload, onChunk)
+		if err == nil || attempt >= c.rateLimitRetries {
+			return text, conversation, err
+		}
+
+		wait, ok := rateLimitWait(ctx, err)
+		if !ok {
+			return text, conversation, err
+		}
+		log.Printf("Ollama is rate limiting, retrying in %v (%d/%d)", wait, attempt+1, c.rateLimitRetries)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return "", nil, transportError(ctx, ctx.Err())
+		}
+	}
+}
+
+// numPredict returns the num_predict to ask model for: its
+// OLLAMA_MODEL_TOKENS entry, by full name or without its :tag, or else
+// MAX_TOKENS. An entry for llama3 thus covers llama3:8b too.
+func (c *OllamaClient) numPredict(model string) int {
+	if n, ok := c.modelTokens[model]; ok {
+		return n
+	}
+	if family, _, ok := strings.Cut(model, ":"); ok {
+		if n, ok := c.modelTokens[family]; ok {
+			return n
+		}
+	}
+	return c.maxTokens
+}
+
+// generate sends a single prompt to Ollama and returns the raw streamed text
+// and the conversation context from the final line.
+// The streaming field of reqPayload is filled in here, and the model if it
+// isn't set. If onChunk is set it is called with each chunk; an error from
+// it aborts.
+func (c *OllamaClient) generate(ctx context.Context, reqPayload OllamaRequest, onChunk func(string) error) (string, []int, error) {
+	// Complete request payload
+	if reqPayload.Model == "" {
+		reqPayload.Model = c.modelFor(ctx)
+	}
+	reqPayload.Stream = true
+
 	jsonData, err := json.Marshal(reqPayload)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %w", err)
+		return "", nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	// Give up early if Ollama doesn't start streaming within the first-byte
+	// timeout, separately from the overall timeout, to tell "slow" from "hung"
+	var firstByteTimer *time.Timer
+	var firstByteTimedOut atomic.Bool
+	if c.firstByteTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+
+		firstByteTimer = time.AfterFunc(c.firstByteTimeout, func() {
+			firstByteTimedOut.Store(true)
+			cancel()
+		})
+		defer firstByteTimer.Stop()
+	}
+
+	// Don't add to the load while backing off from an overloaded Ollama
+	if !c.overload.allow() {
+		return "", nil, fmt.Errorf("%w: backing off", ErrOllamaOverloaded)
 	}
 
 	// Create HTTP request with context
 	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return "", nil, fmt.Errorf("failed to create request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// Send request
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return "The spirits cannot answer at this time. Try again later.", nil
+		if firstByteTimedOut.Load() {
+			return "", nil, ErrFirstByteTimeout
+		}
+		return "", nil, transportError(ctx, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		c.overload.overloaded()
+	}
 	if resp.StatusCode != http.StatusOK {
-		return "The spirits cannot answer at this time. Try again later.", nil
+		return "", nil, statusError(resp, reqPayload.Model)
 	}
+	c.overload.recovered()
 
 	// Process streaming response
 	answer := strings.Builder{}
+	var conversation []int
 	scanner := bufio.NewScanner(resp.Body)
 
 	for scanner.Scan() {
@@ -116,6 +831,11 @@ func (c *OllamaClient) GenerateAnswer(ctx context.Context, question string) (str
 			continue
 		}
 
+		// The first line has arrived, the overall timeout applies from here
+		if firstByteTimer != nil {
+			firstByteTimer.Stop()
+		}
+
 		var ollamaResp OllamaResponse
 		if err := json.Unmarshal(line, &ollamaResp); err != nil {
 			// Skip malformed lines
@@ -124,21 +844,109 @@ func (c *OllamaClient) GenerateAnswer(ctx context.Context, question string) (str
 
 		answer.WriteString(ollamaResp.Response)
 
+		// Each streamed chunk is roughly one token
+		if ollamaResp.Response != "" {
+			addUsage(ctx, 1)
+		}
+
+		if onChunk != nil && ollamaResp.Response != "" {
+			if err := onChunk(ollamaResp.Response); err != nil {
+				return "", nil, err
+			}
+		}
+
 		if ollamaResp.Done {
+			conversation = ollamaResp.Context
+			c.recordEval(ollamaResp, reqPayload.Model)
 			break
 		}
 	}
 
 	if err := scanner.Err(); err != nil && err != io.EOF {
-		return "The spirits cannot answer at this time. Try again later.", nil
+		if firstByteTimedOut.Load() && answer.Len() == 0 {
+			return "", nil, ErrFirstByteTimeout
+		}
+		return "", nil, transportError(ctx, err)
 	}
 
-	result := strings.TrimSpace(answer.String())
-	if result == "" {
-		return "The spirits cannot answer at this time. Try again later.", nil
+	return answer.String(), conversation, nil
+}
+
+// SuffixData is the data available to the ANSWER_SUFFIX template
+type SuffixData struct {
+	// SessionID identifies the session without revealing it: the session
+	// ID is a credential, so this is the start of its SHA-256 instead
+	SessionID string
+}
+
+// suffixSessionID returns the session identifier shown in answer suffixes,
+// the first 8 hex digits of the session ID's SHA-256, "" without a session
+func suffixSessionID(id string) string {
+	if id == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:4])
+}
+
+// appendSuffix adds the configured signature to a generated answer
+func (c *OllamaClient) appendSuffix(ctx context.Context, answer string) string {
+	if c.answerSuffix == nil {
+		return answer
+	}
+
+	var suffix strings.Builder
+	if err := c.answerSuffix.Execute(&suffix, SuffixData{SessionID: suffixSessionID(sessionIDFromContext(ctx))}); err != nil {
+		log.Printf("Error rendering answer suffix: %v", err)
+		return answer
+	}
+
+	if suffix.Len() == 0 {
+		return answer
+	}
+	return answer + " " + suffix.String()
+}
+
+// statusError turns a non-200 Ollama response for model into an error,
+// recognizing a missing model so operators know to pull it rather than
+// debugging blindly
+func statusError(resp *http.Response, model string) error {
+	var ollamaErr OllamaErrorResponse
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	_ = json.Unmarshal(body, &ollamaErr)
+
+	if resp.StatusCode == http.StatusNotFound && strings.Contains(strings.ToLower(ollamaErr.Error), "not found") {
+		log.Printf("ALERT: Ollama model %q is not available (%s); run 'ollama pull %s'", model, ollamaErr.Error, model)
+		return fmt.Errorf("%w: %s", ErrModelNotFound, model)
 	}
 
-	return result, nil
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return fmt.Errorf("%w: %s", ErrOllamaOverloaded, ollamaErr.Error)
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return &rateLimitedError{retryAfter: retryAfter, hasRetryAfter: ok}
+	}
+
+	if ollamaErr.Error != "" {
+		return fmt.Errorf("%w %d: %s", ErrOllamaStatus, resp.StatusCode, ollamaErr.Error)
+	}
+	return fmt.Errorf("%w %d", ErrOllamaStatus, resp.StatusCode)
+}
+
+// transportError classifies a failure to talk to Ollama as a timeout or as
+// Ollama being unreachable. Cancellation by the caller is passed through.
+func transportError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return ctx.Err()
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %v", ErrOllamaTimeout, err)
+	}
+	return fmt.Errorf("%w: %v", ErrOllamaUnreachable, err)
 }
 
 // sanitizeInput removes potentially dangerous characters from input
@@ -149,5 +957,152 @@ func sanitizeInput(input string) string {
 	// Replace null bytes
 	input = strings.ReplaceAll(input, "\x00", "")
 
-	return input
+	// Invalid UTF-8 would otherwise reach the prompt as raw bytes
+	return strings.ToValidUTF8(input, string(utf8.RuneError))
+}
+
+// postProcess cleans up raw model output: surrounding whitespace and filler
+// prefixes are removed, spacing left by joining tokens is tidied if
+// COLLAPSE_ANSWER_SPACES is on, then any HTML is handled per ESCAPE_ANSWER_HTML
+func (c *OllamaClient) postProcess(text string) string {
+	if c.collapseSpaces {
+		text = collapseSpaces(text)
+	}
+	answer := stripFillerPrefixes(strings.TrimSpace(text), c.stripPrefixes)
+	return sanitizeAnswerHTML(answer, c.answerHTML)
+}
+
+var (
+	// spaceRunPattern matches runs of spaces and tabs within a line
+	spaceRunPattern = regexp.MustCompile(`[ \t]{2,}`)
+	// lineEdgeSpacePattern matches spaces and tabs around a line break
+	lineEdgeSpacePattern = regexp.MustCompile(`[ \t]*\n[ \t]*`)
+)
+
+// collapseSpaces tidies the spacing left by concatenating model tokens, most
+// of which start with a space: runs of spaces become one and spaces around
+// line breaks are dropped. The line breaks themselves are kept.
+func collapseSpaces(text string) string {
+	text = lineEdgeSpacePattern.ReplaceAllString(text, "\n")
+	return spaceRunPattern.ReplaceAllString(text, " ")
+}
+
+// echoSeparators may follow a question the model echoed before its answer
+const echoSeparators = "?!.:;,-\u2013\u2014\"'\u201c\u201d\r\n"
+
+// stripQuestionEcho removes question from the start of answer when the
+// model repeats it before answering. Words are compared case-insensitively,
+// ignoring punctuation and spacing. The whole question must be echoed and
+// be followed by punctuation or a line break, so an answer that only starts
+// with the same words ("Love is near" for "Love?") is left alone, as is an
+// answer that is nothing but the echo.
+func stripQuestionEcho(answer, question string) string {
+	if n, decided := questionEcho(answer, question); decided {
+		return answer[n:]
+	}
+	return answer
+}
+
+// questionEcho returns how much of the start of answer is an echo of
+// question, per stripQuestionEcho, and whether that is decided. It isn't
+// while answer could still grow into an echo, or ends inside one, so a
+// stream can hold its start back until it is.
+func questionEcho(answer, question string) (int, bool) {
+	words := strings.FieldsFunc(question, isNotWordRune)
+	if len(words) == 0 {
+		return 0, true
+	}
+
+	rest := answer
+	for _, word := range words {
+		rest = strings.TrimLeftFunc(rest, isNotWordRune)
+		if len(rest) < len(word) {
+			// The answer may still go on to echo the word
+			return 0, !strings.HasPrefix(strings.ToLower(word), strings.ToLower(rest))
+		}
+		if !strings.EqualFold(rest[:len(word)], word) {
+			return 0, true
+		}
+		rest = rest[len(word):]
+		if rest == "" {
+			return 0, false
+		}
+		if next, _ := utf8.DecodeRuneInString(rest); !isNotWordRune(next) {
+			// Only part of a word matched
+			return 0, true
+		}
+	}
+
+	rest = strings.TrimLeft(rest, " \t")
+	if rest == "" {
+		return 0, false
+	}
+	if next, _ := utf8.DecodeRuneInString(rest); !strings.ContainsRune(echoSeparators, next) {
+		return 0, true
+	}
+	remainder := strings.TrimLeft(rest, echoSeparators+" \t")
+	if remainder == "" {
+		return 0, false
+	}
+	return len(answer) - len(remainder), true
+}
+
+// isNotWordRune reports whether r separates words
+func isNotWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// farewellPattern matches any of the keywords as whole words, case-insensitively
+func farewellPattern(keywords []string) (*regexp.Regexp, error) {
+	if len(keywords) == 0 {
+		return nil, errors.New("DETERMINISTIC_GOODBYE needs at least one FAREWELL_KEYWORDS entry")
+	}
+
+	quoted := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		quoted[i] = regexp.QuoteMeta(keyword)
+	}
+	return regexp.Compile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// isFarewell reports whether a question is a farewell the board answers itself
+func (c *OllamaClient) isFarewell(question string) bool {
+	return c.farewell != nil && c.farewell.MatchString(question)
+}
+
+// stripFillerPrefixes removes leading filler phrases such as "Sure, here's your
+// answer:" from an answer, case-insensitively, until none of them match
+func stripFillerPrefixes(answer string, prefixes []string) string {
+	for stripped := true; stripped; {
+		stripped = false
+		for _, prefix := range prefixes {
+			if len(answer) >= len(prefix) && strings.EqualFold(answer[:len(prefix)], prefix) {
+				answer = strings.TrimSpace(answer[len(prefix):])
+				stripped = true
+			}
+		}
+	}
+	return answer
+}
+
+// htmlTagPattern matches HTML tags and comments for ESCAPE_ANSWER_HTML=strip.
+// Script and style elements are removed with their contents.
+var htmlTagPattern = regexp.MustCompile(`(?is)<script\b.*?</script\s*>|<style\b.*?</style\s*>|<!--.*?-->|</?[a-z][^>]*>`)
+
+// validAnswerHTMLMode reports whether mode is a supported ESCAPE_ANSWER_HTML value
+func validAnswerHTMLMode(mode string) bool {
+	return mode == "off" || mode == "escape" || mode == "strip"
+}
+
+// sanitizeAnswerHTML makes an answer safe to render as HTML: "escape"
+// escapes markup, "strip" removes tags and "off" leaves the answer alone
+func sanitizeAnswerHTML(answer, mode string) string {
+	switch mode {
+	case "escape":
+		return html.EscapeString(answer)
+	case "strip":
+		return strings.TrimSpace(htmlTagPattern.ReplaceAllString(answer, ""))
+	default:
+		return answer
+	}
 }
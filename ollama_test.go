@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOllama stands in for Ollama's /api/generate, streaming chunks as
+// response lines and recording every request it gets
+type fakeOllama struct {
+	chunks []string
+
+	mu       sync.Mutex
+	requests []OllamaRequest
+}
+
+// newFakeOllama starts a fake Ollama streaming chunks, closed with the test
+func newFakeOllama(t *testing.T, chunks ...string) (*fakeOllama, *httptest.Server) {
+	t.Helper()
+
+	fake := &fakeOllama{chunks: chunks}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req OllamaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fake.mu.Lock()
+		fake.requests = append(fake.requests, req)
+		fake.mu.Unlock()
+
+		encoder := json.NewEncoder(w)
+		for _, chunk := range fake.chunks {
+			encoder.Encode(OllamaResponse{Response: chunk})
+		}
+		encoder.Encode(OllamaResponse{Done: true})
+	}))
+	t.Cleanup(srv.Close)
+	return fake, srv
+}
+
+// Requests returns the requests received so far
+func (f *fakeOllama) Requests() []OllamaRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]OllamaRequest(nil), f.requests...)
+}
+
+// newTestOllamaClient creates a client for the Ollama at url with the
+// default configuration, adjusted by configure
+func newTestOllamaClient(t *testing.T, url string, configure func(*Config)) *OllamaClient {
+	t.Helper()
+
+	config := LoadConfig()
+	config.OllamaURL = url
+	if configure != nil {
+		configure(config)
+	}
+	client, err := NewOllamaClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestOllamaRequestModel(t *testing.T) {
+	dir := t.TempDir()
+	llamaTemplate := filepath.Join(dir, "llama3.tmpl")
+	if err := os.WriteFile(llamaTemplate, []byte("LLAMA {{.Model}}: {{.Question}}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		model      string
+		wantModel  string
+		wantPrompt string
+	}{
+		{name: "default model", wantModel: "qwen3", wantPrompt: "Ouija"},
+		{name: "requested model", model: "llama3", wantModel: "llama3", wantPrompt: "LLAMA llama3: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeOllama(t, "YES")
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.OllamaModel = "qwen3"
+				config.OllamaModels = []string{"llama3"}
+				config.ModelPromptTemplates = map[string]string{"llama3": llamaTemplate}
+			})
+
+			ctx := contextWithModel(context.Background(), tt.model)
+			calls := map[string]func() error{
+				"generate": func() error { _, err := client.GenerateAnswer(ctx, "Will it rain?"); return err },
+				"stream": func() error {
+					_, err := client.StreamAnswer(ctx, "Will it rain?", func(string) error { return nil })
+					return err
+				},
+			}
+			for name, call := range calls {
+				if err := call(); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+			}
+
+			for _, req := range fake.Requests() {
+				if req.Model != tt.wantModel {
+					t.Errorf("model = %q, want %q", req.Model, tt.wantModel)
+				}
+				if !strings.Contains(req.Prompt, tt.wantPrompt) {
+					t.Errorf("prompt = %q, want it to contain %q", req.Prompt, tt.wantPrompt)
+				}
+			}
+		})
+	}
+}
+
+func TestAnswerCachePerModel(t *testing.T) {
+	tests := []struct {
+		name      string
+		models    []string
+		wantAsked int
+	}{
+		{name: "same model is cached", models: []string{"qwen3", "qwen3"}, wantAsked: 1},
+		{name: "default and named model share", models: []string{"", "qwen3"}, wantAsked: 1},
+		{name: "different models are cached apart", models: []string{"qwen3", "llama3", "qwen3", "llama3"}, wantAsked: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeOllama(t, "YES")
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.OllamaModel = "qwen3"
+				config.OllamaModels = []string{"llama3"}
+				config.AnswerCacheSize = 10
+			})
+
+			for _, model := range tt.models {
+				ctx := context.Background()
+				if model != "" {
+					ctx = contextWithModel(ctx, model)
+				}
+				if _, err := client.GenerateAnswer(ctx, "Will it rain?"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if asked := len(fake.Requests()); asked != tt.wantAsked {
+				t.Errorf("Ollama asked %d times, want %d", asked, tt.wantAsked)
+			}
+		})
+	}
+}
+
+func TestFirstByteTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		firstDelay time.Duration
+		laterDelay time.Duration
+		wantErr    error
+	}{
+		{name: "prompt first byte", wantErr: nil},
+		{name: "slow after the first byte", laterDelay: 150 * time.Millisecond, wantErr: nil},
+		{name: "no first byte", firstDelay: 500 * time.Millisecond, wantErr: ErrFirstByteTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.firstDelay):
+				case <-r.Context().Done():
+					return
+				}
+				encoder := json.NewEncoder(w)
+				encoder.Encode(OllamaResponse{Response: "YES"})
+				w.(http.Flusher).Flush()
+				time.Sleep(tt.laterDelay)
+				encoder.Encode(OllamaResponse{Done: true})
+			}))
+			defer srv.Close()
+
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.OllamaFirstByteTimeout = 100 * time.Millisecond
+			})
+
+			start := time.Now()
+			_, err := client.GenerateAnswer(context.Background(), "Will it rain?")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GenerateAnswer error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, ErrOllamaTimeout) {
+					t.Error("first-byte timeout isn't an ErrOllamaTimeout, so it won't fall back")
+				}
+				if elapsed := time.Since(start); elapsed >= tt.firstDelay {
+					t.Errorf("gave up after %v, want before the first byte at %v", elapsed, tt.firstDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestFitConversation(t *testing.T) {
+	prompt := strings.Repeat("x", 40) // ~10 tokens
+
+	tests := []struct {
+		name         string
+		maxTokens    int
+		conversation []int
+		want         []int
+	}{
+		{name: "no budget", conversation: []int{1, 2, 3}, want: []int{1, 2, 3}},
+		{name: "fits", maxTokens: 20, conversation: []int{1, 2, 3}, want: []int{1, 2, 3}},
+		{name: "oldest trimmed", maxTokens: 12, conversation: []int{1, 2, 3, 4}, want: []int{3, 4}},
+		{name: "no room left", maxTokens: 8, conversation: []int{1, 2}, want: []int{}},
+		{name: "no conversation", maxTokens: 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &OllamaClient{maxPromptTokens: tt.maxTokens}
+			got := client.fitConversation(prompt, tt.conversation)
+			if len(got) != len(tt.want) || (tt.want == nil) != (got == nil) {
+				t.Fatalf("fitConversation = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("fitConversation = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPromptTooLarge(t *testing.T) {
+	fake, srv := newFakeOllama(t, "YES")
+	client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+		config.MaxPromptTokens = 50
+	})
+
+	_, err := client.GenerateAnswer(context.Background(), strings.Repeat("Will it rain? ", 40))
+	if !errors.Is(err, ErrPromptTooLarge) {
+		t.Errorf("GenerateAnswer error = %v, want ErrPromptTooLarge", err)
+	}
+	if len(fake.Requests()) != 0 {
+		t.Error("an oversized prompt was sent to Ollama")
+	}
+}
+
+func TestFollowUpContextTrimmed(t *testing.T) {
+	fake, srv := newFakeOllama(t, "YES")
+	client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+		config.MaxPromptTokens = 200
+		config.OllamaFollowUps = true
+	})
+
+	session := &Session{ID: "s1"}
+	long := make([]int, 500)
+	for i := range long {
+		long[i] = i
+	}
+	session.SetOllamaContext(long)
+
+	if _, err := client.GenerateAnswer(contextWithSession(context.Background(), session), "Will it rain?"); err != nil {
+		t.Fatal(err)
+	}
+	requests := fake.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests sent, want 1", len(requests))
+	}
+	sent := requests[0].Context
+	if len(sent) == 0 || len(sent)+estimateTokens(requests[0].Prompt) > 200 {
+		t.Errorf("sent %d context tokens with a ~%d token prompt, want them trimmed to fit 200", len(sent), estimateTokens(requests[0].Prompt))
+	}
+	if sent[len(sent)-1] != long[len(long)-1] {
+		t.Error("the most recent context was trimmed")
+	}
+}
+
+func TestAnswerSuffix(t *testing.T) {
+	sessionID := "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name      string
+		suffix    string
+		sessionID string
+		want      string
+	}{
+		{name: "no suffix", sessionID: sessionID, want: "YES"},
+		{name: "plain suffix", suffix: "- the spirits", want: "YES - the spirits"},
+		{name: "hashed session", suffix: "#{{.SessionID}}", sessionID: sessionID, want: "YES #" + suffixSessionID(sessionID)},
+		{name: "no session", suffix: "{{.SessionID}}", want: "YES"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestOllamaClient(t, "http://127.0.0.1:0", func(config *Config) {
+				config.AnswerSuffix = tt.suffix
+			})
+			ctx := context.Background()
+			if tt.sessionID != "" {
+				ctx = contextWithSessionID(ctx, tt.sessionID)
+			}
+
+			got := client.appendSuffix(ctx, "YES")
+			if got != tt.want {
+				t.Errorf("appendSuffix = %q, want %q", got, tt.want)
+			}
+			if tt.sessionID != "" && strings.Contains(got, tt.sessionID) {
+				t.Errorf("appendSuffix = %q reveals the session ID", got)
+			}
+		})
+	}
+}
+
+func TestSuffixSessionID(t *testing.T) {
+	first, second := suffixSessionID("session-one"), suffixSessionID("session-two")
+	if len(first) != 8 || first == second {
+		t.Errorf("suffixSessionID gave %q and %q, want 8 distinct hex digits each", first, second)
+	}
+	if suffixSessionID("session-one") != first {
+		t.Error("suffixSessionID isn't stable for a session")
+	}
+}
+
+func TestStripFillerPrefixes(t *testing.T) {
+	prefixes := []string{"Sure, here's your answer:", "The spirits say:"}
+
+	tests := []struct {
+		name   string
+		answer string
+		want   string
+	}{
+		{name: "no prefix", answer: "YES", want: "YES"},
+		{name: "one prefix", answer: "The spirits say: NO", want: "NO"},
+		{name: "case-insensitive", answer: "the SPIRITS say:   NO", want: "NO"},
+		{name: "stacked prefixes", answer: "Sure, here's your answer: The spirits say: MAYBE", want: "MAYBE"},
+		{name: "prefix only", answer: "The spirits say:", want: ""},
+		{name: "prefix later in answer", answer: "YES, the spirits say: so", want: "YES, the spirits say: so"},
+		{name: "shorter than prefix", answer: "The", want: "The"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripFillerPrefixes(tt.answer, prefixes); got != tt.want {
+				t.Errorf("stripFillerPrefixes(%q) = %q, want %q", tt.answer, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripFillerPrefixesNone(t *testing.T) {
+	if got := stripFillerPrefixes("The spirits say: NO", nil); got != "The spirits say: NO" {
+		t.Errorf("stripFillerPrefixes without prefixes = %q, want the answer unchanged", got)
+	}
+}
+
+func TestConfidenceSeeded(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		seed   int64
+		want   int
+	}{
+		{name: "marker", chunks: []string{"YES [confidence: 87]"}, want: 87},
+		{name: "no marker", chunks: []string{"YES"}, seed: 7, want: newLockedRand(7).Intn(101)},
+		{name: "out of range", chunks: []string{"YES [confidence: 300]"}, seed: 7, want: newLockedRand(7).Intn(101)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newFakeOllama(t, tt.chunks...)
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.AnswerConfidence = true
+				config.VariationSeed = tt.seed
+			})
+
+			ctx := contextWithConfidence(context.Background(), &answerConfidence{})
+			answer, err := client.GenerateAnswer(ctx, "Will it rain?")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(answer, "YES") || strings.Contains(answer, "confidence") {
+				t.Errorf("answer %q, want the marker removed", answer)
+			}
+			if got := confidenceFromContext(ctx); got == nil || *got != tt.want {
+				t.Errorf("confidence %v, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollapseSpaces(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "clean", text: "YES, it will", want: "YES, it will"},
+		{name: "doubled spaces", text: "YES,  it   will", want: "YES, it will"},
+		{name: "tabs", text: "YES,\t \tit will", want: "YES, it will"},
+		{name: "leading token space", text: " YES", want: " YES"},
+		{name: "spaces around line breaks", text: "YES \n  it will", want: "YES\nit will"},
+		{name: "blank lines kept", text: "YES\n\n it will", want: "YES\n\nit will"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := collapseSpaces(tt.text); got != tt.want {
+				t.Errorf("collapseSpaces(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateAnswerSpacing(t *testing.T) {
+	tests := []struct {
+		name     string
+		collapse bool
+		chunks   []string
+		want     string
+	}{
+		{name: "leading space tokens", collapse: true, chunks: []string{" YES", ",", "  the", " spirits", "  agree"}, want: "YES, the spirits agree"},
+		{name: "line breaks kept", collapse: true, chunks: []string{" YES", " \n", " the", " spirits", " agree"}, want: "YES\nthe spirits agree"},
+		{name: "off", collapse: false, chunks: []string{" YES", ",", "  the", " spirits"}, want: "YES,  the spirits"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newFakeOllama(t, tt.chunks...)
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.CollapseAnswerSpaces = tt.collapse
+			})
+
+			answer, err := client.GenerateAnswer(context.Background(), "Will it rain?")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if answer != tt.want {
+				t.Errorf("answer %q, want %q", answer, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripQuestionEcho(t *testing.T) {
+	tests := []struct {
+		name     string
+		answer   string
+		question string
+		want     string
+	}{
+		{name: "echo", answer: "Will it rain? YES", question: "Will it rain?", want: "YES"},
+		{name: "case and punctuation ignored", answer: "will IT rain... The spirits say YES", question: "Will it rain?", want: "The spirits say YES"},
+		{name: "echo on its own line", answer: "Will it rain\nYES", question: "Will it rain?", want: "YES"},
+		{name: "no echo", answer: "YES", question: "Will it rain?", want: "YES"},
+		{name: "same first word", answer: "Love is near.", question: "Love?", want: "Love is near."},
+		{name: "longer word", answer: "Will I be richer? Perhaps", question: "Will I be rich?", want: "Will I be richer? Perhaps"},
+		{name: "not followed by punctuation", answer: "Will it rain today", question: "Will it rain?", want: "Will it rain today"},
+		{name: "nothing but the echo", answer: "Will it rain?", question: "Will it rain?", want: "Will it rain?"},
+		{name: "partial echo", answer: "Will it", question: "Will it rain?", want: "Will it"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripQuestionEcho(tt.answer, tt.question); got != tt.want {
+				t.Errorf("stripQuestionEcho(%q, %q) = %q, want %q", tt.answer, tt.question, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumPredictPerModel(t *testing.T) {
+	tests := []struct {
+		name  string
+		model string
+		want  int
+	}{
+		{name: "default model", want: 64},
+		{name: "requested model", model: "llama3", want: 200},
+		{name: "requested model without an entry", model: "mistral", want: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, srv := newFakeOllama(t, "YES")
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.OllamaModel = "qwen3"
+				config.OllamaModels = []string{"llama3", "mistral"}
+				config.MaxTokens = 100
+				config.OllamaModelTokens = map[string]string{"qwen3": "64", "llama3": "200"}
+			})
+
+			ctx := contextWithModel(context.Background(), tt.model)
+			if _, err := client.GenerateAnswer(ctx, "Will it rain?"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.StreamAnswer(ctx, "Will it rain?", func(string) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+
+			requests := fake.Requests()
+			if len(requests) != 2 {
+				t.Fatalf("%d requests, want 2", len(requests))
+			}
+			for _, req := range requests {
+				if req.Options.NumPredict != tt.want {
+					t.Errorf("num_predict = %d for model %q, want %d", req.Options.NumPredict, req.Model, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSlowGenerations(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		ask    func(context.Context, *OllamaClient) error
+	}{
+		{
+			name:   "asked",
+			chunks: []string{"Yes, it will rain."},
+			ask: func(ctx context.Context, c *OllamaClient) error {
+				_, err := c.GenerateAnswer(ctx, "Will it rain?")
+				return err
+			},
+		},
+		{
+			name:   "streamed",
+			chunks: []string{"Yes, ", "it will rain."},
+			ask: func(ctx context.Context, c *OllamaClient) error {
+				_, err := c.StreamAnswer(ctx, "Will it rain?", func(string) error { return nil })
+				return err
+			},
+		},
+		{
+			name:   "structured",
+			chunks: []string{`{"answer":"Yes, it will rain.","confidence":0.9}`},
+			ask: func(ctx context.Context, c *OllamaClient) error {
+				_, err := c.GenerateStructuredAnswer(ctx, "Will it rain?")
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, srv := newFakeOllama(t, tt.chunks...)
+			// Every generation takes longer than a nanosecond
+			client := newTestOllamaClient(t, srv.URL, func(config *Config) {
+				config.SlowGenerationThreshold = time.Nanosecond
+			})
+
+			if err := tt.ask(context.Background(), client); err != nil {
+				t.Fatal(err)
+			}
+			if slow, ok := client.SlowGenerations(); !ok || slow != 1 {
+				t.Errorf("SlowGenerations() = %d, %v, want 1, true", slow, ok)
+			}
+		})
+	}
+}
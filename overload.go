@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// overloadBaseBackoff is the back-off after the first overload response
+	overloadBaseBackoff = time.Second
+	// overloadMaxBackoff caps the back-off however many overloads follow
+	overloadMaxBackoff = time.Minute
+)
+
+// ErrOllamaOverloaded is returned when Ollama answers 503, or while the board
+// is backing off after such answers
+var ErrOllamaOverloaded = errors.New("ollama is overloaded")
+
+// overloadBreaker tracks consecutive overload responses from Ollama. After
+// each one, requests are refused for a back-off period that doubles with
+// every further overload, until Ollama answers normally again.
+type overloadBreaker struct {
+	mu       sync.Mutex
+	failures int
+	until    time.Time
+	// now is the time source, replaceable so back-off can be tested without sleeping
+	now func() time.Time
+}
+
+// newOverloadBreaker creates a closed breaker
+func newOverloadBreaker() *overloadBreaker {
+	return &overloadBreaker{now: time.Now}
+}
+
+// backoff returns the back-off for the current failure count. Must be called
+// with b.mu held.
+func (b *overloadBreaker) backoff() time.Duration {
+	if b.failures == 0 {
+		return 0
+	}
+	exp := math.Min(float64(b.failures-1), 16)
+	return min(time.Duration(float64(overloadBaseBackoff)*math.Pow(2, exp)), overloadMaxBackoff)
+}
+
+// allow reports whether a request may be sent to Ollama now
+func (b *overloadBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.now().Before(b.until)
+}
+
+// overloaded records an overload response and starts a longer back-off
+func (b *overloadBreaker) overloaded() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.until = b.now().Add(b.backoff())
+}
+
+// recovered records a normal response, closing the breaker
+func (b *overloadBreaker) recovered() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.until = time.Time{}
+}
+
+// RetryAfter returns the current back-off, which grows with consecutive overloads
+func (b *overloadBreaker) RetryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.backoff()
+}
+
+// respondOverloaded answers 503 with a growing Retry-After if err means
+// Ollama is overloaded, returning false for any other error
+func (app *App) respondOverloaded(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, ErrOllamaOverloaded) {
+		return false
+	}
+
+	retryAfter := overloadBaseBackoff
+	if reporter, ok := app.generator.(overloadReporter); ok {
+		retryAfter = max(reporter.RetryAfter(), overloadBaseBackoff)
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	respondWithError(w, r, "The spirits are overwhelmed, ask again later", http.StatusServiceUnavailable)
+	return true
+}
+
+// maxRetryAfterWait caps how long a single Retry-After from Ollama is
+// honored, for requests without a deadline
+const maxRetryAfterWait = time.Minute
+
+// ErrOllamaRateLimited is returned when Ollama, or a gateway in front of it,
+// answers 429. It is also an ErrOllamaStatus.
+var ErrOllamaRateLimited = fmt.Errorf("%w 429", ErrOllamaStatus)
+
+// rateLimitedError is an ErrOllamaRateLimited carrying the Retry-After the
+// response asked for, if it had a valid one
+type rateLimitedError struct {
+	retryAfter    time.Duration
+	hasRetryAfter bool
+}
+
+func (e *rateLimitedError) Error() string {
+	if e.hasRetryAfter {
+		return fmt.Sprintf("%v, retry after %v", ErrOllamaRateLimited, e.retryAfter)
+	}
+	return ErrOllamaRateLimited.Error()
+}
+
+func (e *rateLimitedError) Unwrap() error {
+	return ErrOllamaRateLimited
+}
+
+// parseRetryAfter reads a Retry-After header in either delay-seconds or
+// HTTP-date form. Dates in the past mean no wait.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// rateLimitWait returns how long to wait before retrying a request Ollama
+// rate limited with err, or false if it shouldn't be retried: err isn't a
+// rate limit, it didn't say when to retry, or the wait would run past the
+// request's deadline anyway
+func rateLimitWait(ctx context.Context, err error) (time.Duration, bool) {
+	var limited *rateLimitedError
+	if !errors.As(err, &limited) || !limited.hasRetryAfter {
+		return 0, false
+	}
+
+	wait := min(limited.retryAfter, maxRetryAfterWait)
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= wait {
+		return 0, false
+	}
+	return wait, true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sort"
+)
+
+// defaultPersonality is the board's original voice. It uses the configured
+// prompt templates, so PROMPT_TEMPLATE_FILE and MODEL_PROMPT_TEMPLATES still
+// apply to it.
+const defaultPersonality = "classic"
+
+// personalities are the board's prompt presets, selectable with
+// BOARD_PERSONALITY or per request. Every other preset replaces the
+// configured prompt template with its own.
+var personalities = map[string]string{
+	defaultPersonality: defaultPromptTemplate,
+	"ominous": "Pretend that you are a Ouija board possessed by a dark and ominous spirit. Answer the following question in a short, foreboding answer. " +
+		"Respond without using any actions, such as *smiles*, *laughs*, or any text within asterisks. " +
+		"If the question is a yes or no question, answer with a yes or a no, and hint at a price to be paid. Question: {{.Question}}",
+	"playful": "Pretend that you are a Ouija board haunted by a playful, mischievous spirit. Answer the following question in a short, teasing answer. " +
+		"Respond without using any actions, such as *smiles*, *laughs*, or any text within asterisks. " +
+		"If the question is a yes or no question, answer with a yes or a no. Question: {{.Question}}",
+	"cryptic": "Pretend that you are a Ouija board speaking for an ancient, cryptic spirit. Answer the following question in a short riddle or omen rather than plainly. " +
+		"Respond without using any actions, such as *smiles*, *laughs*, or any text within asterisks. Question: {{.Question}}",
+}
+
+// personalityNames returns the preset names in sorted order
+func personalityNames() []string {
+	names := make([]string, 0, len(personalities))
+	for name := range personalities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validPersonality reports whether name is a known preset
+func validPersonality(name string) bool {
+	_, ok := personalities[name]
+	return ok
+}
+
+// personalityContextKey is the context key for a request's chosen personality
+type personalityContextKey struct{}
+
+// contextWithPersonality returns a context asking for the named preset. An
+// empty name leaves the board's BOARD_PERSONALITY in place.
+func contextWithPersonality(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, personalityContextKey{}, name)
+}
+
+// personalityFromContext returns the preset requested for ctx, "" for the
+// board's default
+func personalityFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(personalityContextKey{}).(string)
+	return name
+}
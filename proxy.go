@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// proxyRetryDelay is the pause before the first retry, doubled for each one after
+const proxyRetryDelay = 250 * time.Millisecond
+
+// errUpstreamRetryable marks upstream failures worth trying again. Upstream
+// failures also wrap the ErrOllama* error they amount to, so the local board
+// falls back or reports overload as it would for its own model.
+var errUpstreamRetryable = errors.New("upstream board unavailable")
+
+// ProxyGenerator answers questions by forwarding them to another board's
+// API, for lightweight edge nodes that don't run a model of their own
+type ProxyGenerator struct {
+	upstream string
+	retries  int
+	client   *http.Client
+}
+
+// NewProxyGenerator creates a generator forwarding to the board at upstream
+func NewProxyGenerator(upstream string, timeout time.Duration, retries int) (*ProxyGenerator, error) {
+	if upstream == "" {
+		return nil, errors.New("UPSTREAM_URL is required for the proxy backend")
+	}
+
+	return &ProxyGenerator{
+		upstream: strings.TrimSuffix(upstream, "/"),
+		retries:  max(retries, 0),
+		client:   &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// GenerateAnswer asks the upstream board's /ask endpoint. The upstream
+// board's source is passed on, so its fallback isn't taken for a model answer.
+func (p *ProxyGenerator) GenerateAnswer(ctx context.Context, question string) (string, error) {
+	var resp AskResponse
+	if err := p.post(ctx, "/ask", question, &resp); err != nil {
+		return "", err
+	}
+	if resp.Source != "" {
+		reportSource(ctx, resp.Source)
+	}
+	return resp.Answer, nil
+}
+
+// StreamAnswer asks the upstream board's /ask endpoint and passes the whole
+// answer on as a single chunk
+func (p *ProxyGenerator) StreamAnswer(ctx context.Context, question string, onChunk func(string) error) (string, error) {
+	answer, err := p.GenerateAnswer(ctx, question)
+	if err != nil {
+		return "", err
+	}
+	if err := onChunk(answer); err != nil {
+		return "", err
+	}
+	return answer, nil
+}
+
+// GenerateStructuredAnswer asks the upstream board's /ask/structured
+// endpoint, which must be enabled there
+func (p *ProxyGenerator) GenerateStructuredAnswer(ctx context.Context, question string) (StructuredAnswer, error) {
+	var answer StructuredAnswer
+	if err := p.post(ctx, "/ask/structured", question, &answer); err != nil {
+		return StructuredAnswer{}, err
+	}
+	return answer, nil
+}
+
+// post sends a question to path on the upstream board, retrying network
+// errors, 429s and 5xx responses with exponential backoff. A model chosen
+// for the request is asked for upstream too.
+func (p *ProxyGenerator) post(ctx context.Context, path, question string, out interface{}) error {
+	// Upstream history is left alone, the local board stores the answer
+	noStore := false
+	body, err := json.Marshal(AskRequest{Question: question, Store: &noStore, Model: modelFromContext(ctx)})
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	delay := proxyRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = p.postOnce(ctx, path, body, out)
+		if err == nil || !errors.Is(err, errUpstreamRetryable) || attempt >= p.retries {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return transportError(ctx, ctx.Err())
+		}
+		delay *= 2
+	}
+}
+
+// postOnce makes a single request to the upstream board
+func (p *ProxyGenerator) postOnce(ctx context.Context, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.upstream+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestIDFromContext(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return transportError(ctx, ctx.Err())
+		}
+		return fmt.Errorf("%w: %w", errUpstreamRetryable, transportError(ctx, err))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&errResp)
+
+		// An overloaded upstream is reported as such, so clients back off
+		sentinel := ErrOllamaStatus
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			sentinel = ErrOllamaOverloaded
+		}
+		err := fmt.Errorf("%w: upstream board returned status %d: %s", sentinel, resp.StatusCode, errResp.Error)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return fmt.Errorf("%w: %w", errUpstreamRetryable, err)
+		}
+		return err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%w: failed to decode upstream response: %v", ErrOllamaStatus, err)
+	}
+	return nil
+}
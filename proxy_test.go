@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newUpstreamBoard starts a board answering /ask with handle, counting requests
+func newUpstreamBoard(t *testing.T, handle http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handle(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestProxyGeneratorErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		handle       http.HandlerFunc
+		wantAnswer   string
+		wantErr      error
+		wantRequests int32
+	}{
+		{
+			name: "answer",
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(AskResponse{Answer: "YES", Source: answerSourceModel})
+			},
+			wantAnswer:   "YES",
+			wantRequests: 1,
+		},
+		{
+			name: "server error is retried, then falls back",
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			wantErr:      ErrOllamaStatus,
+			wantRequests: 2,
+		},
+		{
+			name: "overloaded upstream",
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			},
+			wantErr:      ErrOllamaOverloaded,
+			wantRequests: 2,
+		},
+		{
+			name: "client error isn't retried",
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+			},
+			wantErr:      ErrOllamaStatus,
+			wantRequests: 1,
+		},
+		{
+			name: "timeout",
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(200 * time.Millisecond)
+			},
+			wantErr:      ErrOllamaTimeout,
+			wantRequests: 2,
+		},
+		{
+			name: "malformed answer",
+			handle: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("not json"))
+			},
+			wantErr:      ErrOllamaStatus,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := newUpstreamBoard(t, tt.handle)
+			proxy, err := NewProxyGenerator(srv.URL, 50*time.Millisecond, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			answer, err := proxy.GenerateAnswer(context.Background(), "Will it rain?")
+			if !errors.Is(err, tt.wantErr) || answer != tt.wantAnswer {
+				t.Errorf("GenerateAnswer = %q, %v, want %q, %v", answer, err, tt.wantAnswer, tt.wantErr)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("upstream asked %d times, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestProxyGeneratorUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	proxy, err := NewProxyGenerator(srv.URL, time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := proxy.GenerateAnswer(context.Background(), "Will it rain?"); !errors.Is(err, ErrOllamaUnreachable) {
+		t.Errorf("GenerateAnswer error = %v, want ErrOllamaUnreachable", err)
+	}
+
+	// The board answers from its fallbacks rather than failing
+	app := newTestApp(t, proxy)
+	rec := askJSON(app, `{"question":"Will it rain?"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200, body %s", rec.Code, rec.Body)
+	}
+	var resp AskResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Source != answerSourceFallback || resp.Answer == "" {
+		t.Errorf("response %+v, want a fallback answer", resp)
+	}
+}
+
+func TestProxyGeneratorSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		upstream string
+		want     string
+	}{
+		{name: "model", upstream: answerSourceModel, want: answerSourceModel},
+		{name: "upstream fallback", upstream: answerSourceFallback, want: answerSourceFallback},
+		{name: "upstream dry run", upstream: answerSourceDryRun, want: answerSourceDryRun},
+		{name: "no source from an older board", want: answerSourceModel},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newUpstreamBoard(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(AskResponse{Answer: "The spirits are silent", Source: tt.upstream})
+			})
+			proxy, err := NewProxyGenerator(srv.URL, time.Second, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := newTestApp(t, proxy)
+
+			rec := askJSON(app, `{"question":"Will it rain?"}`, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+			}
+			var resp AskResponse
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Source != tt.want {
+				t.Errorf("source %q, want %q", resp.Source, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// seance is one session's shared board: the clients watching it and the
+// answer currently being streamed to it
+type seance struct {
+	watchers int
+	// current is the latest answer, which may still be streaming
+	current *resumableGeneration
+	// next is closed and replaced whenever an answer starts
+	next chan struct{}
+}
+
+// seanceHub fans answers streamed in a session out to every client watching
+// that session, so several people can follow one board. Each answer is
+// generated once and recorded, so a watcher joining mid-stream is sent the
+// answer from its start.
+type seanceHub struct {
+	mu      sync.Mutex
+	seances map[string]*seance
+}
+
+// newSeanceHub creates an empty hub
+func newSeanceHub() *seanceHub {
+	return &seanceHub{seances: make(map[string]*seance)}
+}
+
+// join adds a watcher to a session's seance, starting it if needed
+func (h *seanceHub) join(sessionID string) *seance {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, exists := h.seances[sessionID]
+	if !exists {
+		s = &seance{next: make(chan struct{})}
+		h.seances[sessionID] = s
+	}
+	s.watchers++
+	return s
+}
+
+// leave removes a watcher, ending the seance when the last one has gone
+func (h *seanceHub) leave(sessionID string, s *seance) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s.watchers--
+	if s.watchers == 0 && h.seances[sessionID] == s {
+		delete(h.seances, sessionID)
+	}
+}
+
+// watch returns the latest answer given to s, if any, and a channel closed
+// when the next one starts
+func (h *seanceHub) watch(s *seance) (*resumableGeneration, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return s.current, s.next
+}
+
+// publish starts recording an answer for a session's watchers. It returns
+// nil when nobody is watching, so unwatched sessions cost nothing.
+func (h *seanceHub) publish(sessionID string) *resumableGeneration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, exists := h.seances[sessionID]
+	if !exists {
+		return nil
+	}
+
+	g := &resumableGeneration{id: newRequestID(), changed: make(chan struct{})}
+	s.current = g
+	close(s.next)
+	s.next = make(chan struct{})
+	return g
+}
+
+// seanceStream sends events both to the asking client and to the session's
+// watchers. Failures are the asking client's alone, watchers never fail.
+type seanceStream struct {
+	eventStream
+	watchers *resumableGeneration
+}
+
+// send records the event for the watchers and writes it to the asker
+func (s seanceStream) send(event string, payload interface{}) error {
+	s.watchers.send(event, payload)
+	return s.eventStream.send(event, payload)
+}
+
+// seanceHandler streams every answer asked in the caller's session, by any
+// client, as the same events /ask/stream sends. A watcher joining while an
+// answer is streaming gets it from the start. The session must already
+// exist, so a watcher can't start one nobody asks in.
+func (app *App) seanceHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(sessionHeaderName)
+	if id == "" {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			id = cookie.Value
+		}
+	}
+	if _, ok := app.sessions.Get(id); id == "" || !ok {
+		respondWithError(w, r, "No seance is being held in this session", http.StatusNotFound)
+		return
+	}
+
+	done, ok := app.streams.track()
+	if !ok {
+		respondWithError(w, r, "The board is closing, watch again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+
+	s := app.seances.join(id)
+	defer app.seances.leave(id, s)
+
+	stream := newSSEStream(w)
+	writeStreamHeaders(w, "text/event-stream")
+	// Nothing may be sent for a while, let the client know it is watching
+	if err := stream.rc.Flush(); err != nil {
+		return
+	}
+
+	// An answer that was over before the watcher joined isn't replayed
+	var seen *resumableGeneration
+	if g, _ := app.seances.watch(s); g != nil && g.finished() {
+		seen = g
+	}
+
+	ctx := r.Context()
+	for {
+		g, next := app.seances.watch(s)
+		if g != nil && g != seen {
+			seen = g
+			if err := g.follow(ctx, 0, stream); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-next:
+		case <-app.streams.draining:
+			stream.send("shutdown", ErrorResponse{Error: "The board is closing, reconnect shortly"})
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
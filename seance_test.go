@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one parsed Server-Sent Event
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// readSSE reads events from r until one named last, or the stream ends
+func readSSE(t *testing.T, r *bufio.Reader, last string) []sseEvent {
+	t.Helper()
+
+	var events []sseEvent
+	var current sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return events
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "":
+			events = append(events, current)
+			if current.event == last {
+				return events
+			}
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			current.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			current.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// tokens concatenates the chunks of the token events
+func tokens(events []sseEvent) string {
+	var text strings.Builder
+	for _, ev := range events {
+		if ev.event == "token" {
+			text.WriteString(strings.TrimSuffix(strings.TrimPrefix(ev.data, `{"chunk":"`), `"}`))
+		}
+	}
+	return text.String()
+}
+
+// waitForWatchers waits until n clients watch the session
+func waitForWatchers(t *testing.T, hub *seanceHub, sessionID string, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		hub.mu.Lock()
+		s, exists := hub.seances[sessionID]
+		watching := exists && s.watchers == n
+		hub.mu.Unlock()
+		if watching {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d watchers", n)
+}
+
+func TestSeanceFanOut(t *testing.T) {
+	app := newTestApp(t, &FakeGenerator{Answer: "THE SPIRITS SAY YES"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ask/stream", app.askStreamHandler)
+	mux.HandleFunc("/session/stream", app.seanceHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	session := app.sessions.Create()
+
+	// Two watchers join the seance
+	var watchers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/session/stream", nil)
+		req.Header.Set(sessionHeaderName, session.ID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		watchers = append(watchers, bufio.NewReader(resp.Body))
+	}
+	waitForWatchers(t, app.seances, session.ID, 2)
+
+	// One of them asks
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/ask/stream", strings.NewReader(`{"question":"Will it rain?"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(sessionHeaderName, session.ID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asked := readSSE(t, bufio.NewReader(resp.Body), "done")
+	resp.Body.Close()
+
+	for i, watcher := range watchers {
+		events := readSSE(t, watcher, "done")
+		if got, want := tokens(events), tokens(asked); got != want || got != "THE SPIRITS SAY YES" {
+			t.Errorf("watcher %d saw %q, asker saw %q", i, got, want)
+		}
+		if last := events[len(events)-1]; last.event != "done" {
+			t.Errorf("watcher %d ended with %q, want done", i, last.event)
+		}
+	}
+}
+
+func TestSeanceUnknownSession(t *testing.T) {
+	app := newTestApp(t, &FakeGenerator{Answer: "YES"})
+
+	tests := []struct {
+		name      string
+		sessionID string
+	}{
+		{name: "no session"},
+		{name: "unknown session", sessionID: "not-a-session"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/session/stream", nil)
+			if tt.sessionID != "" {
+				req.Header.Set(sessionHeaderName, tt.sessionID)
+			}
+			rec := httptest.NewRecorder()
+			app.seanceHandler(rec, req)
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("status %d, want 404", rec.Code)
+			}
+		})
+	}
+}
+
+func TestSeanceHubReplaysMidStream(t *testing.T) {
+	hub := newSeanceHub()
+	first := hub.join("s1")
+
+	g := hub.publish("s1")
+	g.send("token", StreamChunk{Chunk: "YES"})
+
+	// A watcher joining mid-answer gets what was already streamed
+	late := hub.join("s1")
+	current, _ := hub.watch(late)
+	if current != g {
+		t.Fatal("late watcher doesn't see the current answer")
+	}
+
+	rec := httptest.NewRecorder()
+	g.finish()
+	if err := current.follow(context.Background(), 0, newSSEStream(rec)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(rec.Body.String(), `"chunk":"YES"`) {
+		t.Errorf("late watcher got %q, want the earlier token replayed", rec.Body.String())
+	}
+
+	// The seance goes once its last watcher leaves
+	hub.leave("s1", first)
+	hub.leave("s1", late)
+	if g := hub.publish("s1"); g != nil {
+		t.Error("answer published to a seance nobody watches")
+	}
+	if len(hub.seances) != 0 {
+		t.Errorf("%d seances left after everyone left", len(hub.seances))
+	}
+}
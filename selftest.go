@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// selfTestQuestion is the canned question asked by --selftest
+const selfTestQuestion = "Will the spirits answer this test?"
+
+// selfTestTimeout bounds the self-test, including loading the model
+const selfTestTimeout = 2 * time.Minute
+
+// runSelfTest asks the generator one canned question, as a smoke test for
+// CI and deploys. It fails if generation errors or only a fallback answer
+// comes back, so a passing run proves the backend and the prompt pipeline
+// work end to end.
+func runSelfTest(generator AnswerGenerator) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	answer, err := generator.GenerateAnswer(ctx, selfTestQuestion)
+	if fallback, ok := fallbackFor(err); ok {
+		return fallback, fmt.Errorf("the board gave its fallback answer: %w", err)
+	}
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(answer) == "" {
+		return "", errors.New("the answer was empty")
+	}
+	return answer, nil
+}
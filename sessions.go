@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionCookieName is the cookie used to remember a visitor's session
+	sessionCookieName = "ouija_session"
+	// sessionHeaderName lets API clients present a session without cookies
+	sessionHeaderName = "X-Session-ID"
+)
+
+// sessionContextKey is the context key for the current session ID
+type sessionContextKey struct{}
+
+// contextWithSessionID returns a context carrying the session ID
+func contextWithSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, id)
+}
+
+// sessionIDFromContext returns the session ID carried by ctx, if any
+func sessionIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(sessionContextKey{}).(string)
+	return id
+}
+
+// sessionStateContextKey is the context key for the current *Session
+type sessionStateContextKey struct{}
+
+// contextWithSession returns a context carrying the session and its ID
+func contextWithSession(ctx context.Context, session *Session) context.Context {
+	ctx = contextWithSessionID(ctx, session.ID)
+	return context.WithValue(ctx, sessionStateContextKey{}, session)
+}
+
+// sessionFromContext returns the session carried by ctx, nil if none
+func sessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionStateContextKey{}).(*Session)
+	return session
+}
+
+// Session holds per-visitor state
+type Session struct {
+	ID       string
+	Created  time.Time
+	LastSeen time.Time
+
+	// mu guards the conversation state below, which generations update
+	// outside the store's lock
+	mu sync.Mutex
+	// ollamaContext is Ollama's context after the last answer, fed back
+	// with the next question when OLLAMA_FOLLOW_UPS is on
+	ollamaContext []int
+}
+
+// OllamaContext returns the conversation context of the last answer
+func (s *Session) OllamaContext() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ollamaContext
+}
+
+// SetOllamaContext keeps the conversation context of the latest answer
+func (s *Session) SetOllamaContext(conversation []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ollamaContext = conversation
+}
+
+// sessionStore is an LRU-bounded, idle-expiring store of sessions
+type sessionStore struct {
+	maxSessions int
+	idleTimeout time.Duration
+	mu          sync.Mutex
+	order       *list.List // most recently used at the front
+	sessions    map[string]*list.Element
+}
+
+// newSessionStore creates a new session store
+func newSessionStore(maxSessions int, idleTimeout time.Duration) *sessionStore {
+	return &sessionStore{
+		maxSessions: maxSessions,
+		idleTimeout: idleTimeout,
+		order:       list.New(),
+		sessions:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the session with the given ID and marks it as recently used
+func (s *sessionStore) Get(id string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expireIdle(now)
+
+	elem, exists := s.sessions[id]
+	if !exists {
+		return nil, false
+	}
+
+	session := elem.Value.(*Session)
+	session.LastSeen = now
+	s.order.MoveToFront(elem)
+	return session, true
+}
+
+// Create starts a new session, evicting the least recently used one if full
+func (s *sessionStore) Create() *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expireIdle(now)
+
+	for s.order.Len() >= s.maxSessions && s.order.Len() > 0 {
+		s.remove(s.order.Back())
+	}
+
+	session := &Session{
+		ID:       newRequestID(),
+		Created:  now,
+		LastSeen: now,
+	}
+	s.sessions[session.ID] = s.order.PushFront(session)
+	return session
+}
+
+// Len returns the number of live sessions
+func (s *sessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expireIdle(time.Now())
+	return s.order.Len()
+}
+
+// expireIdle drops sessions unused for longer than the idle timeout. Since the
+// list is ordered by use, it only needs to look at the back. Must be called
+// with s.mu held.
+func (s *sessionStore) expireIdle(now time.Time) {
+	if s.idleTimeout <= 0 {
+		return
+	}
+
+	for elem := s.order.Back(); elem != nil; elem = s.order.Back() {
+		if now.Sub(elem.Value.(*Session).LastSeen) <= s.idleTimeout {
+			return
+		}
+		s.remove(elem)
+	}
+}
+
+// remove deletes a session element. Must be called with s.mu held.
+func (s *sessionStore) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.sessions, elem.Value.(*Session).ID)
+}
+
+// resolveSession returns the caller's session from the header or cookie,
+// starting a new one (and telling the client about it) if none is known
+func (app *App) resolveSession(w http.ResponseWriter, r *http.Request) *Session {
+	id := r.Header.Get(sessionHeaderName)
+	if id == "" {
+		if cookie, err := r.Cookie(sessionCookieName); err == nil {
+			id = cookie.Value
+		}
+	}
+
+	if id != "" {
+		if session, ok := app.sessions.Get(id); ok {
+			return session
+		}
+	}
+
+	// Never adopt a client-chosen ID, always mint a fresh one
+	session := app.sessions.Create()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set(sessionHeaderName, session.ID)
+	return session
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals start a graceful shutdown. On Linux and macOS these are
+// Ctrl+C and SIGTERM from Docker, systemd or Kubernetes. Windows has no
+// SIGTERM to send, but Go reports Ctrl+C and Ctrl+Break as os.Interrupt,
+// and the console being closed, the user logging off or the system
+// shutting down as syscall.SIGTERM, so the same set works there. Windows
+// only waits a few seconds after those last events before ending the
+// process, so the drain may be cut short.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
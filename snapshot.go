@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SaveSnapshot atomically writes all Q&A pairs to path as JSON by writing a
+// temporary file and renaming it over the previous snapshot
+func (s *MemoryStorage) SaveSnapshot(path string) error {
+	pairs, err := s.GetAll()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(pairs)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	// Make sure the data is on disk before it replaces the old snapshot
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// LoadSnapshot replaces the stored Q&A pairs with those from a snapshot file.
+// A missing file is not an error.
+func (s *MemoryStorage) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var pairs []QAPair
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+
+	// Keep only the newest entries if the snapshot exceeds the current limit
+	if len(pairs) > s.maxSize {
+		pairs = pairs[len(pairs)-s.maxSize:]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Older snapshots have no IDs, number them after the highest known one,
+	s.nextID = 1
+	for _, pair := range pairs {
+		if pair.ID >= s.nextID {
+			s.nextID = pair.ID + 1
+		}
+	}
+	// and treat pairs without a timestamp as created now so a TTL doesn't
+	// expire them all at once
+	now := s.now()
+	for i := range pairs {
+		if pairs[i].ID == 0 {
+			pairs[i].ID = s.nextID
+			s.nextID++
+		}
+		if pairs[i].CreatedAt.IsZero() {
+			pairs[i].CreatedAt = now
+		}
+	}
+	s.pairs = pairs
+
+	return nil
+}
+
+// snapshotter periodically saves history to disk so it survives hard crashes
+// where Close never runs
+type snapshotter struct {
+	storage  *MemoryStorage
+	path     string
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newSnapshotter creates a new snapshotter
+func newSnapshotter(storage *MemoryStorage, path string, interval time.Duration) *snapshotter {
+	return &snapshotter{
+		storage:  storage,
+		path:     path,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start begins taking snapshots on a timer
+func (sn *snapshotter) Start() {
+	sn.wg.Add(1)
+	go func() {
+		defer sn.wg.Done()
+
+		ticker := time.NewTicker(sn.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := sn.storage.SaveSnapshot(sn.path); err != nil {
+					log.Printf("Error saving history snapshot: %v", err)
+				}
+			case <-sn.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the timer and takes a final snapshot
+func (sn *snapshotter) Stop() {
+	close(sn.stop)
+	sn.wg.Wait()
+
+	if err := sn.storage.SaveSnapshot(sn.path); err != nil {
+		log.Printf("Error saving final history snapshot: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), namespaceSnapshotPath("answers.json", "love"))
+
+	saved := NewMemoryStorage(10, 0)
+	for _, question := range []string{"Does she love me?", "Will he call?"} {
+		if err := saved.Add(context.Background(), QAPair{Question: question, Answer: "YES"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saved.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewMemoryStorage(10, 0)
+	if err := loaded.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := loaded.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || pairs[0].Question != "Does she love me?" || pairs[1].ID != 2 {
+		t.Errorf("loaded pairs = %+v, want the two saved ones", pairs)
+	}
+}
+
+func TestLoadSnapshotMissing(t *testing.T) {
+	storage := NewMemoryStorage(10, 0)
+	if err := storage.LoadSnapshot(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("LoadSnapshot of a missing file = %v, want nil", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+// warmer is implemented by generators that can load their model ahead of
+// the first question
+type warmer interface {
+	Warmup(ctx context.Context) error
+}
+
+// startupGateMiddleware answers 503 until started is set, so questions
+// asked while the board is still loading history or warming the model
+// don't fail or stall
+func startupGateMiddleware(started *atomic.Bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !started.Load() {
+				w.Header().Set("Retry-After", "1")
+				respondWithError(w, r, "The board is still waking, ask again shortly", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HealthResponse is the liveness probe's answer
+type HealthResponse struct {
+	Status string `json:"status"`
+	// Storage is omitted when the history backend isn't metered
+	Storage *StorageHealth `json:"storage,omitempty"`
+}
+
+// StorageHealth is the default history's recent p99 latency per operation
+type StorageHealth struct {
+	Backend string             `json:"backend"`
+	P99Ms   map[string]float64 `json:"p99_ms"`
+}
+
+// healthHandler is the liveness probe: it answers as soon as the server
+// listens, whether or not startup has finished. A slow storage backend is
+// reported but doesn't fail the probe, since restarting won't speed it up.
+func (app *App) healthHandler(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{Status: "ok"}
+	if metered, ok := app.storage.(*MeteredStorage); ok {
+		stats := metered.Stats()
+		resp.Storage = &StorageHealth{Backend: stats.Backend, P99Ms: make(map[string]float64, len(stats.Operations))}
+		for op, latency := range stats.Operations {
+			resp.Storage.P99Ms[op] = latency.P99Ms
+		}
+	}
+	respondWithJSON(w, r, resp, http.StatusOK)
+}
@@ -47,6 +47,20 @@ const letterPositions = {
 };
 
 
+// Show the board as dormant, with the form disabled, while the spirits can't answer
+function setDormant(dormant) {
+    document.body.classList.toggle("dormant", dormant);
+    document.getElementById("dormant").hidden = !dormant;
+    document.getElementById("questionInput").disabled = dormant;
+    document.querySelector("#questionForm button[type=submit]").disabled = dormant;
+}
+
+// Check live status on load, since the page may have been cached or the
+// model may have come and gone since it was rendered
+fetch("/ready")
+    .then(response => setDormant(!response.ok))
+    .catch(() => setDormant(true));
+
 // Handle form submission
 document.getElementById("questionForm").addEventListener("submit", function(event) {
     event.preventDefault();
@@ -1,42 +1,107 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"slices"
 	"sync"
+	"time"
 )
 
+// ErrNotFound is returned when a requested Q&A pair does not exist
+var ErrNotFound = errors.New("not found")
+
 // QAPair represents a question and answer pair
 type QAPair struct {
-	Question string `json:"question"`
-	Answer   string `json:"answer"`
+	ID        int64     `json:"id"`
+	Question  string    `json:"question"`
+	Answer    string    `json:"answer"`
+	CreatedAt time.Time `json:"created_at"`
+	// Cost is the approximate generation cost, see COST_PER_TOKEN
+	Cost float64 `json:"cost,omitempty"`
+	// Tags categorize the question, e.g. "love", see TAG_KEYWORDS
+	Tags []string `json:"tags,omitempty"`
+	// Confidence is the spirits' certainty from 0 to 100, see ANSWER_CONFIDENCE
+	Confidence *int `json:"confidence,omitempty"`
+	// SessionID is the session that asked the question. It is never
+	// serialized, so session IDs can't leak through /history or snapshots.
+	SessionID string `json:"-"`
 }
 
-// Storage interface defines methods for managing Q&A history
+// Storage interface defines methods for managing Q&A history.
+//
+// Implementations keep at most MAX_HISTORY_SIZE pairs and, when HISTORY_TTL
+// is set, drop pairs older than the TTL; both limits apply together. A SQL
+// backend would index created_at and run something like
+// "DELETE FROM history WHERE created_at < ?" on Add or from a periodic job,
+// and filter reads with the same cutoff so expired rows are never served.
 type Storage interface {
-	Add(pair QAPair) error
+	// Add stores a pair, assigning it a new ID and, if unset, a creation time.
+	// Backends doing I/O should give up when ctx is done, so a slow write
+	// can't hold up shutdown.
+	Add(ctx context.Context, pair QAPair) error
+	// Get returns the pair with the given ID, or ErrNotFound
+	Get(id int64) (QAPair, error)
+	// GetAll returns every pair, oldest first. The result may be shared
+	// between callers, so it must not be modified.
 	GetAll() ([]QAPair, error)
+	// GetBySession returns the pairs asked in a session, oldest first. Unknown
+	// sessions have no pairs.
+	GetBySession(sessionID string) ([]QAPair, error)
+	// GetByTag returns the pairs carrying a normalized tag, oldest first
+	GetByTag(tag string) ([]QAPair, error)
 	Close() error
 }
 
-// MemoryStorage implements Storage interface using in-memory storage
+// MemoryStorage implements Storage interface using in-memory storage.
+//
+// pairs is append-only: new pairs are appended and old ones dropped by
+// reslicing from the front, so an element is never written twice. Readers
+// can therefore share views of the backing array without copying, and
+// writers never wait for a copy to finish.
 type MemoryStorage struct {
 	maxSize int
-	mu      sync.RWMutex
-	pairs   []QAPair
+	// ttl is how long pairs are kept, 0 keeps them until evicted by maxSize
+	ttl    time.Duration
+	mu     sync.RWMutex
+	pairs  []QAPair
+	nextID int64
+	// now is the time source, replaceable so expiry can be tested without sleeping
+	now func() time.Time
+	// feed receives every pair once it is stored
+	feed *historyFeed
 }
 
 // NewMemoryStorage creates a new MemoryStorage instance
-func NewMemoryStorage(maxSize int) *MemoryStorage {
+func NewMemoryStorage(maxSize int, ttl time.Duration) *MemoryStorage {
 	return &MemoryStorage{
 		maxSize: maxSize,
+		ttl:     ttl,
 		pairs:   make([]QAPair, 0),
+		nextID:  1,
+		now:     time.Now,
+		feed:    newHistoryFeed(),
 	}
 }
 
-// Add adds a new Q&A pair to storage
-func (s *MemoryStorage) Add(pair QAPair) error {
+// Add adds a new Q&A pair to storage and publishes it to the live feed.
+// Memory writes can't block, so ctx is ignored.
+func (s *MemoryStorage) Add(_ context.Context, pair QAPair) error {
+	pair = s.add(pair)
+	s.feed.publish(pair)
+	return nil
+}
+
+// add stores a pair and returns it with its ID and creation time set
+func (s *MemoryStorage) add(pair QAPair) QAPair {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	pair.ID = s.nextID
+	s.nextID++
+	if pair.CreatedAt.IsZero() {
+		pair.CreatedAt = s.now()
+	}
 	s.pairs = append(s.pairs, pair)
 
 	// Enforce maximum size by removing oldest entries
@@ -44,20 +109,108 @@ func (s *MemoryStorage) Add(pair QAPair) error {
 		s.pairs = s.pairs[len(s.pairs)-s.maxSize:]
 	}
 
-	return nil
+	// Drop expired entries, which are always at the front
+	s.pairs = s.pairs[s.firstLive():]
+
+	return pair
 }
 
-// GetAll returns all Q&A pairs
+// firstLive returns the index of the oldest pair within the TTL. Pairs are
+// appended in time order, so everything before it has expired. Must be
+// called with s.mu held.
+func (s *MemoryStorage) firstLive() int {
+	if s.ttl <= 0 {
+		return 0
+	}
+
+	cutoff := s.now().Add(-s.ttl)
+	i := 0
+	for i < len(s.pairs) && s.pairs[i].CreatedAt.Before(cutoff) {
+		i++
+	}
+	return i
+}
+
+// Get returns the Q&A pair with the given ID
+func (s *MemoryStorage) Get(id int64) (QAPair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// IDs are assigned in increasing order, so the slice is sorted by ID.
+	// Expired pairs waiting for the next Add are skipped.
+	lo, hi := s.firstLive(), len(s.pairs)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if s.pairs[mid].ID < id {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	if lo < len(s.pairs) && s.pairs[lo].ID == id {
+		return s.pairs[lo], nil
+	}
+	return QAPair{}, ErrNotFound
+}
+
+// GetAll returns all Q&A pairs as a view of the history, which later writes
+// never touch, so nothing is copied and the lock is held only briefly
 func (s *MemoryStorage) GetAll() ([]QAPair, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	// Return a copy to prevent external modification
-	result := make([]QAPair, len(s.pairs))
-	copy(result, s.pairs)
+	// Expired pairs that the next Add will drop are left out. Capping the
+	// capacity makes an append by the caller copy instead of writing into
+	// the shared array, where the next Add would overwrite it.
+	return s.pairs[s.firstLive():len(s.pairs):len(s.pairs)], nil
+}
+
+// GetBySession returns the Q&A pairs asked in a session
+func (s *MemoryStorage) GetBySession(sessionID string) ([]QAPair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]QAPair, 0)
+	if sessionID == "" {
+		return result, nil
+	}
+	for _, pair := range s.pairs[s.firstLive():] {
+		if pair.SessionID == sessionID {
+			result = append(result, pair)
+		}
+	}
+	return result, nil
+}
+
+// GetByTag returns the Q&A pairs carrying tag
+func (s *MemoryStorage) GetByTag(tag string) ([]QAPair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]QAPair, 0)
+	for _, pair := range s.pairs[s.firstLive():] {
+		if slices.Contains(pair.Tags, tag) {
+			result = append(result, pair)
+		}
+	}
 	return result, nil
 }
 
+// HistorySize returns how many pairs are held, leaving out expired pairs
+// that the next Add will drop, and how many may be held
+func (s *MemoryStorage) HistorySize() (pairs, maxPairs int, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.pairs) - s.firstLive(), s.maxSize, true
+}
+
+// Feed returns the live feed of newly stored pairs
+func (s *MemoryStorage) Feed() *historyFeed {
+	return s.feed
+}
+
 // Close performs cleanup
 func (s *MemoryStorage) Close() error {
 	// No resources to clean up for in-memory storage
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// fillStorage creates a storage holding n pairs
+func fillStorage(tb testing.TB, n int) *MemoryStorage {
+	tb.Helper()
+
+	storage := NewMemoryStorage(n, 0)
+	for i := 0; i < n; i++ {
+		pair := QAPair{Question: fmt.Sprintf("Question %d?", i), Answer: "YES"}
+		if err := storage.Add(context.Background(), pair); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return storage
+}
+
+func TestGetAllShared(t *testing.T) {
+	storage := fillStorage(t, 3)
+
+	pairs, err := storage.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Appending to a result mustn't reach the history or later results
+	_ = append(pairs, QAPair{Question: "Appended?"})
+	if err := storage.Add(context.Background(), QAPair{Question: "Stored?"}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := storage.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 3 || after[2].Question != "Stored?" {
+		t.Errorf("after an Add GetAll = %+v, want the stored pair last", after)
+	}
+	if len(pairs) != 3 || pairs[0].Question != "Question 0?" || pairs[2].Question != "Question 2?" {
+		t.Errorf("earlier result changed to %+v", pairs)
+	}
+}
+
+func BenchmarkGetAll(b *testing.B) {
+	storage := fillStorage(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := storage.GetAll(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGetAllWithWrites(b *testing.B) {
+	storage := fillStorage(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// One Add every 100 reads
+	for i := 0; i < b.N; i++ {
+		if i%100 == 0 {
+			if err := storage.Add(context.Background(), QAPair{Question: "Again?", Answer: "NO"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if _, err := storage.GetAll(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMemoryStorageConcurrent(t *testing.T) {
+	storage := fillStorage(t, 100)
+
+	// Readers walk every result while writers keep evicting the oldest
+	// pairs; run with -race to check the shared views
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				pair := QAPair{Question: fmt.Sprintf("Writer %d question %d?", w, i), Answer: "NO"}
+				if err := storage.Add(context.Background(), pair); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				pairs, err := storage.GetAll()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(pairs) != 100 {
+					t.Errorf("GetAll returned %d pairs, want 100", len(pairs))
+					return
+				}
+				for j := 1; j < len(pairs); j++ {
+					if pairs[j].ID <= pairs[j-1].ID {
+						t.Errorf("pairs out of order: %d after %d", pairs[j].ID, pairs[j-1].ID)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	pairs, err := storage.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 100 || pairs[len(pairs)-1].ID != 900 {
+		t.Errorf("after the writes GetAll has %d pairs ending at ID %d, want 100 ending at 900", len(pairs), pairs[len(pairs)-1].ID)
+	}
+}
+
+func BenchmarkGetAllConcurrentAdd(b *testing.B) {
+	storage := fillStorage(b, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Every parallel worker mixes one Add into every 10 reads, so readers
+	// and writers contend for the lock
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if i%10 == 0 {
+				if err := storage.Add(context.Background(), QAPair{Question: "Again?", Answer: "NO"}); err != nil {
+					b.Fatal(err)
+				}
+				continue
+			}
+			if _, err := storage.GetAll(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
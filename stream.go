@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// StreamChunk is the payload of an SSE token event
+type StreamChunk struct {
+	Chunk string `json:"chunk"`
+}
+
+// eventStream writes streaming answer events in some wire format
+type eventStream interface {
+	// send writes one event ("token", "done", "error" or "shutdown") and flushes it
+	send(event string, payload interface{}) error
+}
+
+// askStreamHandler answers a question as a Server-Sent Events stream. Each
+// chunk is sent as a "token" event, followed by a "done" event carrying the
+// full answer, or an "error" event if generation fails part way. During
+// shutdown a "shutdown" event asks the client to reconnect later. The
+// ?chunk= query param picks the granularity of token events. With
+// STREAM_RESUME_WINDOW set, events carry IDs a client can resume from.
+func (app *App) askStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if app.resumes != nil {
+		app.serveResumableStream(w, r)
+		return
+	}
+	app.serveStream(w, r, "text/event-stream", func(w http.ResponseWriter) eventStream {
+		return newSSEStream(w)
+	})
+}
+
+// serveStream answers a question as a stream of events written by the
+// stream newStream returns, with the given Content-Type
+func (app *App) serveStream(w http.ResponseWriter, r *http.Request, contentType string, newStream func(http.ResponseWriter) eventStream) {
+	granularity, ok := streamGranularity(w, r)
+	if !ok {
+		return
+	}
+
+	req, ok := app.decodeAskRequest(w, r)
+	if !ok {
+		return
+	}
+
+	done, ok := app.streams.track()
+	if !ok {
+		respondWithError(w, r, "The board is closing, ask again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+
+	release, ok := app.acquireGeneration(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	ctx, usage := app.streamContext(w, r, req)
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Queue events so a slow client can't hold up the generation
+	buffered := newBufferedStream(newStream(w), http.NewResponseController(w), streamBufferSize)
+	defer buffered.close()
+	stream := eventStream(buffered)
+
+	writeStreamHeaders(w, contentType)
+
+	stopWatching := app.watchShutdown(ctx, cancel, stream)
+	defer stopWatching()
+
+	app.streamGeneration(ctx, req, usage, granularity, stream)
+}
+
+// streamGranularity returns the ?chunk= granularity of a stream request,
+// answering 400 if it isn't supported
+func streamGranularity(w http.ResponseWriter, r *http.Request) (string, bool) {
+	granularity := r.URL.Query().Get("chunk")
+	if granularity == "" {
+		granularity = chunkToken
+	}
+	if !validChunkGranularity(granularity) {
+		respondWithError(w, r, "chunk must be token, word or char", http.StatusBadRequest)
+		return "", false
+	}
+	return granularity, true
+}
+
+// streamContext returns the context a streamed question is answered in,
+// carrying its session, usage, personality, tags, model and source
+func (app *App) streamContext(w http.ResponseWriter, r *http.Request, req AskRequest) (context.Context, *generationUsage) {
+	session := app.resolveSession(w, r)
+	usage := &generationUsage{}
+	ctx := contextWithTags(contextWithPersonality(contextWithUsage(contextWithSession(r.Context(), session), usage), req.Personality), req.Tags)
+	return contextWithSource(contextWithModel(ctx, req.Model), &reportedSource{}), usage
+}
+
+// writeStreamHeaders starts a streamed response of the given Content-Type
+func writeStreamHeaders(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+}
+
+// watchShutdown tells stream when the server starts draining, and cancels
+// ctx once the grace period is over. The returned function cancels ctx and
+// waits for the watcher to exit.
+func (app *App) watchShutdown(ctx context.Context, cancel context.CancelFunc, stream eventStream) func() {
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-app.streams.draining:
+			stream.send("shutdown", ErrorResponse{Error: "The board is closing, reconnect shortly"})
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-app.streams.closing:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-watchDone
+	}
+}
+
+// streamGeneration answers req in ctx, sending its chunks to stream as
+// "token" events followed by "done", or "error" if generation fails
+func (app *App) streamGeneration(ctx context.Context, req AskRequest, usage *generationUsage, granularity string, stream eventStream) {
+	// Anyone watching the session follows along
+	sessionID := sessionIDFromContext(ctx)
+	if watchers := app.seances.publish(sessionID); watchers != nil {
+		defer watchers.finish()
+		stream = seanceStream{eventStream: stream, watchers: watchers}
+	}
+
+	chunker := newStreamChunker(granularity, func(chunk string) error {
+		return stream.send("token", StreamChunk{Chunk: chunk})
+	})
+	start := time.Now()
+	answer, err := app.generator.StreamAnswer(ctx, req.Question, chunker.write)
+	app.metrics.observe(time.Since(start), err)
+	cost := app.costs.record(usage)
+	if err == nil {
+		err = chunker.flush()
+	}
+	if errors.Is(err, errSlowClient) {
+		// The buffered stream sends the client its parting message
+		log.Printf("Dropping slow stream client after %d queued events", streamBufferSize)
+		return
+	}
+	if err != nil {
+		// Partial answers are never stored
+		log.Printf("Error streaming answer: %v", err)
+		if errors.Is(err, ErrPromptTooLarge) {
+			stream.send("error", ErrorResponse{Error: app.messages.Load().PromptTooLarge})
+		} else if !app.streams.isClosing() {
+			stream.send("error", ErrorResponse{Error: "The spirits have lost their connection"})
+		}
+		return
+	}
+
+	if req.shouldStore() {
+		app.storeAnswer(ctx, req.Question, answer, cost)
+	}
+
+	stream.send("done", AskResponse{Answer: answer, RequestID: newRequestID(), Source: app.generatedSource(ctx)})
+}
+
+const (
+	// chunkToken passes model tokens through as they arrive
+	chunkToken = "token"
+	// chunkWord buffers tokens and emits whole words with their leading whitespace
+	chunkWord = "word"
+	// chunkChar emits one character per event
+	chunkChar = "char"
+)
+
+// validChunkGranularity reports whether g is a supported ?chunk= value
+func validChunkGranularity(g string) bool {
+	return g == chunkToken || g == chunkWord || g == chunkChar
+}
+
+// streamChunker regroups streamed model tokens into events of the requested
+// granularity. Concatenating everything it emits reproduces the input.
+type streamChunker struct {
+	granularity string
+	emit        func(string) error
+	pending     string
+}
+
+// newStreamChunker creates a chunker that passes each chunk to emit
+func newStreamChunker(granularity string, emit func(string) error) *streamChunker {
+	return &streamChunker{granularity: granularity, emit: emit}
+}
+
+// write accepts the next model token
+func (c *streamChunker) write(token string) error {
+	switch c.granularity {
+	case chunkChar:
+		for _, r := range token {
+			if err := c.emit(string(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case chunkWord:
+		c.pending += token
+		return c.emitWords()
+	default:
+		return c.emit(token)
+	}
+}
+
+// emitWords sends every word in the buffer that is known to be complete,
+// i.e. followed by whitespace, keeping the trailing partial word
+func (c *streamChunker) emitWords() error {
+	for {
+		start := strings.IndexFunc(c.pending, func(r rune) bool { return !unicode.IsSpace(r) })
+		if start < 0 {
+			return nil
+		}
+		end := strings.IndexFunc(c.pending[start:], unicode.IsSpace)
+		if end < 0 {
+			return nil
+		}
+		end += start
+
+		word := c.pending[:end]
+		c.pending = c.pending[end:]
+		if err := c.emit(word); err != nil {
+			return err
+		}
+	}
+}
+
+// flush sends any buffered partial word once the model is done
+func (c *streamChunker) flush() error {
+	if c.pending == "" {
+		return nil
+	}
+	pending := c.pending
+	c.pending = ""
+	return c.emit(pending)
+}
+
+const (
+	// streamBufferSize is how many events may queue up for a stream client
+	// before it is considered too slow and dropped
+	streamBufferSize = 64
+	// streamDropTimeout bounds the time spent telling a dropped client why
+	streamDropTimeout = 2 * time.Second
+)
+
+// errSlowClient is returned by a bufferedStream once its client has fallen
+// more than streamBufferSize events behind
+var errSlowClient = errors.New("stream client too slow")
+
+// streamEvent is one event waiting in a bufferedStream
+type streamEvent struct {
+	event   string
+	payload interface{}
+}
+
+// bufferedStream queues events for a background writer, so a slow client
+// never blocks the generation feeding it. When the queue is full the client
+// is dropped: the rest of the queue is discarded, every later send fails
+// with errSlowClient and the client gets one last "error" event.
+type bufferedStream struct {
+	next    eventStream
+	rc      *http.ResponseController
+	events  chan streamEvent
+	written chan struct{} // closed when the writer has finished
+	mu      sync.Mutex
+	err     error // first failure, nothing more is sent once set
+	closed  bool
+}
+
+// newBufferedStream starts a writer passing up to size queued events to next
+func newBufferedStream(next eventStream, rc *http.ResponseController, size int) *bufferedStream {
+	b := &bufferedStream{
+		next:    next,
+		rc:      rc,
+		events:  make(chan streamEvent, size),
+		written: make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// send queues an event without blocking, dropping the client if the queue is full
+func (b *bufferedStream) send(event string, payload interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+	if b.closed {
+		return errors.New("stream closed")
+	}
+
+	select {
+	case b.events <- streamEvent{event: event, payload: payload}:
+		return nil
+	default:
+	}
+
+	b.err = errSlowClient
+	b.closed = true
+	close(b.events)
+	// Unstick a writer blocked on the client, leaving it just long enough
+	// for the parting message
+	if err := b.rc.SetWriteDeadline(time.Now().Add(streamDropTimeout)); err != nil {
+		log.Printf("Error setting write deadline: %v", err)
+	}
+	return errSlowClient
+}
+
+// failure returns the error that ended the stream, if any
+func (b *bufferedStream) failure() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// run writes queued events until the queue is closed
+func (b *bufferedStream) run() {
+	defer close(b.written)
+
+	for ev := range b.events {
+		if b.failure() != nil {
+			// Discard the backlog of a dead stream
+			continue
+		}
+		if err := b.next.send(ev.event, ev.payload); err != nil {
+			b.mu.Lock()
+			if b.err == nil {
+				b.err = err
+			}
+			b.mu.Unlock()
+		}
+	}
+
+	if errors.Is(b.failure(), errSlowClient) {
+		b.next.send("error", ErrorResponse{Error: "The spirits cannot wait for you, reconnect to ask again"})
+	}
+}
+
+// close stops accepting events and waits for the queued ones to be written
+func (b *bufferedStream) close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.events)
+	}
+	b.mu.Unlock()
+
+	<-b.written
+}
+
+// sseStream writes Server-Sent Events, serializing writes from the handler
+// and background notifications
+type sseStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	mu sync.Mutex
+}
+
+// newSSEStream prepares w for a long-lived event stream
+func newSSEStream(w http.ResponseWriter) *sseStream {
+	return &sseStream{w: w, rc: newStreamController(w)}
+}
+
+// newStreamController returns a controller for flushing w, with the write
+// deadline cleared since streams can outlive the server's write timeout
+func newStreamController(w http.ResponseWriter) *http.ResponseController {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		log.Printf("Error clearing write deadline: %v", err)
+	}
+	return rc
+}
+
+// send writes a single event with a JSON payload and flushes it
+func (s *sseStream) send(event string, payload interface{}) error {
+	return s.sendWithID("", event, payload)
+}
+
+// sendWithID writes an event like send, tagged with id unless it is empty.
+// Browsers send the last ID they saw back as Last-Event-ID on reconnect.
+func (s *sseStream) sendWithID(id, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id != "" {
+		if _, err := fmt.Fprintf(s.w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+// streamTracker keeps count of active streaming connections so shutdown can
+// notify them and wait briefly for them to finish
+type streamTracker struct {
+	mu       sync.Mutex
+	active   int
+	idle     chan struct{}
+	draining chan struct{} // closed when shutdown begins
+	closing  chan struct{} // closed when the grace period is over
+	once     sync.Once
+}
+
+// newStreamTracker creates a new stream tracker
+func newStreamTracker() *streamTracker {
+	return &streamTracker{
+		draining: make(chan struct{}),
+		closing:  make(chan struct{}),
+	}
+}
+
+// track registers a new stream. It returns false once draining has begun;
+// otherwise the returned function must be called when the stream ends.
+func (t *streamTracker) track() (func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.draining:
+		return nil, false
+	default:
+	}
+
+	t.active++
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		t.active--
+		if t.active == 0 && t.idle != nil {
+			close(t.idle)
+			t.idle = nil
+		}
+	}, true
+}
+
+// isClosing reports whether the grace period has ended
+func (t *streamTracker) isClosing() bool {
+	select {
+	case <-t.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// Drain notifies active streams that the server is shutting down, waits up
+// to grace for them to finish, then tells the remaining ones to stop
+func (t *streamTracker) Drain(grace time.Duration) {
+	t.once.Do(func() {
+		t.mu.Lock()
+		close(t.draining)
+		var idle chan struct{}
+		if t.active > 0 {
+			idle = make(chan struct{})
+			t.idle = idle
+		}
+		t.mu.Unlock()
+
+		if idle != nil {
+			select {
+			case <-idle:
+			case <-time.After(grace):
+			}
+		}
+
+		close(t.closing)
+	})
+}
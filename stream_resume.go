@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumableGeneration records every event of one /ask/stream generation, so
+// a client that loses its connection can reconnect with Last-Event-ID and
+// pick up from the next event instead of asking again. Events are numbered
+// from 1 and their IDs are "<generation>:<number>".
+type resumableGeneration struct {
+	id      string
+	mu      sync.Mutex
+	events  []streamEvent
+	done    bool
+	changed chan struct{} // closed and replaced whenever an event is added
+}
+
+// send records an event and wakes up the clients following the generation.
+// It never blocks, so no client can hold up the generation.
+func (g *resumableGeneration) send(event string, payload interface{}) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.events = append(g.events, streamEvent{event: event, payload: payload})
+	close(g.changed)
+	g.changed = make(chan struct{})
+	return nil
+}
+
+// finish marks the generation over, ending its followers once they have
+// caught up
+func (g *resumableGeneration) finish() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.done = true
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// finished reports whether the generation is over
+func (g *resumableGeneration) finished() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.done
+}
+
+// follow writes the events after event number after to stream, then every
+// new one as it arrives, until the generation is over or ctx is done
+func (g *resumableGeneration) follow(ctx context.Context, after int, stream *sseStream) error {
+	for {
+		g.mu.Lock()
+		// Recorded events are never modified, so they can be written unlocked
+		events := g.events[min(after, len(g.events)):]
+		done, changed := g.done, g.changed
+		g.mu.Unlock()
+
+		for _, ev := range events {
+			after++
+			if err := stream.sendWithID(g.id+":"+strconv.Itoa(after), ev.event, ev.payload); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// resumeStore keeps recent generations for STREAM_RESUME_WINDOW after they
+// finish, so late reconnects can still collect the end of their answer
+type resumeStore struct {
+	window      time.Duration
+	mu          sync.Mutex
+	generations map[string]*resumableGeneration
+}
+
+// newResumeStore creates a store keeping finished generations for window
+func newResumeStore(window time.Duration) *resumeStore {
+	return &resumeStore{
+		window:      window,
+		generations: make(map[string]*resumableGeneration),
+	}
+}
+
+// start registers a new generation
+func (s *resumeStore) start() *resumableGeneration {
+	g := &resumableGeneration{id: newRequestID(), changed: make(chan struct{})}
+
+	s.mu.Lock()
+	s.generations[g.id] = g
+	s.mu.Unlock()
+	return g
+}
+
+// finish marks g over and forgets it once the window has passed
+func (s *resumeStore) finish(g *resumableGeneration) {
+	g.finish()
+	time.AfterFunc(s.window, func() {
+		s.mu.Lock()
+		delete(s.generations, g.id)
+		s.mu.Unlock()
+	})
+}
+
+// lookup returns the generation a Last-Event-ID belongs to and the number
+// of the last event the client saw
+func (s *resumeStore) lookup(lastEventID string) (*resumableGeneration, int, bool) {
+	id, number, ok := strings.Cut(lastEventID, ":")
+	if !ok {
+		return nil, 0, false
+	}
+	seen, err := strconv.Atoi(number)
+	if err != nil || seen < 0 {
+		return nil, 0, false
+	}
+
+	s.mu.Lock()
+	g, ok := s.generations[id]
+	s.mu.Unlock()
+	return g, seen, ok
+}
+
+// serveResumableStream answers /ask/stream with numbered events. The
+// generation runs on its own and is recorded, so it carries on when the
+// client disconnects, and a client reconnecting with Last-Event-ID is sent
+// the rest of it rather than a new answer. An unknown or expired ID asks
+// the question again.
+func (app *App) serveResumableStream(w http.ResponseWriter, r *http.Request) {
+	done, ok := app.streams.track()
+	if !ok {
+		respondWithError(w, r, "The board is closing, ask again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	defer done()
+
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		if g, seen, ok := app.resumes.lookup(lastEventID); ok {
+			app.followGeneration(w, r, g, seen)
+			return
+		}
+	}
+
+	granularity, ok := streamGranularity(w, r)
+	if !ok {
+		return
+	}
+
+	req, ok := app.decodeAskRequest(w, r)
+	if !ok {
+		return
+	}
+
+	release, ok := app.acquireGeneration(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, usage := app.streamContext(w, r, req)
+	// The generation outlives the request, but the session, personality
+	// and tags it carries still apply, and REQUEST_TIMEOUT still bounds it
+	ctx = context.WithoutCancel(ctx)
+	var cancel context.CancelFunc
+	if app.config.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, app.config.RequestTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	// The generation is tracked on its own, so draining waits for it even
+	// after the client that started it has gone
+	generationDone, ok := app.streams.track()
+	if !ok {
+		cancel()
+		release()
+		respondWithError(w, r, "The board is closing, ask again shortly", http.StatusServiceUnavailable)
+		return
+	}
+
+	g := app.resumes.start()
+	go func() {
+		defer generationDone()
+		defer release()
+		defer app.resumes.finish(g)
+
+		stopWatching := app.watchShutdown(ctx, cancel, g)
+		defer stopWatching()
+
+		app.streamGeneration(ctx, req, usage, granularity, g)
+	}()
+
+	app.followGeneration(w, r, g, 0)
+}
+
+// followGeneration streams g's events after event number seen to the client
+func (app *App) followGeneration(w http.ResponseWriter, r *http.Request, g *resumableGeneration, seen int) {
+	stream := newSSEStream(w)
+	writeStreamHeaders(w, "text/event-stream")
+
+	// A client gone mid-stream can reconnect, so there's nothing to report
+	g.follow(r.Context(), seen, stream)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingStream is an eventStream that records events, optionally
+// blocking on each send until released, like a client that stopped reading
+type recordingStream struct {
+	release chan struct{} // nil never blocks
+	mu      sync.Mutex
+	events  []string
+}
+
+func (s *recordingStream) send(event string, payload interface{}) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// sent returns the events sent so far
+func (s *recordingStream) sent() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.events...)
+}
+
+func TestBufferedStreamDropsSlowClient(t *testing.T) {
+	const size, tokens = 4, 20
+
+	fast := &recordingStream{}
+	slow := &recordingStream{release: make(chan struct{})}
+	fastBuffered := newBufferedStream(fast, http.NewResponseController(httptest.NewRecorder()), size)
+	slowBuffered := newBufferedStream(slow, http.NewResponseController(httptest.NewRecorder()), size)
+
+	// One generation feeds both clients; it must never wait on the slow one
+	start := time.Now()
+	var slowErr error
+	for i := 0; i < tokens; i++ {
+		if err := fastBuffered.send("token", StreamChunk{Chunk: "x"}); err != nil {
+			t.Fatalf("fast client failed at token %d: %v", i, err)
+		}
+		if err := slowBuffered.send("token", StreamChunk{Chunk: "x"}); err != nil && slowErr == nil {
+			slowErr = err
+		}
+		// Give the fast writer time to keep up, as a real client would
+		time.Sleep(time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("generation took %v, held up by the slow client", elapsed)
+	}
+	if !errors.Is(slowErr, errSlowClient) {
+		t.Fatalf("slow client error = %v, want errSlowClient", slowErr)
+	}
+	if err := slowBuffered.send("done", nil); !errors.Is(err, errSlowClient) {
+		t.Errorf("send after the drop = %v, want errSlowClient", err)
+	}
+
+	if err := fastBuffered.send("done", nil); err != nil {
+		t.Fatal(err)
+	}
+	fastBuffered.close()
+	if events := fast.sent(); len(events) != tokens+1 || events[len(events)-1] != "done" {
+		t.Errorf("fast client got %d events ending %q, want %d tokens and done", len(events), events[len(events)-1], tokens)
+	}
+
+	// The slow client, once it reads again, gets what it had taken and a
+	// parting error instead of the backlog
+	close(slow.release)
+	slowBuffered.close()
+	events := slow.sent()
+	if len(events) == 0 || events[len(events)-1] != "error" {
+		t.Fatalf("slow client got %q, want it to end with error", events)
+	}
+	// At most the token it was stuck writing, then the error
+	if len(events) > 2 {
+		t.Errorf("slow client got %q, want the backlog discarded", events)
+	}
+}
+
+func TestAskStreamGetResume(t *testing.T) {
+	gen := &FakeGenerator{Answer: "THE SPIRITS SAY YES"}
+	app := newTestApp(t, gen)
+	app.resumes = newResumeStore(time.Minute)
+	srv := httptest.NewServer(http.HandlerFunc(app.askStreamHandler))
+	defer srv.Close()
+
+	// get asks like EventSource does, optionally reconnecting
+	get := func(lastEventID string) []sseEvent {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/ask/stream?q=Will+it+rain%3F", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d, want 200", resp.StatusCode)
+		}
+		return readSSE(t, bufio.NewReader(resp.Body), "done")
+	}
+
+	first := get("")
+	if got := tokens(first); got != "THE SPIRITS SAY YES" {
+		t.Fatalf("streamed %q, want the answer", got)
+	}
+	if asked := gen.Questions(); len(asked) != 1 || asked[0] != "Will it rain?" {
+		t.Fatalf("asked %q, want the question from q", asked)
+	}
+
+	// Reconnecting after the first event sends only the rest
+	resumed := get(first[0].id)
+	if got, want := tokens(resumed), tokens(first[1:]); got != want {
+		t.Errorf("resumed with %q, want %q", got, want)
+	}
+	if len(resumed) != len(first)-1 || resumed[0].id != first[1].id || resumed[len(resumed)-1].event != "done" {
+		t.Errorf("resumed with events %+v, want those after %s", resumed, first[0].id)
+	}
+	if asked := gen.Questions(); len(asked) != 1 {
+		t.Errorf("resuming asked the question again, %d questions asked", len(asked))
+	}
+}
+
+func TestDrainWaitsForResumableGeneration(t *testing.T) {
+	gen := &FakeGenerator{Answer: "YES", Delay: 200 * time.Millisecond}
+	app := newTestApp(t, gen)
+	app.resumes = newResumeStore(time.Minute)
+	srv := httptest.NewServer(http.HandlerFunc(app.askStreamHandler))
+	defer srv.Close()
+
+	// The client gives up while the answer is still being generated
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/ask/stream?q=Will+it+rain%3F", nil)
+	go func() {
+		for len(gen.Questions()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	// Draining waits for the generation the client left behind
+	app.streams.Drain(5 * time.Second)
+
+	app.resumes.mu.Lock()
+	defer app.resumes.mu.Unlock()
+	if len(app.resumes.generations) != 1 {
+		t.Fatalf("%d generations recorded, want 1", len(app.resumes.generations))
+	}
+	for _, g := range app.resumes.generations {
+		if !g.finished() {
+			t.Error("drain returned before the generation finished")
+		}
+	}
+}
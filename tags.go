@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxTags is the most tags a question may carry
+	maxTags = 5
+	// maxTagLength is the longest tag accepted, in bytes
+	maxTagLength = 32
+)
+
+// tagPattern is what a normalized tag looks like, e.g. "love" or "day-job"
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// normalizeTags lowercases and trims tags and drops blanks and duplicates,
+// failing if any is malformed or there are too many
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || slices.Contains(normalized, tag) {
+			continue
+		}
+		if len(tag) > maxTagLength || !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("tags must be letters, digits, - or _, at most %d characters each", maxTagLength)
+		}
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return normalized, nil
+}
+
+// splitTags splits a comma-separated tag list from a form or query string
+func splitTags(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// tagClassifier tags questions by keyword, see TAG_KEYWORDS
+type tagClassifier struct {
+	tags     []string
+	patterns map[string]*regexp.Regexp
+}
+
+// newTagClassifier creates a classifier from tag=keyword|keyword entries,
+// or nil when there are none
+func newTagClassifier(keywords map[string]string) (*tagClassifier, error) {
+	if len(keywords) == 0 {
+		return nil, nil
+	}
+
+	c := &tagClassifier{patterns: make(map[string]*regexp.Regexp, len(keywords))}
+	for tag, words := range keywords {
+		normalized, err := normalizeTags([]string{tag})
+		if err != nil || len(normalized) == 0 {
+			return nil, fmt.Errorf("invalid TAG_KEYWORDS tag %q", tag)
+		}
+		tag = normalized[0]
+
+		quoted := make([]string, 0)
+		for _, word := range strings.Split(words, "|") {
+			if word = strings.TrimSpace(word); word != "" {
+				quoted = append(quoted, regexp.QuoteMeta(word))
+			}
+		}
+		if len(quoted) == 0 {
+			return nil, fmt.Errorf("TAG_KEYWORDS tag %q has no keywords", tag)
+		}
+
+		pattern, err := regexp.Compile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TAG_KEYWORDS keywords for %q: %w", tag, err)
+		}
+		c.tags = append(c.tags, tag)
+		c.patterns[tag] = pattern
+	}
+	// Classify in a stable order so the maxTags cut is predictable
+	sort.Strings(c.tags)
+	return c, nil
+}
+
+// classify returns the tags whose keywords appear in question
+func (c *tagClassifier) classify(question string) []string {
+	if c == nil {
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range c.tags {
+		if c.patterns[tag].MatchString(question) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// mergeTags adds the tags in extra that aren't in tags, up to maxTags,
+// leaving tags itself untouched
+func mergeTags(tags, extra []string) []string {
+	tags = slices.Clip(tags)
+	for _, tag := range extra {
+		if len(tags) >= maxTags {
+			break
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// tagsContextKey is the context key for the tags a request asked for
+type tagsContextKey struct{}
+
+// contextWithTags returns a context carrying a question's tags to history
+func contextWithTags(ctx context.Context, tags []string) context.Context {
+	if len(tags) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, tagsContextKey{}, tags)
+}
+
+// tagsFromContext returns the tags carried by ctx
+func tagsFromContext(ctx context.Context) []string {
+	tags, _ := ctx.Value(tagsContextKey{}).([]string)
+	return tags
+}
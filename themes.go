@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// Palette holds the colors used to render the board page
+type Palette struct {
+	Background string `json:"background"`
+	Text       string `json:"text"`
+	Border     string `json:"border"`
+	Control    string `json:"control"`
+}
+
+// Theme is a named visual theme for the board
+type Theme struct {
+	Name    string  `json:"name"`
+	Palette Palette `json:"palette"`
+}
+
+// themes are the available board themes, selectable with BOARD_THEME or ?theme=
+var themes = map[string]Theme{
+	"classic": {
+		Name: "classic",
+		Palette: Palette{
+			Background: "#2e2e2e",
+			Text:       "#e0e0e0",
+			Border:     "#e0e0e0",
+			Control:    "#000000b3",
+		},
+	},
+	"wood": {
+		Name: "wood",
+		Palette: Palette{
+			Background: "#3b2a1a",
+			Text:       "#f3e2c7",
+			Border:     "#8b5a2b",
+			Control:    "#3b230fcc",
+		},
+	},
+	"neon": {
+		Name: "neon",
+		Palette: Palette{
+			Background: "#0b0b1a",
+			Text:       "#39ff14",
+			Border:     "#ff00ff",
+			Control:    "#140028cc",
+		},
+	},
+	"spooky": {
+		Name: "spooky",
+		Palette: Palette{
+			Background: "#120a0a",
+			Text:       "#d9c9a3",
+			Border:     "#7a0000",
+			Control:    "#1e0000cc",
+		},
+	},
+}
+
+// themeNames returns the names of the available themes, sorted
+func themeNames() []string {
+	names := make([]string, 0, len(themes))
+	for name := range themes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveTheme returns the theme requested by ?theme=, or the configured
+// theme if none was requested. ok is false for an unknown requested theme.
+func (app *App) resolveTheme(r *http.Request) (theme Theme, ok bool) {
+	name := r.URL.Query().Get("theme")
+	if name == "" {
+		return themes[app.config.BoardTheme], true
+	}
+
+	theme, ok = themes[name]
+	return theme, ok
+}
+
+// themeHandler returns the active theme and its palette
+func (app *App) themeHandler(w http.ResponseWriter, r *http.Request) {
+	theme, ok := app.resolveTheme(r)
+	if !ok {
+		respondWithError(w, r, "The spirits know no such theme", http.StatusBadRequest)
+		return
+	}
+
+	respondWithJSON(w, r, theme, http.StatusOK)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// moodInstruction is appended to the prompt with the mood picked for a question
+const moodInstruction = "Answer in a %s mood, while staying a Ouija board."
+
+// answerVariation picks a random mood and temperature offset per question,
+// so a fixed prompt doesn't keep producing the same few answers. A fixed
+// seed makes the sequence of picks repeatable.
+type answerVariation struct {
+	moods []string
+	// jitter is the largest temperature offset, either way
+	jitter float64
+	mu     sync.Mutex
+	rng    *rand.Rand
+}
+
+// newAnswerVariation creates a variation source, or returns nil when there
+// are no moods and no jitter. A seed of 0 seeds from the clock.
+func newAnswerVariation(moods []string, jitter float64, seed int64) *answerVariation {
+	if len(moods) == 0 && jitter <= 0 {
+		return nil
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &answerVariation{
+		moods:  moods,
+		jitter: max(jitter, 0),
+		rng:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// moodInstruction returns the prompt line for a randomly picked mood, or ""
+// when no moods are configured
+func (v *answerVariation) moodInstruction() string {
+	if v == nil || len(v.moods) == 0 {
+		return ""
+	}
+
+	v.mu.Lock()
+	mood := v.moods[v.rng.Intn(len(v.moods))]
+	v.mu.Unlock()
+	return fmt.Sprintf(moodInstruction, mood)
+}
+
+// temperatureOffset returns a random offset in [-jitter, jitter] to add to
+// the base temperature, 0 when jitter is off
+func (v *answerVariation) temperatureOffset() float64 {
+	if v == nil || v.jitter == 0 {
+		return 0
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return (v.rng.Float64()*2 - 1) * v.jitter
+}
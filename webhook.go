@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// callbackBaseBackoff is the wait before the first callback retry, doubling
+// with each further attempt
+const callbackBaseBackoff = time.Second
+
+// CallbackPayload is POSTed to a request's callback_url once it is answered
+type CallbackPayload struct {
+	RequestID string `json:"request_id"`
+	Question  string `json:"question"`
+	Answer    string `json:"answer"`
+	// Confidence is only given with ANSWER_CONFIDENCE on
+	Confidence *int   `json:"confidence,omitempty"`
+	Source     string `json:"source"`
+}
+
+// AcceptedResponse is returned when an answer will be delivered by callback
+type AcceptedResponse struct {
+	RequestID string `json:"request_id"`
+	Status    string `json:"status"`
+}
+
+// callbackSender delivers answers to callback URLs in the background. Only
+// hosts on the allow-list may be called, so the board can't be used to reach
+// internal services (SSRF); redirects are not followed for the same reason.
+type callbackSender struct {
+	allowedHosts []string
+	retries      int
+	client       *http.Client
+	inFlight     sync.WaitGroup
+}
+
+// newCallbackSender creates a sender for allowedHosts, retrying failed
+// deliveries up to retries times
+func newCallbackSender(allowedHosts []string, retries int, timeout time.Duration) *callbackSender {
+	hosts := make([]string, len(allowedHosts))
+	for i, host := range allowedHosts {
+		hosts[i] = strings.ToLower(host)
+	}
+
+	return &callbackSender{
+		allowedHosts: hosts,
+		retries:      retries,
+		client: &http.Client{
+			Timeout: timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// validate checks that a callback URL is http(s), carries no credentials
+// and points at an allowed host
+func (s *callbackSender) validate(raw string) error {
+	if len(s.allowedHosts) == 0 {
+		return errors.New("callbacks are not enabled on this board")
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("callback_url must be an http or https URL")
+	}
+	if u.User != nil {
+		return errors.New("callback_url must not contain credentials")
+	}
+	if !slices.Contains(s.allowedHosts, strings.ToLower(u.Hostname())) {
+		return errors.New("callback_url host is not allowed")
+	}
+	return nil
+}
+
+// deliver POSTs payload to callbackURL, retrying with exponential backoff
+// until a 2xx response or the retries run out
+func (s *callbackSender) deliver(ctx context.Context, callbackURL string, payload CallbackPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal callback: %w", err)
+	}
+
+	backoff := callbackBaseBackoff
+	for attempt := 0; ; attempt++ {
+		err = s.post(ctx, callbackURL, body)
+		if err == nil || attempt >= s.retries {
+			return err
+		}
+
+		log.Printf("Callback for %s failed, retrying in %v (%d/%d): %v", payload.RequestID, backoff, attempt+1, s.retries, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// post makes one delivery attempt
+func (s *callbackSender) post(ctx context.Context, callbackURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Wait waits up to timeout for deliveries in progress, so shutdown doesn't
+// drop answers that are nearly done
+func (s *callbackSender) Wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Gave up waiting for answer callbacks")
+	}
+}
+
+// askWithCallback answers req in the background and POSTs the answer to its
+// callback_url, responding 202 Accepted straight away. A generation slot is
+// taken before accepting, so a busy board still answers 503.
+func (app *App) askWithCallback(ctx context.Context, w http.ResponseWriter, r *http.Request, req AskRequest, usage *generationUsage) {
+	if err := app.callbacks.validate(req.CallbackURL); err != nil {
+		respondWithError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	release, ok := app.acquireGeneration(w, r)
+	if !ok {
+		return
+	}
+
+	// The request is over once accepted, but the session, namespace and
+	// personality it carries still apply
+	ctx = context.WithoutCancel(ctx)
+
+	requestID := newRequestID()
+	app.callbacks.inFlight.Add(1)
+	go func() {
+		defer app.callbacks.inFlight.Done()
+
+		// REQUEST_TIMEOUT bounds the generation, as it would have on the request
+		generateCtx := ctx
+		if app.config.RequestTimeout > 0 {
+			var cancel context.CancelFunc
+			generateCtx, cancel = context.WithTimeout(ctx, app.config.RequestTimeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+		answer, err := app.generator.GenerateAnswer(generateCtx, req.Question)
+		app.metrics.observe(time.Since(start), err)
+		release()
+		cost := app.costs.record(usage)
+
+		source := app.generatedSource(ctx)
+		if fallback, ok := app.fallback(err); ok {
+			log.Printf("Error generating answer, using fallback: %v", err)
+			answer, err, source = fallback, nil, answerSourceFallback
+		}
+		if err != nil {
+			log.Printf("Error generating answer for callback %s: %v", requestID, err)
+			return
+		}
+
+		if req.shouldStore() {
+			app.storeAnswer(ctx, req.Question, answer, cost)
+		}
+
+		payload := CallbackPayload{RequestID: requestID, Question: req.Question, Answer: answer, Confidence: confidenceFromContext(ctx), Source: source}
+		if err := app.callbacks.deliver(ctx, req.CallbackURL, payload); err != nil {
+			log.Printf("Giving up on callback for %s: %v", requestID, err)
+		}
+	}()
+
+	respondWithJSON(w, r, AcceptedResponse{RequestID: requestID, Status: "accepted"}, http.StatusAccepted)
+}